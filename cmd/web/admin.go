@@ -0,0 +1,284 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strconv"
+    "time"
+
+    "github.com/cpucortexm/chunkbox/internal/models"
+    "github.com/cpucortexm/chunkbox/internal/validator"
+    "github.com/julienschmidt/httprouter"
+)
+
+// The admin area under /admin. Moderators can look after the chunks; only
+// admins can look after the users and see the system stats. Everything an
+// admin or moderator changes is logged, with who did it.
+
+// adminPageSize is how many chunks or users are listed per page.
+const adminPageSize = 50
+
+// extendDays are the numbers of days a moderator can extend a chunk by.
+var extendDays = []int{1, 7, 30, 365}
+
+// pageParam returns the page number from the page query string parameter.
+// Pages start at 1, which is also what a missing or invalid page gets.
+func pageParam(r *http.Request) int {
+    page, err := strconv.Atoi(r.URL.Query().Get("page"))
+    if err != nil || page < 1 {
+        return 1
+    }
+    return page
+}
+
+// adminReturnURL returns the URL of the list page at path with the search
+// query and page from the form, so that after a change the moderator is
+// back where they were.
+func adminReturnURL(path string, r *http.Request) string {
+    query := url.Values{}
+    if q := r.PostForm.Get("q"); q != "" {
+        query.Set("q", q)
+    }
+    if page := r.PostForm.Get("page"); page != "" && page != "1" {
+        query.Set("page", page)
+    }
+    if len(query) == 0 {
+        return path
+    }
+    return path + "?" + query.Encode()
+}
+
+// The adminHome handler shows the links to the parts of the admin area the
+// user may see.
+func (app *application) adminHome(w http.ResponseWriter, r *http.Request) {
+    app.render(w, r, http.StatusOK, "admin.html", app.newTemplateData(r))
+}
+
+// The adminChunks handler lists all the chunks, including expired ones,
+// optionally only those whose slug or title contains the q parameter.
+func (app *application) adminChunks(w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query().Get("q")
+    page := pageParam(r)
+
+    chunks, more, err := app.chunks.Search(r.Context(), query, adminPageSize, (page-1)*adminPageSize)
+    if err != nil {
+        app.serverError(w, r, err)
+        return
+    }
+
+    data := app.newTemplateData(r)
+    data.Chunks = chunks
+    data.Query = query
+    data.Page = page
+    data.MorePages = more
+    data.ExtendDays = extendDays
+    app.render(w, r, http.StatusOK, "admin_chunks.html", data)
+}
+
+// The adminChunkDeletePost handler deletes a chunk, whoever it belongs to.
+func (app *application) adminChunkDeletePost(w http.ResponseWriter, r *http.Request) {
+    err := r.ParseForm()
+    if err != nil {
+        app.clientError(w, r, http.StatusBadRequest)
+        return
+    }
+    slug := httprouter.ParamsFromContext(r.Context()).ByName("slug")
+
+    err = app.chunks.DeleteAny(r.Context(), slug)
+    if err != nil {
+        if errors.Is(err, models.ErrNoRecord) {
+            app.notFound(w, r)
+        } else {
+            app.serverError(w, r, err)
+        }
+        return
+    }
+    app.logger.Info("admin: deleted chunk", "request_id", requestIDFromContext(r.Context()),
+        "slug", slug, "by", userIDFromContext(r.Context()))
+
+    app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("Chunk %s has been deleted.", slug))
+    http.Redirect(w, r, adminReturnURL("/admin/chunks", r), http.StatusSeeOther)
+}
+
+// The adminChunkExtendPost handler pushes back the expiry of a chunk by the
+// number of days in the days field. Expired chunks come back to life.
+func (app *application) adminChunkExtendPost(w http.ResponseWriter, r *http.Request) {
+    err := r.ParseForm()
+    if err != nil {
+        app.clientError(w, r, http.StatusBadRequest)
+        return
+    }
+    days, err := strconv.Atoi(r.PostForm.Get("days"))
+    if err != nil || !validator.PermittedInt(days, extendDays...) {
+        app.clientError(w, r, http.StatusBadRequest)
+        return
+    }
+    slug := httprouter.ParamsFromContext(r.Context()).ByName("slug")
+
+    err = app.chunks.Extend(r.Context(), slug, days)
+    if err != nil {
+        if errors.Is(err, models.ErrNoRecord) {
+            app.notFound(w, r)
+        } else {
+            app.serverError(w, r, err)
+        }
+        return
+    }
+    app.logger.Info("admin: extended chunk", "request_id", requestIDFromContext(r.Context()),
+        "slug", slug, "days", days, "by", userIDFromContext(r.Context()))
+
+    app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("Chunk %s has been extended by %d days.", slug, days))
+    http.Redirect(w, r, adminReturnURL("/admin/chunks", r), http.StatusSeeOther)
+}
+
+// The adminUsers handler lists the users, optionally only those whose name
+// or email address contains the q parameter.
+func (app *application) adminUsers(w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query().Get("q")
+    page := pageParam(r)
+
+    users, more, err := app.users.Search(r.Context(), query, adminPageSize, (page-1)*adminPageSize)
+    if err != nil {
+        app.serverError(w, r, err)
+        return
+    }
+
+    data := app.newTemplateData(r)
+    data.Users = users
+    data.Query = query
+    data.Page = page
+    data.MorePages = more
+    data.Roles = models.Roles
+    app.render(w, r, http.StatusOK, "admin_users.html", data)
+}
+
+// userFromPath parses the :id parameter of an /admin/users/:id URL. Admins
+// can't change their own account here, so that nobody locks themselves out
+// of the admin area by mistake. If the ID is no good it sends the response
+// itself and returns false.
+func (app *application) userFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+    id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+    if err != nil || id < 1 {
+        app.notFound(w, r)
+        return 0, false
+    }
+    if id == userIDFromContext(r.Context()) {
+        app.errorResponse(w, r, http.StatusForbidden, "You can't change your own account. Ask another admin.", "")
+        return 0, false
+    }
+    return id, true
+}
+
+// The adminUserRolePost handler gives a user the role in the role field.
+func (app *application) adminUserRolePost(w http.ResponseWriter, r *http.Request) {
+    err := r.ParseForm()
+    if err != nil {
+        app.clientError(w, r, http.StatusBadRequest)
+        return
+    }
+    role := r.PostForm.Get("role")
+    if !validator.PermittedValue(role, models.Roles...) {
+        app.clientError(w, r, http.StatusBadRequest)
+        return
+    }
+    id, ok := app.userFromPath(w, r)
+    if !ok {
+        return
+    }
+
+    err = app.users.SetRole(r.Context(), id, role)
+    if err != nil {
+        if errors.Is(err, models.ErrNoRecord) {
+            app.notFound(w, r)
+        } else {
+            app.serverError(w, r, err)
+        }
+        return
+    }
+    app.logger.Info("admin: changed user role", "request_id", requestIDFromContext(r.Context()),
+        "user_id", id, "role", role, "by", userIDFromContext(r.Context()))
+
+    app.sessionManager.Put(r.Context(), "flash", "The user's role has been changed.")
+    http.Redirect(w, r, adminReturnURL("/admin/users", r), http.StatusSeeOther)
+}
+
+// The adminUserDisabledPost handler disables a user, or enables them again,
+// depending on the disabled field. A disabled user is logged out of every
+// session and their API tokens stop working, but their chunks stay.
+func (app *application) adminUserDisabledPost(w http.ResponseWriter, r *http.Request) {
+    err := r.ParseForm()
+    if err != nil {
+        app.clientError(w, r, http.StatusBadRequest)
+        return
+    }
+    disabled, err := strconv.ParseBool(r.PostForm.Get("disabled"))
+    if err != nil {
+        app.clientError(w, r, http.StatusBadRequest)
+        return
+    }
+    id, ok := app.userFromPath(w, r)
+    if !ok {
+        return
+    }
+
+    err = app.users.SetDisabled(r.Context(), id, disabled)
+    if err != nil {
+        if errors.Is(err, models.ErrNoRecord) {
+            app.notFound(w, r)
+        } else {
+            app.serverError(w, r, err)
+        }
+        return
+    }
+    app.logger.Info("admin: changed user disabled", "request_id", requestIDFromContext(r.Context()),
+        "user_id", id, "disabled", disabled, "by", userIDFromContext(r.Context()))
+
+    message := "The user has been enabled."
+    if disabled {
+        message = "The user has been disabled."
+    }
+    app.sessionManager.Put(r.Context(), "flash", message)
+    http.Redirect(w, r, adminReturnURL("/admin/users", r), http.StatusSeeOther)
+}
+
+// The adminStats handler shows the numbers of chunks and users, and the
+// state of the database connection pool from sql.DB.Stats().
+func (app *application) adminStats(w http.ResponseWriter, r *http.Request) {
+    stats := &statsData{}
+
+    var err error
+    stats.Chunks.Live, stats.Chunks.Expired, err = app.chunks.Counts(r.Context())
+    if err != nil {
+        app.serverError(w, r, err)
+        return
+    }
+    stats.Users.Total, stats.Users.Disabled, err = app.users.Counts(r.Context())
+    if err != nil {
+        app.serverError(w, r, err)
+        return
+    }
+
+    db := app.chunks.DB.Stats()
+    stats.DB = dbStats{
+        MaxOpenConnections: db.MaxOpenConnections,
+        OpenConnections:    db.OpenConnections,
+        InUse:              db.InUse,
+        Idle:               db.Idle,
+        WaitCount:          db.WaitCount,
+        WaitDuration:       db.WaitDuration.Round(time.Millisecond).String(),
+        MaxIdleClosed:      db.MaxIdleClosed,
+        MaxIdleTimeClosed:  db.MaxIdleTimeClosed,
+        MaxLifetimeClosed:  db.MaxLifetimeClosed,
+    }
+
+    if wantsJSON(r) {
+        app.writeJSON(w, http.StatusOK, map[string]any{"stats": stats})
+        return
+    }
+
+    data := app.newTemplateData(r)
+    data.Stats = stats
+    app.render(w, r, http.StatusOK, "admin_stats.html", data)
+}
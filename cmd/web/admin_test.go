@@ -0,0 +1,181 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "testing"
+
+    "github.com/cpucortexm/chunkbox/internal/assert"
+    "github.com/cpucortexm/chunkbox/internal/models"
+    "github.com/cpucortexm/chunkbox/internal/models/mocks"
+)
+
+// newAdminTest returns a test server with a user of each role, whose
+// passwords are all "pa55word".
+func newAdminTest(t *testing.T) (*testServer, *mocks.UserModel) {
+    t.Helper()
+
+    app := newTestApplication(t)
+    users := app.users.(*mocks.UserModel)
+    for _, role := range models.Roles {
+        id := users.AddUser(role, role+"@example.com", "pa55word")
+        err := users.SetRole(context.Background(), id, role)
+        assert.NilError(t, err)
+    }
+    return newTestServer(t, app.routes()), users
+}
+
+// logIn logs in with the email address and password, as a new browser.
+func logIn(t *testing.T, ts *testServer, email string) {
+    t.Helper()
+
+    ts.resetCookies(t)
+    _, _, body := ts.get(t, "/user/login")
+    form := url.Values{
+        "email":      {email},
+        "password":   {"pa55word"},
+        "csrf_token": {extractCSRFToken(t, body)},
+    }
+    code, _, _ := ts.postForm(t, "/user/login", form)
+    assert.Equal(t, code, http.StatusSeeOther)
+}
+
+// loggedIn reports whether the browser is logged in, going by the logout
+// button in the navigation.
+func loggedIn(t *testing.T, ts *testServer) bool {
+    t.Helper()
+
+    _, _, body := ts.get(t, "/user/login")
+    return strings.Contains(body, "<button>Logout</button>")
+}
+
+func TestAdminRoles(t *testing.T) {
+    ts, _ := newAdminTest(t)
+
+    tests := []struct {
+        name     string
+        email    string
+        path     string
+        wantCode int
+    }{
+        {"Not logged in", "", "/admin", http.StatusSeeOther},
+        {"User on the admin home", "user@example.com", "/admin", http.StatusForbidden},
+        {"User on chunks", "user@example.com", "/admin/chunks", http.StatusForbidden},
+        {"User on users", "user@example.com", "/admin/users", http.StatusForbidden},
+        {"User on stats", "user@example.com", "/admin/stats", http.StatusForbidden},
+        {"Moderator on the admin home", "moderator@example.com", "/admin", http.StatusOK},
+        {"Moderator on users", "moderator@example.com", "/admin/users", http.StatusForbidden},
+        {"Moderator on stats", "moderator@example.com", "/admin/stats", http.StatusForbidden},
+        {"Admin on the admin home", "admin@example.com", "/admin", http.StatusOK},
+        {"Admin on users", "admin@example.com", "/admin/users", http.StatusOK},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if tt.email == "" {
+                ts.resetCookies(t)
+            } else {
+                logIn(t, ts, tt.email)
+            }
+
+            code, header, _ := ts.get(t, tt.path)
+            assert.Equal(t, code, tt.wantCode)
+            if tt.wantCode == http.StatusSeeOther {
+                assert.Equal(t, header.Get("Location"), "/user/login")
+            }
+        })
+    }
+
+    // A user can't get at the forms of the admin area either.
+    logIn(t, ts, "user@example.com")
+    _, _, body := ts.get(t, "/user/login")
+    code, _, _ := ts.postForm(t, "/admin/users/1/role", url.Values{
+        "role":       {models.RoleAdmin},
+        "csrf_token": {extractCSRFToken(t, body)},
+    })
+    assert.Equal(t, code, http.StatusForbidden)
+}
+
+func TestAdminOwnAccount(t *testing.T) {
+    ts, users := newAdminTest(t)
+    logIn(t, ts, "admin@example.com")
+    adminID := len(models.Roles)
+    _, _, body := ts.get(t, "/admin/users")
+    csrfToken := extractCSRFToken(t, body)
+
+    tests := []struct {
+        name string
+        path string
+        form url.Values
+    }{
+        {
+            name: "Role",
+            path: "/admin/users/" + strconv.Itoa(adminID) + "/role",
+            form: url.Values{"role": {models.RoleUser}},
+        },
+        {
+            name: "Disabled",
+            path: "/admin/users/" + strconv.Itoa(adminID) + "/disabled",
+            form: url.Values{"disabled": {"true"}},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            tt.form.Set("csrf_token", csrfToken)
+            code, _, body := ts.postForm(t, tt.path, tt.form)
+            assert.Equal(t, code, http.StatusForbidden)
+            assert.StringContains(t, body, "You can&#39;t change your own account")
+
+            u, err := users.Get(context.Background(), adminID)
+            assert.NilError(t, err)
+            assert.Equal(t, u.Role, models.RoleAdmin)
+            assert.Equal(t, u.Disabled, false)
+        })
+    }
+
+    // Other users' accounts can be changed.
+    code, _, _ := ts.postForm(t, "/admin/users/1/role", url.Values{
+        "role":       {models.RoleModerator},
+        "csrf_token": {csrfToken},
+    })
+    assert.Equal(t, code, http.StatusSeeOther)
+    u, err := users.Get(context.Background(), 1)
+    assert.NilError(t, err)
+    assert.Equal(t, u.Role, models.RoleModerator)
+}
+
+func TestDisabledUserLoggedOut(t *testing.T) {
+    ts, users := newAdminTest(t)
+
+    logIn(t, ts, "user@example.com")
+    assert.Equal(t, loggedIn(t, ts), true)
+
+    // Disabling a user logs them out of the sessions they already have.
+    err := users.SetDisabled(context.Background(), 1, true)
+    assert.NilError(t, err)
+    assert.Equal(t, loggedIn(t, ts), false)
+    code, header, _ := ts.get(t, "/settings/tokens")
+    assert.Equal(t, code, http.StatusSeeOther)
+    assert.Equal(t, header.Get("Location"), "/user/login")
+
+    // And they can't log in again.
+    _, _, body := ts.get(t, "/user/login")
+    code, _, body = ts.postForm(t, "/user/login", url.Values{
+        "email":      {"user@example.com"},
+        "password":   {"pa55word"},
+        "csrf_token": {extractCSRFToken(t, body)},
+    })
+    assert.Equal(t, code, http.StatusUnprocessableEntity)
+    assert.StringContains(t, body, "Your account has been disabled")
+    assert.Equal(t, loggedIn(t, ts), false)
+
+    // Once they are enabled again, they can.
+    err = users.SetDisabled(context.Background(), 1, false)
+    assert.NilError(t, err)
+    logIn(t, ts, "user@example.com")
+    assert.Equal(t, loggedIn(t, ts), true)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/cpucortexm/chunkbox/internal/models"
+    "github.com/julienschmidt/httprouter"
+)
+
+// The JSON API lives under /api/ and is used with a personal API token, see
+// the authenticateToken middleware. Errors are sent as JSON, like those
+// for any client which asks for JSON.
+
+// apiFile is a file of a chunk, as the API sends and receives it.
+type apiFile struct {
+    Name        string `json:"name"`
+    Content     string `json:"content"`
+    ContentType string `json:"content_type"`
+    Language    string `json:"language,omitempty"`
+}
+
+// apiChunk is a chunk, as the API sends it.
+type apiChunk struct {
+    Slug       string    `json:"slug"`
+    Title      string    `json:"title"`
+    URL        string    `json:"url"`
+    Size       int64     `json:"size"`
+    Created    time.Time `json:"created"`
+    Expires    time.Time `json:"expires"`
+    ForkedFrom string    `json:"forked_from,omitempty"`
+    Workspace  string    `json:"workspace,omitempty"`
+    Private    bool      `json:"private"`
+    Files      []apiFile `json:"files"`
+}
+
+// newAPIChunk converts a chunk to the form the API sends it in.
+func newAPIChunk(chunk *models.Chunk) apiChunk {
+    c := apiChunk{
+        Slug:       chunk.Slug,
+        Title:      chunk.Title,
+        URL:        "/c/" + chunk.Slug,
+        Size:       chunk.Size,
+        Created:    chunk.Created,
+        Expires:    chunk.Expires,
+        ForkedFrom: chunk.ForkedFromSlug,
+        Workspace:  chunk.WorkspaceSlug,
+        Private:    chunk.Private,
+        Files:      []apiFile{},
+    }
+    for _, f := range chunk.Files {
+        c.Files = append(c.Files, apiFile{
+            Name:        f.Name,
+            Content:     f.Content,
+            ContentType: f.ContentType,
+            Language:    f.Language,
+        })
+    }
+    return c
+}
+
+// The apiChunkView handler sends a chunk, with the content of its files.
+func (app *application) apiChunkView(w http.ResponseWriter, r *http.Request) {
+    chunk, ok := app.chunkFromPath(w, r)
+    if !ok {
+        return
+    }
+    app.writeJSON(w, http.StatusOK, map[string]any{"chunk": newAPIChunk(chunk)})
+}
+
+// The apiChunkCreate handler creates a chunk from a JSON object like
+//
+//     {"title": "...", "expires": 7, "files": [{"name": "main.go", "content": "..."}]}
+//
+// with the same fields, rules and quotas as the create form. The content
+// type of a file defaults to code, and its language is detected when it
+// isn't given. The chunk goes in the workspace with the slug in the
+// workspace field, if there is one, and "private": true makes it private.
+func (app *application) apiChunkCreate(w http.ResponseWriter, r *http.Request) {
+    // JSON escapes can make the content bigger, just like URL-encoding
+    // does for the form.
+    r.Body = http.MaxBytesReader(w, r.Body, 3*app.maxChunkBytes+64<<10)
+
+    var input struct {
+        Title      string    `json:"title"`
+        Slug       string    `json:"slug"`
+        Expires    int       `json:"expires"`
+        ForkedFrom string    `json:"forked_from"`
+        Workspace  string    `json:"workspace"`
+        Private    bool      `json:"private"`
+        Files      []apiFile `json:"files"`
+    }
+    dec := json.NewDecoder(r.Body)
+    dec.DisallowUnknownFields()
+    err := dec.Decode(&input)
+    if err != nil {
+        var maxBytesError *http.MaxBytesError
+        if errors.As(err, &maxBytesError) {
+            app.chunkTooLarge(w, r)
+        } else {
+            app.errorResponse(w, r, http.StatusBadRequest, "The request body is not valid JSON: "+err.Error(), "")
+        }
+        return
+    }
+
+    form := chunkCreateForm{
+        Title:      input.Title,
+        Slug:       strings.TrimSpace(input.Slug),
+        Expires:    input.Expires,
+        ForkedFrom: input.ForkedFrom,
+        Workspace:  input.Workspace,
+        Private:    input.Private,
+    }
+    for _, f := range input.Files {
+        if f.ContentType == "" {
+            f.ContentType = models.ContentTypeCode
+        }
+        form.Files = append(form.Files, &fileForm{
+            Name:        strings.TrimSpace(f.Name),
+            Content:     f.Content,
+            ContentType: f.ContentType,
+            Language:    f.Language,
+        })
+    }
+
+    if form.size() > app.maxChunkBytes {
+        app.chunkTooLarge(w, r)
+        return
+    }
+
+    forkedFrom, workspaceID, err := app.validateChunkForm(r.Context(), &form)
+    if err != nil {
+        app.serverError(w, r, err)
+        return
+    }
+    if !form.Valid() {
+        app.validationFailed(w, r, form.FieldErrors)
+        return
+    }
+
+    owner := app.owner(r)
+    owner.WorkspaceID = workspaceID
+    slug, err := app.chunks.Insert(r.Context(), owner, form.Title, form.Slug, form.modelFiles(), form.Expires, forkedFrom, form.Private)
+    if err != nil {
+        switch {
+        case errors.Is(err, models.ErrDuplicateSlug):
+            app.validationFailed(w, r, map[string]string{"slug": "This slug is already in use"})
+        case errors.Is(err, models.ErrNotMember):
+            app.validationFailed(w, r, map[string]string{"workspace": "You are not a member of this workspace"})
+        case errors.Is(err, models.ErrQuotaExceeded):
+            app.quotaExceeded(w, r, owner, form)
+        default:
+            app.serverError(w, r, err)
+        }
+        return
+    }
+    app.metrics.chunksCreated.Inc()
+
+    chunk, err := app.chunks.GetBySlug(r.Context(), slug, owner.UserID)
+    if err != nil {
+        app.serverError(w, r, err)
+        return
+    }
+    w.Header().Set("Location", "/api/chunks/"+slug)
+    app.writeJSON(w, http.StatusCreated, map[string]any{"chunk": newAPIChunk(chunk)})
+}
+
+// The apiChunkDelete handler deletes one of the user's chunks, or one in a
+// workspace they belong to. Chunks which belong to someone else, or nobody,
+// get a 404 Not Found like those which don't exist.
+func (app *application) apiChunkDelete(w http.ResponseWriter, r *http.Request) {
+    slug := httprouter.ParamsFromContext(r.Context()).ByName("slug")
+
+    err := app.chunks.Delete(r.Context(), slug, userIDFromContext(r.Context()))
+    if err != nil {
+        if errors.Is(err, models.ErrNoRecord) {
+            app.notFound(w, r)
+        } else {
+            app.serverError(w, r, err)
+        }
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// validationFailed sends a 422 Unprocessable Entity response listing what
+// is wrong with each field. The fields of the files are named by their
+// position, like "file0.name".
+func (app *application) validationFailed(w http.ResponseWriter, r *http.Request, fields map[string]string) {
+    app.sendError(w, r, &errorData{
+        Status:  http.StatusUnprocessableEntity,
+        Message: "The chunk is not valid.",
+        Fields:  fields,
+    })
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "github.com/cpucortexm/chunkbox/internal/highlight"
+    "github.com/cpucortexm/chunkbox/internal/models"
+    "github.com/go-sql-driver/mysql"
+    "gopkg.in/yaml.v3"
+)
+
+// config holds the settings of the application. They are merged from four
+// sources, each overriding the one before:
+//
+//  1. the defaults from defaultConfig()
+//  2. a YAML config file, named by -config or CHUNKBOX_CONFIG
+//  3. CHUNKBOX_* environment variables
+//  4. command-line flags
+//
+// Every setting has a flag, and the environment variable for a flag is its
+// name in upper case with the hyphens replaced by underscores, so -db-password
+// can also be set with CHUNKBOX_DB_PASSWORD.
+type config struct {
+    Addr      string `yaml:"addr"`
+    AdminAddr string `yaml:"admin_addr"`
+
+    // TLS is used when the certificate and key are both set. RedirectAddr
+    // is the address of a plain HTTP listener which redirects to HTTPS.
+    TLS struct {
+        Cert         string `yaml:"cert"`
+        Key          string `yaml:"key"`
+        RedirectAddr string `yaml:"redirect_addr"`
+    } `yaml:"tls"`
+
+    // Server holds the limits of the http.Server. Without them a client
+    // which sends its request slowly enough can hold a connection open
+    // forever.
+    Server struct {
+        ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+        ReadTimeout       time.Duration `yaml:"read_timeout"`
+        WriteTimeout      time.Duration `yaml:"write_timeout"`
+        IdleTimeout       time.Duration `yaml:"idle_timeout"`
+        MaxHeaderBytes    int           `yaml:"max_header_bytes"`
+    } `yaml:"server"`
+
+    DB struct {
+        // DSN is the MySQL data source name. It shouldn't hold the password,
+        // which goes in Password so it can be kept out of the config file.
+        DSN      string `yaml:"dsn"`
+        Password string `yaml:"password"`
+        MaxOpenConns    int           `yaml:"max_open_conns"`
+        MaxIdleConns    int           `yaml:"max_idle_conns"`
+        ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+        ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time"`
+        // ConnectTimeout is how long we keep trying to reach the database
+        // at startup, in case it is still starting up itself.
+        ConnectTimeout time.Duration `yaml:"connect_timeout"`
+        QueryTimeout   time.Duration `yaml:"query_timeout"`
+        Migrate        bool          `yaml:"migrate"`
+    } `yaml:"db"`
+
+    Log struct {
+        Format string `yaml:"format"`
+        Level  string `yaml:"level"`
+    } `yaml:"log"`
+
+    Shutdown struct {
+        Delay   time.Duration `yaml:"delay"`
+        Timeout time.Duration `yaml:"timeout"`
+    } `yaml:"shutdown"`
+
+    UI struct {
+        Theme string `yaml:"theme"`
+        Dir   string `yaml:"dir"`
+        Dev   bool   `yaml:"dev"`
+    } `yaml:"ui"`
+
+    // RateLimit sets how many requests a client can make: Burst requests
+    // in one go, then Rate requests per second. Writes (like creating a
+    // chunk) have their own, lower, limit.
+    RateLimit struct {
+        Enabled    bool    `yaml:"enabled"`
+        ReadRate   float64 `yaml:"read_rate"`
+        ReadBurst  int     `yaml:"read_burst"`
+        WriteRate  float64 `yaml:"write_rate"`
+        WriteBurst int     `yaml:"write_burst"`
+        // TrustedProxies are the addresses or networks of the proxies in
+        // front of us, whose X-Forwarded-For headers we believe.
+        TrustedProxies stringList `yaml:"trusted_proxies"`
+    } `yaml:"rate_limit"`
+
+    // Limits caps the size of a chunk, and the quotas how many live chunks
+    // (and bytes) people can have: per IP address for people who aren't
+    // logged in, per user for those who are. Zero means no limit.
+    Limits struct {
+        MaxChunkBytes int64       `yaml:"max_chunk_bytes"`
+        IPQuota       quotaConfig `yaml:"ip_quota"`
+        UserQuota     quotaConfig `yaml:"user_quota"`
+    } `yaml:"limits"`
+
+    // OIDC sets up single sign-on with an OpenID Connect provider, next to
+    // the local accounts. It is switched on by setting the Issuer. Users
+    // are matched up by the claims named by EmailClaim and NameClaim, and
+    // only those with an email address in one of the AllowedDomains (if
+    // any) get in.
+    OIDC struct {
+        Issuer         string     `yaml:"issuer"`
+        Name           string     `yaml:"name"`
+        ClientID       string     `yaml:"client_id"`
+        ClientSecret   string     `yaml:"client_secret"`
+        RedirectURL    string     `yaml:"redirect_url"`
+        Scopes         stringList `yaml:"scopes"`
+        EmailClaim     string     `yaml:"email_claim"`
+        NameClaim      string     `yaml:"name_claim"`
+        AllowedDomains stringList `yaml:"allowed_domains"`
+        Timeout        time.Duration `yaml:"timeout"`
+    } `yaml:"oidc"`
+
+    SlugLength int `yaml:"slug_length"`
+
+    Features features `yaml:"features"`
+}
+
+// quotaConfig is the config form of models.Quota.
+type quotaConfig struct {
+    MaxChunks int   `yaml:"max_chunks"`
+    MaxBytes  int64 `yaml:"max_bytes"`
+}
+
+func (q quotaConfig) quota() models.Quota {
+    return models.Quota{MaxChunks: q.MaxChunks, MaxBytes: q.MaxBytes}
+}
+
+// features switches parts of the application on and off.
+type features struct {
+    Forking     bool `yaml:"forking"`
+    CustomSlugs bool `yaml:"custom_slugs"`
+    Downloads   bool `yaml:"downloads"`
+}
+
+// defaultConfig returns the settings used when nothing else is given.
+func defaultConfig() *config {
+    cfg := &config{
+        Addr:       ":3001",
+        AdminAddr:  "localhost:3002",
+        SlugLength: models.DefaultSlugLength,
+    }
+    cfg.Server.ReadHeaderTimeout = 5 * time.Second
+    cfg.Server.ReadTimeout = 15 * time.Second
+    cfg.Server.WriteTimeout = 30 * time.Second
+    cfg.Server.IdleTimeout = time.Minute
+    cfg.Server.MaxHeaderBytes = 64 << 10
+    cfg.DB.DSN = "web@/chunkbox?parseTime=true"
+    cfg.DB.MaxOpenConns = 25
+    cfg.DB.MaxIdleConns = 25
+    cfg.DB.ConnMaxLifetime = 30 * time.Minute
+    cfg.DB.ConnMaxIdleTime = 5 * time.Minute
+    cfg.DB.ConnectTimeout = time.Minute
+    cfg.DB.QueryTimeout = 5 * time.Second
+    cfg.Log.Format = "text"
+    cfg.Log.Level = "info"
+    cfg.Shutdown.Delay = 5 * time.Second
+    cfg.Shutdown.Timeout = 30 * time.Second
+    cfg.UI.Theme = "github"
+    cfg.Limits.MaxChunkBytes = 1 << 20
+    cfg.Limits.IPQuota = quotaConfig{MaxChunks: 50, MaxBytes: 10 << 20}
+    cfg.Limits.UserQuota = quotaConfig{MaxChunks: 500, MaxBytes: 100 << 20}
+    cfg.RateLimit.Enabled = true
+    cfg.RateLimit.ReadRate = 10
+    cfg.RateLimit.ReadBurst = 50
+    cfg.RateLimit.WriteRate = 0.2
+    cfg.RateLimit.WriteBurst = 10
+    cfg.OIDC.Name = "SSO"
+    cfg.OIDC.Scopes = stringList{"openid", "profile", "email"}
+    cfg.OIDC.EmailClaim = "email"
+    cfg.OIDC.NameClaim = "name"
+    cfg.OIDC.Timeout = 10 * time.Second
+    cfg.Features = features{Forking: true, CustomSlugs: true, Downloads: true}
+    return cfg
+}
+
+// stringList is a list of strings, which is given as a comma-separated
+// list in a flag or environment variable and as a list in the config file.
+type stringList []string
+
+func (sl *stringList) String() string {
+    if sl == nil {
+        return ""
+    }
+    return strings.Join(*sl, ",")
+}
+
+func (sl *stringList) Set(value string) error {
+    *sl = nil
+    for _, s := range strings.Split(value, ",") {
+        s = strings.TrimSpace(s)
+        if s != "" {
+            *sl = append(*sl, s)
+        }
+    }
+    return nil
+}
+
+// envPrefix is the prefix of the environment variables we read.
+const envPrefix = "CHUNKBOX_"
+
+// flagSet returns a flag set whose flags write straight into the config.
+// The current values of the config are the defaults of the flags, so
+// parsing the command line only changes the settings it names.
+func (cfg *config) flagSet(name string) *flag.FlagSet {
+    fs := flag.NewFlagSet(name, flag.ContinueOnError)
+
+    // The config flag is read before everything else, see loadConfig(). It
+    // is only defined here so that it is accepted and shows up in -help.
+    fs.String("config", "", "Path of a YAML config file (or "+envPrefix+"CONFIG)")
+
+    fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "HTTP network address")
+    // The metrics are served on a separate admin listener, which shouldn't
+    // be reachable from outside.
+    fs.StringVar(&cfg.AdminAddr, "admin-addr", cfg.AdminAddr, "HTTP network address for the admin listener serving /metrics (empty to disable)")
+
+    // With a certificate and key the server speaks HTTPS. The certificate
+    // is loaded again on SIGHUP.
+    fs.StringVar(&cfg.TLS.Cert, "tls-cert", cfg.TLS.Cert, "Path of the TLS certificate (PEM), to serve HTTPS")
+    fs.StringVar(&cfg.TLS.Key, "tls-key", cfg.TLS.Key, "Path of the TLS private key (PEM), to serve HTTPS")
+    fs.StringVar(&cfg.TLS.RedirectAddr, "tls-redirect-addr", cfg.TLS.RedirectAddr, "HTTP network address of a listener which redirects to HTTPS (empty to disable)")
+
+    fs.DurationVar(&cfg.Server.ReadHeaderTimeout, "read-header-timeout", cfg.Server.ReadHeaderTimeout, "Maximum time to read the request headers")
+    fs.DurationVar(&cfg.Server.ReadTimeout, "read-timeout", cfg.Server.ReadTimeout, "Maximum time to read the whole request, including the body")
+    fs.DurationVar(&cfg.Server.WriteTimeout, "write-timeout", cfg.Server.WriteTimeout, "Maximum time from the end of the request headers to the end of the response")
+    fs.DurationVar(&cfg.Server.IdleTimeout, "idle-timeout", cfg.Server.IdleTimeout, "Maximum time to keep an idle keep-alive connection open")
+    fs.IntVar(&cfg.Server.MaxHeaderBytes, "max-header-bytes", cfg.Server.MaxHeaderBytes, "Maximum size of the request headers in bytes")
+
+    fs.StringVar(&cfg.DB.DSN, "dsn", cfg.DB.DSN, "MySQL data source name, without the password")
+    fs.StringVar(&cfg.DB.Password, "db-password", cfg.DB.Password, "MySQL password (better set with "+envPrefix+"DB_PASSWORD)")
+    fs.IntVar(&cfg.DB.MaxOpenConns, "db-max-open-conns", cfg.DB.MaxOpenConns, "Maximum number of open database connections (0 for no limit)")
+    fs.IntVar(&cfg.DB.MaxIdleConns, "db-max-idle-conns", cfg.DB.MaxIdleConns, "Maximum number of idle database connections")
+    fs.DurationVar(&cfg.DB.ConnMaxLifetime, "db-conn-max-lifetime", cfg.DB.ConnMaxLifetime, "Maximum time a database connection may be reused (0 for no limit)")
+    fs.DurationVar(&cfg.DB.ConnMaxIdleTime, "db-conn-max-idle-time", cfg.DB.ConnMaxIdleTime, "Maximum time a database connection may be idle (0 for no limit)")
+    fs.DurationVar(&cfg.DB.ConnectTimeout, "db-connect-timeout", cfg.DB.ConnectTimeout, "How long to keep trying to reach the database at startup")
+    // Database calls which take longer than this are abandoned, and the
+    // user gets a 503 Service Unavailable.
+    fs.DurationVar(&cfg.DB.QueryTimeout, "query-timeout", cfg.DB.QueryTimeout, "Maximum time each database call may take (0 for no limit)")
+    fs.BoolVar(&cfg.DB.Migrate, "migrate", cfg.DB.Migrate, "Apply pending database migrations at startup")
+
+    // Logs are written as text by default, or as JSON for log pipelines.
+    fs.StringVar(&cfg.Log.Format, "log-format", cfg.Log.Format, "Log format (text or json)")
+    fs.StringVar(&cfg.Log.Level, "log-level", cfg.Log.Level, "Minimum log level (debug, info, warn or error)")
+
+    // On SIGINT or SIGTERM the readiness probe fails straight away, but we
+    // keep serving for shutdown-delay so the load balancer can stop sending
+    // us requests, then wait up to shutdown-timeout for requests in flight.
+    fs.DurationVar(&cfg.Shutdown.Delay, "shutdown-delay", cfg.Shutdown.Delay, "How long to keep serving after readiness starts failing on shutdown")
+    fs.DurationVar(&cfg.Shutdown.Timeout, "shutdown-timeout", cfg.Shutdown.Timeout, "How long to wait for requests in flight on shutdown")
+
+    fs.StringVar(&cfg.UI.Theme, "theme", cfg.UI.Theme, "Syntax highlighting theme")
+    // By default the templates and static files are embedded in the binary.
+    // For development, -ui-dir serves them from disk instead.
+    fs.StringVar(&cfg.UI.Dir, "ui-dir", cfg.UI.Dir, "Serve templates and static files from this directory instead of the embedded copy")
+    // In development mode the templates are re-parsed on every request and
+    // template errors are shown in the browser.
+    fs.BoolVar(&cfg.UI.Dev, "dev", cfg.UI.Dev, "Development mode: reload templates on every request (needs -ui-dir)")
+
+    fs.BoolVar(&cfg.RateLimit.Enabled, "ratelimit", cfg.RateLimit.Enabled, "Limit how often each client can make requests")
+    fs.Float64Var(&cfg.RateLimit.ReadRate, "ratelimit-read-rate", cfg.RateLimit.ReadRate, "Reads allowed per second per client, once the burst is used up")
+    fs.IntVar(&cfg.RateLimit.ReadBurst, "ratelimit-read-burst", cfg.RateLimit.ReadBurst, "Reads allowed in a burst per client")
+    fs.Float64Var(&cfg.RateLimit.WriteRate, "ratelimit-write-rate", cfg.RateLimit.WriteRate, "Writes allowed per second per client, once the burst is used up")
+    fs.IntVar(&cfg.RateLimit.WriteBurst, "ratelimit-write-burst", cfg.RateLimit.WriteBurst, "Writes allowed in a burst per client")
+    fs.Var(&cfg.RateLimit.TrustedProxies, "trusted-proxies", "Comma-separated addresses or networks of proxies whose X-Forwarded-For header is trusted")
+
+    fs.Int64Var(&cfg.Limits.MaxChunkBytes, "max-chunk-bytes", cfg.Limits.MaxChunkBytes, "Maximum total size of the files of a chunk in bytes")
+    fs.IntVar(&cfg.Limits.IPQuota.MaxChunks, "quota-ip-chunks", cfg.Limits.IPQuota.MaxChunks, "Live chunks allowed per IP address for people not logged in (0 for no limit)")
+    fs.Int64Var(&cfg.Limits.IPQuota.MaxBytes, "quota-ip-bytes", cfg.Limits.IPQuota.MaxBytes, "Bytes of live chunks allowed per IP address for people not logged in (0 for no limit)")
+    fs.IntVar(&cfg.Limits.UserQuota.MaxChunks, "quota-user-chunks", cfg.Limits.UserQuota.MaxChunks, "Live chunks allowed per user (0 for no limit)")
+    fs.Int64Var(&cfg.Limits.UserQuota.MaxBytes, "quota-user-bytes", cfg.Limits.UserQuota.MaxBytes, "Bytes of live chunks allowed per user (0 for no limit)")
+
+    // Single sign-on is offered when an issuer is set. The redirect URL is
+    // our /user/login/sso/callback page, as the provider's users see it.
+    fs.StringVar(&cfg.OIDC.Issuer, "oidc-issuer", cfg.OIDC.Issuer, "Issuer URL of the OpenID Connect provider for single sign-on (empty to disable)")
+    fs.StringVar(&cfg.OIDC.Name, "oidc-name", cfg.OIDC.Name, "Name of the single sign-on provider, shown on the login page")
+    fs.StringVar(&cfg.OIDC.ClientID, "oidc-client-id", cfg.OIDC.ClientID, "OpenID Connect client ID")
+    fs.StringVar(&cfg.OIDC.ClientSecret, "oidc-client-secret", cfg.OIDC.ClientSecret, "OpenID Connect client secret (better set with "+envPrefix+"OIDC_CLIENT_SECRET)")
+    fs.StringVar(&cfg.OIDC.RedirectURL, "oidc-redirect-url", cfg.OIDC.RedirectURL, "Full URL of /user/login/sso/callback, registered with the provider")
+    fs.Var(&cfg.OIDC.Scopes, "oidc-scopes", "Comma-separated scopes to ask the provider for")
+    fs.StringVar(&cfg.OIDC.EmailClaim, "oidc-email-claim", cfg.OIDC.EmailClaim, "ID token claim holding the user's email address")
+    fs.StringVar(&cfg.OIDC.NameClaim, "oidc-name-claim", cfg.OIDC.NameClaim, "ID token claim holding the user's name")
+    fs.Var(&cfg.OIDC.AllowedDomains, "oidc-allowed-domains", "Comma-separated email domains allowed to log in with single sign-on (empty for any)")
+    fs.DurationVar(&cfg.OIDC.Timeout, "oidc-timeout", cfg.OIDC.Timeout, "Maximum time for each request to the OpenID Connect provider")
+
+    fs.IntVar(&cfg.SlugLength, "slug-length", cfg.SlugLength, "Length of generated chunk slugs (6-64)")
+
+    fs.BoolVar(&cfg.Features.Forking, "feature-forking", cfg.Features.Forking, "Allow chunks to be forked")
+    fs.BoolVar(&cfg.Features.CustomSlugs, "feature-custom-slugs", cfg.Features.CustomSlugs, "Allow custom slugs for new chunks")
+    fs.BoolVar(&cfg.Features.Downloads, "feature-downloads", cfg.Features.Downloads, "Allow chunks to be downloaded as archives")
+
+    return fs
+}
+
+// loadConfig works out the settings from the defaults, the config file, the
+// environment and the command-line arguments, in that order, and checks
+// them.
+func loadConfig(name string, args []string, stderr io.Writer) (*config, error) {
+    cfg := defaultConfig()
+
+    // Look for the config file first, as the environment and the flags
+    // override it. A throwaway flag set finds the -config flag; it also
+    // catches unknown flags and -help before we read any files.
+    scratch := defaultConfig().flagSet(name)
+    scratch.SetOutput(stderr)
+    err := scratch.Parse(args)
+    if err != nil {
+        return nil, err
+    }
+    path := scratch.Lookup("config").Value.String()
+    if path == "" {
+        path = os.Getenv(envPrefix + "CONFIG")
+    }
+    if path != "" {
+        err = cfg.readFile(path)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    fs := cfg.flagSet(name)
+    fs.SetOutput(stderr)
+
+    // Each flag can be set from the environment.
+    var envErrs []error
+    fs.VisitAll(func(f *flag.Flag) {
+        if f.Name == "config" {
+            return
+        }
+        key := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+        value, ok := os.LookupEnv(key)
+        if !ok {
+            return
+        }
+        err := fs.Set(f.Name, value)
+        if err != nil {
+            envErrs = append(envErrs, fmt.Errorf("%s: %w", key, err))
+        }
+    })
+    if len(envErrs) > 0 {
+        return nil, errors.Join(envErrs...)
+    }
+
+    err = fs.Parse(args)
+    if err != nil {
+        return nil, err
+    }
+    if fs.NArg() > 0 {
+        return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+    }
+
+    err = cfg.validate()
+    if err != nil {
+        return nil, err
+    }
+    return cfg, nil
+}
+
+// readFile reads the YAML config file at path into the config. Settings
+// missing from the file keep their current values, and unknown settings
+// are an error, as they are most likely typos.
+func (cfg *config) readFile(path string) error {
+    f, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    dec := yaml.NewDecoder(f)
+    dec.KnownFields(true)
+    err = dec.Decode(cfg)
+    if err != nil && !errors.Is(err, io.EOF) {
+        return fmt.Errorf("%s: %w", path, err)
+    }
+    return nil
+}
+
+// validate checks the settings, reporting all the problems at once.
+func (cfg *config) validate() error {
+    var errs []error
+    check := func(ok bool, format string, args ...any) {
+        if !ok {
+            errs = append(errs, fmt.Errorf(format, args...))
+        }
+    }
+
+    check(cfg.Addr != "", "addr must not be empty")
+    check((cfg.TLS.Cert == "") == (cfg.TLS.Key == ""), "tls-cert and tls-key must be set together")
+    check(cfg.TLS.RedirectAddr == "" || cfg.TLS.Cert != "", "tls-redirect-addr needs tls-cert and tls-key")
+    check(cfg.Server.ReadHeaderTimeout > 0, "read-header-timeout must be positive")
+    check(cfg.Server.ReadTimeout > 0, "read-timeout must be positive")
+    check(cfg.Server.WriteTimeout > 0, "write-timeout must be positive")
+    check(cfg.Server.IdleTimeout > 0, "idle-timeout must be positive")
+    check(cfg.Server.MaxHeaderBytes > 0, "max-header-bytes must be positive")
+    // If the write timeout ran out first, a user whose query timed out
+    // would get no response at all instead of a 503.
+    check(cfg.DB.QueryTimeout == 0 || cfg.DB.QueryTimeout < cfg.Server.WriteTimeout, "query-timeout must be shorter than write-timeout")
+
+    _, err := mysql.ParseDSN(cfg.DB.DSN)
+    check(err == nil, "dsn is invalid: %v", err)
+    check(cfg.DB.MaxOpenConns >= 0, "db-max-open-conns must not be negative")
+    check(cfg.DB.MaxIdleConns >= 0, "db-max-idle-conns must not be negative")
+    check(cfg.DB.MaxOpenConns == 0 || cfg.DB.MaxIdleConns <= cfg.DB.MaxOpenConns, "db-max-idle-conns must not be more than db-max-open-conns")
+    check(cfg.DB.ConnMaxLifetime >= 0, "db-conn-max-lifetime must not be negative")
+    check(cfg.DB.ConnMaxIdleTime >= 0, "db-conn-max-idle-time must not be negative")
+    check(cfg.DB.ConnectTimeout >= 0, "db-connect-timeout must not be negative")
+    check(cfg.DB.QueryTimeout >= 0, "query-timeout must not be negative")
+
+    check(cfg.Log.Format == "text" || cfg.Log.Format == "json", "log-format must be text or json")
+    var level slog.Level
+    check(level.UnmarshalText([]byte(cfg.Log.Level)) == nil, "log-level must be debug, info, warn or error")
+
+    check(cfg.Shutdown.Delay >= 0, "shutdown-delay must not be negative")
+    check(cfg.Shutdown.Timeout > 0, "shutdown-timeout must be positive")
+
+    _, err = highlight.Stylesheet(cfg.UI.Theme)
+    check(err == nil, "theme: %v", err)
+    // Development mode wants to see changes to the templates, and the
+    // embedded copy never changes, so it needs the ui directory on disk.
+    // We don't guess where that is, as a relative path would depend on
+    // where the binary was started from.
+    check(!cfg.UI.Dev || cfg.UI.Dir != "", "dev needs ui-dir, the path of the ui directory of the source tree")
+    if cfg.UI.Dir != "" {
+        info, err := os.Stat(filepath.Join(cfg.UI.Dir, "html"))
+        check(err == nil && info.IsDir(), "ui-dir %q has no html directory of templates", cfg.UI.Dir)
+    }
+
+    check(cfg.RateLimit.ReadRate > 0, "ratelimit-read-rate must be positive")
+    check(cfg.RateLimit.ReadBurst > 0, "ratelimit-read-burst must be positive")
+    check(cfg.RateLimit.WriteRate > 0, "ratelimit-write-rate must be positive")
+    check(cfg.RateLimit.WriteBurst > 0, "ratelimit-write-burst must be positive")
+    _, err = parseCIDRs(cfg.RateLimit.TrustedProxies)
+    check(err == nil, "trusted-proxies: %v", err)
+
+    // The content column holds up to 16MB.
+    check(cfg.Limits.MaxChunkBytes > 0 && cfg.Limits.MaxChunkBytes <= 16<<20, "max-chunk-bytes must be between 1 and 16MB")
+    check(cfg.Limits.IPQuota.MaxChunks >= 0 && cfg.Limits.IPQuota.MaxBytes >= 0, "quota-ip-chunks and quota-ip-bytes must not be negative")
+    check(cfg.Limits.UserQuota.MaxChunks >= 0 && cfg.Limits.UserQuota.MaxBytes >= 0, "quota-user-chunks and quota-user-bytes must not be negative")
+
+    if cfg.OIDC.Issuer != "" {
+        check(absoluteURL(cfg.OIDC.Issuer), "oidc-issuer must be an absolute http or https URL")
+        check(absoluteURL(cfg.OIDC.RedirectURL), "oidc-redirect-url must be an absolute http or https URL")
+        check(cfg.OIDC.ClientID != "", "oidc-client-id must be set with oidc-issuer")
+        check(cfg.OIDC.EmailClaim != "", "oidc-email-claim must not be empty")
+        check(cfg.OIDC.NameClaim != "", "oidc-name-claim must not be empty")
+        check(cfg.OIDC.Timeout > 0, "oidc-timeout must be positive")
+    }
+
+    // Short slugs are easy to guess, and the slug column holds at most 64
+    // characters.
+    check(cfg.SlugLength >= 6 && cfg.SlugLength <= 64, "slug-length must be between 6 and 64")
+
+    return errors.Join(errs...)
+}
+
+// absoluteURL reports whether s is an absolute http or https URL.
+func absoluteURL(s string) bool {
+    u, err := url.Parse(s)
+    return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// dsn returns the data source name to connect with, with the password
+// added to it.
+func (cfg *config) dsn() (string, error) {
+    dsn, err := mysql.ParseDSN(cfg.DB.DSN)
+    if err != nil {
+        return "", err
+    }
+    if cfg.DB.Password != "" {
+        dsn.Passwd = cfg.DB.Password
+    }
+    return dsn.FormatDSN(), nil
+}
+
+// useTLS reports whether the server should speak HTTPS.
+func (cfg *config) useTLS() bool {
+    return cfg.TLS.Cert != ""
+}
+
+// applyServerLimits sets the timeouts and header size limit of the server.
+func (cfg *config) applyServerLimits(srv *http.Server) {
+    srv.ReadHeaderTimeout = cfg.Server.ReadHeaderTimeout
+    srv.ReadTimeout = cfg.Server.ReadTimeout
+    srv.WriteTimeout = cfg.Server.WriteTimeout
+    srv.IdleTimeout = cfg.Server.IdleTimeout
+    srv.MaxHeaderBytes = cfg.Server.MaxHeaderBytes
+}
+
+// redacted is shown in place of secrets when the config is printed.
+const redacted = "REDACTED"
+
+// print writes the config as YAML, in the same form as the config file,
+// with the secrets redacted.
+func (cfg *config) print(w io.Writer) error {
+    c := *cfg
+    if c.DB.Password != "" {
+        c.DB.Password = redacted
+    }
+    if c.OIDC.ClientSecret != "" {
+        c.OIDC.ClientSecret = redacted
+    }
+    // The DSN should be free of passwords, but may not be.
+    dsn, err := mysql.ParseDSN(c.DB.DSN)
+    if err == nil && dsn.Passwd != "" {
+        dsn.Passwd = redacted
+        c.DB.DSN = dsn.FormatDSN()
+    }
+
+    enc := yaml.NewEncoder(w)
+    enc.SetIndent(2)
+    err = enc.Encode(&c)
+    if err != nil {
+        return err
+    }
+    return enc.Close()
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/cpucortexm/chunkbox/internal/assert"
+)
+
+// writeConfigFile writes a config file with the content to a temporary
+// directory, and returns its path.
+func writeConfigFile(t *testing.T, content string) string {
+    t.Helper()
+
+    path := filepath.Join(t.TempDir(), "chunkbox.yaml")
+    err := os.WriteFile(path, []byte(content), 0o600)
+    assert.NilError(t, err)
+    return path
+}
+
+func TestLoadConfigLayers(t *testing.T) {
+    // Each layer sets addr, and each but the last sets slug-length, so we
+    // can see both that a later layer wins and that it leaves the settings
+    // it doesn't name alone.
+    path := writeConfigFile(t, "addr: ':4000'\nslug_length: 10\nlog:\n  level: warn\n")
+
+    tests := []struct {
+        name           string
+        env            map[string]string
+        args           []string
+        wantAddr       string
+        wantSlugLength int
+        wantLogLevel   string
+    }{
+        {
+            name:           "Defaults",
+            wantAddr:       ":3001",
+            wantSlugLength: defaultConfig().SlugLength,
+            wantLogLevel:   "info",
+        },
+        {
+            name:           "File",
+            args:           []string{"-config", path},
+            wantAddr:       ":4000",
+            wantSlugLength: 10,
+            wantLogLevel:   "warn",
+        },
+        {
+            name:           "File from the environment",
+            env:            map[string]string{"CHUNKBOX_CONFIG": path},
+            wantAddr:       ":4000",
+            wantSlugLength: 10,
+            wantLogLevel:   "warn",
+        },
+        {
+            name:           "Environment",
+            env:            map[string]string{"CHUNKBOX_ADDR": ":5000", "CHUNKBOX_SLUG_LENGTH": "12"},
+            args:           []string{"-config", path},
+            wantAddr:       ":5000",
+            wantSlugLength: 12,
+            wantLogLevel:   "warn",
+        },
+        {
+            name:           "Flags",
+            env:            map[string]string{"CHUNKBOX_ADDR": ":5000", "CHUNKBOX_SLUG_LENGTH": "12"},
+            args:           []string{"-config", path, "-addr", ":6000"},
+            wantAddr:       ":6000",
+            wantSlugLength: 12,
+            wantLogLevel:   "warn",
+        },
+        {
+            name:           "Flag given before the config file",
+            args:           []string{"-addr", ":6000", "-config", path},
+            wantAddr:       ":6000",
+            wantSlugLength: 10,
+            wantLogLevel:   "warn",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            for key, value := range tt.env {
+                t.Setenv(key, value)
+            }
+
+            cfg, err := loadConfig("chunkbox", tt.args, io.Discard)
+            assert.NilError(t, err)
+            assert.Equal(t, cfg.Addr, tt.wantAddr)
+            assert.Equal(t, cfg.SlugLength, tt.wantSlugLength)
+            assert.Equal(t, cfg.Log.Level, tt.wantLogLevel)
+        })
+    }
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+    tests := []struct {
+        name    string
+        file    string
+        env     map[string]string
+        args    []string
+        wantErr string
+    }{
+        {
+            name:    "Unknown setting in the file",
+            file:    "adr: ':4000'\n",
+            wantErr: "field adr not found",
+        },
+        {
+            name:    "Bad environment variable",
+            env:     map[string]string{"CHUNKBOX_SLUG_LENGTH": "long"},
+            wantErr: "CHUNKBOX_SLUG_LENGTH",
+        },
+        {
+            name:    "Unknown flag",
+            args:    []string{"-nope"},
+            wantErr: "flag provided but not defined",
+        },
+        {
+            name:    "Extra arguments",
+            args:    []string{"serve"},
+            wantErr: "unexpected arguments: serve",
+        },
+        {
+            name:    "Invalid value from a later layer",
+            file:    "slug_length: 10\n",
+            args:    []string{"-slug-length", "3"},
+            wantErr: "slug-length must be between 6 and 64",
+        },
+        {
+            name:    "Development mode without a ui directory",
+            args:    []string{"-dev"},
+            wantErr: "dev needs ui-dir",
+        },
+        {
+            name:    "Missing ui directory",
+            args:    []string{"-ui-dir", "no/such/ui"},
+            wantErr: `ui-dir "no/such/ui" has no html directory`,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            for key, value := range tt.env {
+                t.Setenv(key, value)
+            }
+            args := tt.args
+            if tt.file != "" {
+                args = append([]string{"-config", writeConfigFile(t, tt.file)}, args...)
+            }
+
+            _, err := loadConfig("chunkbox", args, io.Discard)
+            if err == nil {
+                t.Fatal("expected an error")
+            }
+            assert.StringContains(t, err.Error(), tt.wantErr)
+        })
+    }
+}
+
+func TestLoadConfigDev(t *testing.T) {
+    // The tests run in cmd/web, so the ui directory is two levels up.
+    cfg, err := loadConfig("chunkbox", []string{"-dev", "-ui-dir", "../../ui"}, io.Discard)
+    assert.NilError(t, err)
+    assert.Equal(t, cfg.UI.Dev, true)
+    assert.Equal(t, cfg.UI.Dir, "../../ui")
+}
+
+func TestValidate(t *testing.T) {
+    tests := []struct {
+        name    string
+        change  func(cfg *config)
+        wantErr string
+    }{
+        {
+            name:   "Defaults",
+            change: func(cfg *config) {},
+        },
+        {
+            name:    "Certificate without a key",
+            change:  func(cfg *config) { cfg.TLS.Cert = "cert.pem" },
+            wantErr: "tls-cert and tls-key must be set together",
+        },
+        {
+            name:    "Query timeout longer than the write timeout",
+            change:  func(cfg *config) { cfg.DB.QueryTimeout = time.Minute },
+            wantErr: "query-timeout must be shorter than write-timeout",
+        },
+        {
+            name:    "Bad trusted proxy",
+            change:  func(cfg *config) { cfg.RateLimit.TrustedProxies = stringList{"10.0.0.0/33"} },
+            wantErr: "trusted-proxies",
+        },
+        {
+            name:    "Issuer without a client ID",
+            change: func(cfg *config) {
+                cfg.OIDC.Issuer = "https://idp.example.com"
+                cfg.OIDC.RedirectURL = "https://chunkbox.example.com/user/login/sso/callback"
+            },
+            wantErr: "oidc-client-id must be set with oidc-issuer",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            cfg := defaultConfig()
+            tt.change(cfg)
+
+            err := cfg.validate()
+            if tt.wantErr == "" {
+                assert.NilError(t, err)
+                return
+            }
+            if err == nil {
+                t.Fatal("expected an error")
+            }
+            assert.StringContains(t, err.Error(), tt.wantErr)
+        })
+    }
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.Addr = ""
+    cfg.SlugLength = 1
+
+    err := cfg.validate()
+    if err == nil {
+        t.Fatal("expected an error")
+    }
+    assert.Equal(t, strings.Count(err.Error(), "\n"), 1)
+    assert.StringContains(t, err.Error(), "addr must not be empty")
+    assert.StringContains(t, err.Error(), "slug-length must be between 6 and 64")
+}
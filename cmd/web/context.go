@@ -0,0 +1,55 @@
+package main
+
+import (
+    "context"
+
+    "github.com/cpucortexm/chunkbox/internal/models"
+)
+
+// contextKey is the type of the keys we store values under in the request
+// context. Using our own type means they can't collide with keys set by
+// other packages.
+type contextKey string
+
+const (
+    requestIDContextKey = contextKey("requestID")
+    // sessionContextKey is set for requests which have a session, see
+    // loadAndSave.
+    sessionContextKey = contextKey("session")
+    // userIDContextKey holds the ID of the user making the request, who
+    // logged in or sent an API token.
+    userIDContextKey = contextKey("userID")
+    // roleContextKey holds the role of a logged in user.
+    roleContextKey = contextKey("role")
+    // tokenContextKey holds the API token a request was made with.
+    tokenContextKey = contextKey("token")
+)
+
+// requestIDFromContext returns the request ID stored by the requestID
+// middleware, or an empty string if there isn't one.
+func requestIDFromContext(ctx context.Context) string {
+    id, _ := ctx.Value(requestIDContextKey).(string)
+    return id
+}
+
+// userIDFromContext returns the ID of the user making the request, or 0 if
+// they aren't logged in.
+func userIDFromContext(ctx context.Context) int {
+    id, _ := ctx.Value(userIDContextKey).(int)
+    return id
+}
+
+// roleFromContext returns the role of the logged in user, or an empty
+// string if they aren't logged in. Requests made with an API token have no
+// role.
+func roleFromContext(ctx context.Context) string {
+    role, _ := ctx.Value(roleContextKey).(string)
+    return role
+}
+
+// tokenFromContext returns the API token the request was made with, or nil
+// if there isn't one.
+func tokenFromContext(ctx context.Context) *models.Token {
+    t, _ := ctx.Value(tokenContextKey).(*models.Token)
+    return t
+}
@@ -7,12 +7,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/cpucortexm/chunkbox/internal/highlight"
 	"github.com/cpucortexm/chunkbox/internal/models"
+	"github.com/cpucortexm/chunkbox/internal/validator"
+	"github.com/julienschmidt/httprouter"
 )
 
 // Start using the applications custom logger instead of the
@@ -20,31 +28,36 @@ import (
 // methods against the application struct.
 
 func (app *application) home(w http.ResponseWriter, r *http.Request){
-    // Check if the current request URL path exactly matches "/". If it doesn't, use
-    // the http.NotFound() function to send a 404 response to the client.
-    // Importantly, we then return from the handler. If we don't return, the handler
-    // would keep executing and also write the "Hello from Chunkbox" message.
-    if r.URL.Path != "/" {
-        app.notFound(w) // use the app.notFound helper
-        return
-    }
+    // Because httprouter matches the "/" path exactly, we no longer need to
+    // check r.URL.Path here.
 
-    chunks, err := app.chunks.Latest()
+    // Call the newTemplateData() helper to get a templateData struct containing
+    // the 'default' data (which for now is just the current year).
+    data := app.newTemplateData(r)
 
+    // Members of workspaces get links to them, and the latest chunks of
+    // their workspaces and their own in place of the global latest list.
+    // Everyone else gets the latest public chunks.
+    var err error
+    if id := userIDFromContext(r.Context()); id != 0 {
+        data.Workspaces, err = app.workspaces.ForUser(r.Context(), id)
+        if err != nil {
+            app.serverError(w, r, err)
+            return
+        }
+    }
+    if len(data.Workspaces) > 0 {
+        data.Chunks, err = app.chunks.ForUser(r.Context(), userIDFromContext(r.Context()))
+    } else {
+        data.Chunks, err = app.chunks.Latest(r.Context())
+    }
     if err != nil{
-        app.serverError(w, err)
+        app.serverError(w, r, err)
         return
     }
 
-    // Call the newTemplateData() helper to get a templateData struct containing
-    // the 'default' data (which for now is just the current year), and add the
-    // snippets slice to it.
-
-    data := app.newTemplateData(r)
-    data.Chunks = chunks
-
     // Use the render helper.
-    app.render(w, 
+    app.render(w, r,
                http.StatusOK,
                "home.html",
                data,
@@ -52,63 +65,1031 @@ func (app *application) home(w http.ResponseWriter, r *http.Request){
 }
 
 func (app *application)chunkView(w http.ResponseWriter, r *http.Request){
-    // Extract the value of the id parameter from the query string and try to
-    // convert it to an integer using the strconv.Atoi() function. If it can't
-    // be converted to an integer, or the value is less than 1, we return a 404 page
-    // not found response.
-    id, err :=  strconv.Atoi(r.URL.Query().Get("id"))
-    if err != nil || id < 1{
-        app.notFound(w) // use the app.notFound helper
+    // Look up the chunk from the slug in the URL path. If no matching
+    // record is found, chunkFromPath has already sent a 404 Not Found
+    // response.
+    chunk, ok := app.chunkFromPath(w, r)
+    if !ok {
         return
     }
-    // Use the ChunkModel object's Get method to retrieve the data for a
-    // specific record based on its ID. If no matching record is found,
-    // return a 404 Not Found response.
-    chunk, err := app.chunks.Get(id)
+    app.renderView(w, r, http.StatusOK, chunk, shareForm{Permission: models.PermissionRead})
+}
 
-    if err != nil{
-        if errors.Is(err, models.ErrNoRecord){
-            app.notFound(w)
-        }else {
-            app.serverError(w, err)
-        }
+// renderView shows the view.html page for the chunk. Its owners also get the
+// sharing dialog, with the form for a new grant.
+func (app *application) renderView(w http.ResponseWriter, r *http.Request, status int, chunk *models.Chunk, form shareForm) {
+    // Fetch the chunks forked from this one, so the lineage can be browsed
+    // in both directions.
+    userID := userIDFromContext(r.Context())
+    forks, err := app.chunks.Forks(r.Context(), chunk.ID, userID)
+    if err != nil {
+        app.serverError(w, r, err)
         return
     }
-    
+
     data := app.newTemplateData(r)
     data.Chunk = chunk
+    data.Forks = forks
+    // Markdown chunks are rendered by default, ?source=1 shows the
+    // highlighted Markdown source instead.
+    data.ShowSource = r.URL.Query().Get("source") == "1"
+
+    if chunk.CanShare {
+        data.Grants, err = app.chunks.Grants(r.Context(), chunk.ID)
+        if err != nil {
+            app.serverError(w, r, err)
+            return
+        }
+        data.Workspaces, err = app.workspaces.ForUser(r.Context(), userID)
+        if err != nil {
+            app.serverError(w, r, err)
+            return
+        }
+        data.Permissions = models.Permissions
+        data.Form = form
+    }
 
     // Use the render helper.
-    app.render(w, 
-               http.StatusOK,
+    app.render(w, r,
+               status,
                "view.html",
                data,
     )
 }
 
+// The chunkRaw handler returns the content of a chunk file as plain text, so
+// it can be fetched by scripts. The optional lines parameter (like
+// ?lines=40-55) limits the response to a range of lines.
+func (app *application)chunkRaw(w http.ResponseWriter, r *http.Request){
+    chunk, ok := app.chunkFromPath(w, r)
+    if !ok {
+        return
+    }
+
+    // The file parameter picks one of the chunk's files by name. Without
+    // it we return the first file. A chunk whose files are missing has
+    // nothing to return.
+    var file *models.File
+    if name := r.URL.Query().Get("file"); name != "" {
+        file = chunk.File(name)
+    } else if len(chunk.Files) > 0 {
+        file = chunk.Files[0]
+    }
+    if file == nil {
+        app.notFound(w, r)
+        return
+    }
+
+    content := file.Content
+    if lines := r.URL.Query().Get("lines"); lines != "" {
+        start, end, err := parseLineRange(lines)
+        if err != nil {
+            app.clientError(w, r, http.StatusBadRequest)
+            return
+        }
+        var ok bool
+        content, ok = extractLines(content, start, end)
+        if !ok {
+            app.clientError(w, r, http.StatusBadRequest)
+            return
+        }
+    }
+
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    w.Write([]byte(content))
+}
+
+// The chunkCreate handler shows the form for a new chunk. The router only
+// sends GET requests here, and sends POST requests to chunkCreatePost.
 func (app *application)chunkCreate(w http.ResponseWriter, r *http.Request){
-    // Use r.Method to check whether the request is using POST or not.
-    if r.Method != http.MethodPost {
-        // Use the Header().Set() method to add an 'Allow: POST' header to the
-        // response header map. The first parameter is the header name, and
-        // the second parameter is the header value.
-        w.Header().Set("Allow", http.MethodPost)
-        app.clientError(w, http.StatusMethodNotAllowed) // Use the clientError() helper.
-        return
-    }
-    // Create some variables holding dummy data. We'll remove these later on
-    // during the build.
-    title := "On Rigveda"
-    content := "One should, perform karma with nonchalance \n without expecting the benefits \n because sooner or later one shall definitely gets the fruits.. \n- Rigveda"
-    expires := 7
+    // Initialize a new chunkCreateForm instance and pass it to the template,
+    // so that the default expiry radio button is checked and there is one
+    // empty file with its language set to auto-detect.
+    form := chunkCreateForm{
+        Files:   []*fileForm{{ContentType: models.ContentTypeCode}},
+        Expires: 365,
+    }
+    app.renderCreate(w, r, http.StatusOK, form)
+}
+
+// renderCreate shows the create form with the given status. Logged in users
+// can put the chunk in one of their workspaces, so they are offered in the
+// form.
+func (app *application) renderCreate(w http.ResponseWriter, r *http.Request, status int, form chunkCreateForm) {
+    data := app.newTemplateData(r)
+    data.Form = form
+    data.Languages = highlight.Languages()
+    if id := userIDFromContext(r.Context()); id != 0 {
+        workspaces, err := app.workspaces.ForUser(r.Context(), id)
+        if err != nil {
+            app.serverError(w, r, err)
+            return
+        }
+        data.Workspaces = workspaces
+    }
+    app.render(w, r, status, "create.html", data)
+}
+
+// Define a chunkCreateForm struct to represent the form data and validation
+// errors for the form fields. The embedded Validator gives us the
+// FieldErrors map and the CheckField() method. Errors for a file are keyed
+// by the position of the file, like "file0.name".
+type chunkCreateForm struct {
+    Title      string
+    Slug       string // custom slug, or empty for a random one
+    Files      []*fileForm
+    Expires    int
+    ForkedFrom string // slug of the chunk being forked, or empty
+    Workspace  string // slug of the workspace for the chunk, or empty for a public one
+    Private    bool   // only for the user and those they share it with
+    validator.Validator
+}
+
+// fileForm holds the fields of one of the files in the create form.
+type fileForm struct {
+    Name        string
+    Content     string
+    ContentType string
+    Language    string // empty means "auto-detect"
+}
+
+// maxFiles is the most files a single chunk can be made of.
+const maxFiles = 20
+
+// slugRX checks custom slugs: lower case letters, digits and hyphens, not
+// starting or ending with a hyphen.
+var slugRX = regexp.MustCompile(`^[a-z0-9](?:[a-z0-9-]*[a-z0-9])?$`)
+
+// reservedSlugs can't be used as custom slugs, as they are (or may one day
+// be) the names of our own pages.
+var reservedSlugs = []string{
+    "admin", "api", "c", "chunkbox", "create", "download", "fork", "healthz",
+    "login", "logout", "metrics", "new", "raw", "readyz", "settings",
+    "share", "shared", "signup", "static", "usage", "user", "users", "w",
+    "workspaces",
+}
+
+// size returns how big the files of the chunk add up to.
+func (form *chunkCreateForm) size() int64 {
+    var size int64
+    for _, f := range form.Files {
+        size += int64(len(f.Content))
+    }
+    return size
+}
+
+// checkContent checks the title and files of the form, which are all there
+// is to an edited chunk.
+func (form *chunkCreateForm) checkContent() {
+    form.CheckField(validator.NotBlank(form.Title), "title", "This field cannot be blank")
+    form.CheckField(validator.MaxChars(form.Title, 100), "title", "This field cannot be more than 100 characters long")
+    form.CheckField(len(form.Files) > 0, "files", "A chunk needs at least one file")
+    form.CheckField(len(form.Files) <= maxFiles, "files", fmt.Sprintf("A chunk can have at most %d files", maxFiles))
+
+    seen := make(map[string]bool)
+    for i, f := range form.Files {
+        key := fmt.Sprintf("file%d.", i)
+        form.CheckField(validator.NotBlank(f.Name), key+"name", "This field cannot be blank")
+        form.CheckField(validator.MaxChars(f.Name, 255), key+"name", "This field cannot be more than 255 characters long")
+        form.CheckField(validFileName(f.Name), key+"name", "This field must be a file name, without slashes or control characters")
+        form.CheckField(!seen[f.Name], key+"name", "Another file already has this name")
+        form.CheckField(validator.NotBlank(f.Content), key+"content", "This field cannot be blank")
+        form.CheckField(validator.PermittedValue(f.ContentType, models.ContentTypeCode, models.ContentTypeMarkdown), key+"content_type", "This field must equal code or markdown")
+        form.CheckField(f.Language == "" || highlight.Supported(f.Language), key+"language", "This language is not supported")
+        seen[f.Name] = true
+    }
+}
+
+// validateChunkForm checks a new chunk, adding any errors to the form. It is
+// used for chunks from both the create form and the API. The fields of
+// features which are switched off are ignored: the form doesn't show them,
+// so they can only come from an old page. It returns the IDs of the chunk
+// being forked and of the workspace for the chunk, if any.
+func (app *application) validateChunkForm(ctx context.Context, form *chunkCreateForm) (forkedFrom int, workspaceID int, err error) {
+    if !app.features.CustomSlugs {
+        form.Slug = ""
+    }
+    if !app.features.Forking {
+        form.ForkedFrom = ""
+    }
+
+    form.checkContent()
+    if form.Slug != "" {
+        form.CheckField(validator.MinChars(form.Slug, 3), "slug", "This field must be at least 3 characters long")
+        form.CheckField(validator.MaxChars(form.Slug, 64), "slug", "This field cannot be more than 64 characters long")
+        form.CheckField(validator.Matches(form.Slug, slugRX), "slug", "This field can only contain lower case letters, digits and hyphens")
+        form.CheckField(!validator.PermittedValue(form.Slug, reservedSlugs...), "slug", "This slug is reserved")
+    }
+    form.CheckField(validator.PermittedInt(form.Expires, 1, 7, 365), "expires", "This field must equal 1, 7 or 365")
+
+    // A private chunk can only be seen by whoever created it, so that needs
+    // someone who is logged in.
+    userID := userIDFromContext(ctx)
+    form.CheckField(!form.Private || userID != 0, "private", "You need to log in to create a private chunk")
+
+    // Make sure the chunk being forked still exists, it may have expired
+    // while the form was being filled in. We need its ID to record the fork.
+    if form.ForkedFrom != "" {
+        parent, err := app.chunks.GetBySlug(ctx, form.ForkedFrom, userID)
+        if err == nil {
+            forkedFrom = parent.ID
+        } else if errors.Is(err, models.ErrNoRecord) {
+            form.AddFieldError("forked_from", "The chunk you are forking no longer exists")
+        } else if err != nil {
+            return 0, 0, err
+        }
+    }
+
+    // Only members can put chunks in a workspace. Someone who isn't logged
+    // in is a member of none.
+    if form.Workspace != "" {
+        workspace, err := app.workspaces.Get(ctx, form.Workspace, userID)
+        if err == nil {
+            workspaceID = workspace.ID
+        } else if errors.Is(err, models.ErrNoRecord) {
+            form.AddFieldError("workspace", "You are not a member of this workspace")
+        } else if err != nil {
+            return 0, 0, err
+        }
+    }
+    return forkedFrom, workspaceID, nil
+}
+
+// modelFiles returns the files of the form, ready to be inserted.
+func (form *chunkCreateForm) modelFiles() []*models.File {
+    files := make([]*models.File, len(form.Files))
+    for i, f := range form.Files {
+        // Markdown files are always highlighted as Markdown when their
+        // source is shown. Otherwise, if no language was chosen, guess one
+        // from the file name and content.
+        language := f.Language
+        if f.ContentType == models.ContentTypeMarkdown {
+            language = "markdown"
+        } else if language == "" {
+            language = highlight.DetectFile(f.Name, f.Content)
+        }
+        files[i] = &models.File{
+            Name:        f.Name,
+            Content:     f.Content,
+            ContentType: f.ContentType,
+            Language:    language,
+        }
+    }
+    return files
+}
+
+func (app *application)chunkCreatePost(w http.ResponseWriter, r *http.Request){
+    // Limit the size of the request body, so nobody can fill up our memory
+    // (or database). The form is URL-encoded, which can make the content up
+    // to three times bigger, and the other fields need a little room too.
+    // The size of the content itself is checked once it has been decoded.
+    r.Body = http.MaxBytesReader(w, r.Body, 3*app.maxChunkBytes+64<<10)
+
+    // Call r.ParseForm() which adds any data in POST request bodies to the
+    // r.PostForm map.
+    err := r.ParseForm()
+    if err != nil {
+        var maxBytesError *http.MaxBytesError
+        if errors.As(err, &maxBytesError) {
+            app.chunkTooLarge(w, r)
+        } else {
+            app.clientError(w, r, http.StatusBadRequest)
+        }
+        return
+    }
+
+    // The r.PostForm.Get() method always returns the form data as a *string*,
+    // so we need to manually convert the expires value to an int.
+    expires, err := strconv.Atoi(r.PostForm.Get("expires"))
+    if err != nil {
+        app.clientError(w, r, http.StatusBadRequest)
+        return
+    }
+
+    form := chunkCreateForm{
+        Title:   r.PostForm.Get("title"),
+        Slug:    strings.TrimSpace(r.PostForm.Get("slug")),
+        Expires: expires,
+    }
+
+    // The forked_from field is only sent by the form for forking a chunk,
+    // and the workspace and private fields only to users who are logged in.
+    form.ForkedFrom = r.PostForm.Get("forked_from")
+    form.Workspace = r.PostForm.Get("workspace")
+    form.Private = r.PostForm.Get("private") == "true"
+
+    var ok bool
+    form.Files, ok = fileForms(r)
+    if !ok {
+        app.clientError(w, r, http.StatusBadRequest)
+        return
+    }
+
+    if form.size() > app.maxChunkBytes {
+        app.chunkTooLarge(w, r)
+        return
+    }
+
+    forkedFrom, workspaceID, err := app.validateChunkForm(r.Context(), &form)
+    if err != nil {
+        app.serverError(w, r, err)
+        return
+    }
+
+    // If there are any errors, redisplay the create.html template passing in
+    // the form and a 422 status code.
+    if !form.Valid() {
+        app.renderCreate(w, r, http.StatusUnprocessableEntity, form)
+        return
+    }
+
     // Pass the data to the ChunkModel.Insert() method, receiving the
-    // ID of the new record back.
-    id, err := app.chunks.Insert(title, content, expires)
+    // slug of the new record back. If the custom slug is already taken, or
+    // the user has left the workspace in the meantime, add an error message
+    // to the form and re-display it.
+    owner := app.owner(r)
+    owner.WorkspaceID = workspaceID
+    slug, err := app.chunks.Insert(r.Context(), owner, form.Title, form.Slug, form.modelFiles(), form.Expires, forkedFrom, form.Private)
     if err != nil {
-        app.serverError(w, err)
+        switch {
+        case errors.Is(err, models.ErrDuplicateSlug):
+            form.AddFieldError("slug", "This slug is already in use")
+            app.renderCreate(w, r, http.StatusUnprocessableEntity, form)
+        case errors.Is(err, models.ErrNotMember):
+            form.AddFieldError("workspace", "You are not a member of this workspace")
+            app.renderCreate(w, r, http.StatusUnprocessableEntity, form)
+        case errors.Is(err, models.ErrQuotaExceeded):
+            app.quotaExceeded(w, r, owner, form)
+        default:
+            app.serverError(w, r, err)
+        }
         return
     }
+    app.metrics.chunksCreated.Inc()
+
     // Redirect the user to the relevant page for the chunk.
-    http.Redirect(w, r, fmt.Sprintf("/chunkbox/view?id=%d", id), http.StatusSeeOther)
+    http.Redirect(w, r, "/c/"+slug, http.StatusSeeOther)
+}
+
+// fileForms returns the files of a submitted create or edit form. Each file
+// in the form repeats the same four fields, so r.PostForm holds a slice of
+// values for each of them, in the order they appear in the form. If the
+// slices aren't the same length the request wasn't sent by our form, and it
+// returns false.
+func fileForms(r *http.Request) ([]*fileForm, bool) {
+    names := r.PostForm["file_name"]
+    contents := r.PostForm["file_content"]
+    contentTypes := r.PostForm["file_content_type"]
+    languages := r.PostForm["file_language"]
+    if len(contents) != len(names) || len(contentTypes) != len(names) || len(languages) != len(names) {
+        return nil, false
+    }
+
+    var files []*fileForm
+    for i := range names {
+        files = append(files, &fileForm{
+            Name:        strings.TrimSpace(names[i]),
+            Content:     contents[i],
+            ContentType: contentTypes[i],
+            Language:    languages[i],
+        })
+    }
+    return files, true
+}
+
+// quotaExceeded tells the user the chunk they tried to create would take
+// them over their quota. JSON clients get the usage in the error, everyone
+// else gets the form back so their work isn't lost.
+func (app *application) quotaExceeded(w http.ResponseWriter, r *http.Request, owner models.Owner, form chunkCreateForm) {
+    u, err := app.chunks.Usage(r.Context(), owner)
+    if err != nil {
+        app.serverError(w, r, err)
+        return
+    }
+    message := "This chunk would take you over your quota. Delete some chunks or wait for them to expire."
+
+    if wantsJSON(r) {
+        app.sendError(w, r, &errorData{
+            Status:  http.StatusForbidden,
+            Message: message,
+            Usage:   newUsageData(owner, u, app.chunks.QuotaFor(owner)),
+        })
+        return
+    }
+
+    form.AddFieldError("quota", message)
+    app.renderCreate(w, r, http.StatusForbidden, form)
+}
+
+// The chunkFork handler shows the create form filled in with the title and
+// files of an existing chunk. Submitting it creates a new chunk which
+// remembers the chunk it was forked from.
+func (app *application)chunkFork(w http.ResponseWriter, r *http.Request){
+    chunk, ok := app.chunkFromPath(w, r)
+    if !ok {
+        return
+    }
+
+    // A fork of a private chunk is private too, unless the user says
+    // otherwise. A fork of a chunk in a workspace goes in the same
+    // workspace if the user belongs to it (which is what CanShare means
+    // for a workspace chunk). Someone who only sees it through a grant
+    // can't create chunks there, so their fork is a private chunk of
+    // their own instead.
+    form := chunkCreateForm{
+        Title:      chunk.Title,
+        Expires:    365,
+        ForkedFrom: chunk.Slug,
+        Private:    chunk.Private,
+    }
+    if chunk.WorkspaceID != 0 {
+        if chunk.CanShare {
+            form.Workspace = chunk.WorkspaceSlug
+        } else {
+            form.Private = true
+        }
+    }
+    for _, f := range chunk.Files {
+        form.Files = append(form.Files, &fileForm{
+            Name:        f.Name,
+            Content:     f.Content,
+            ContentType: f.ContentType,
+            Language:    f.Language,
+        })
+    }
+
+    app.renderCreate(w, r, http.StatusOK, form)
+}
+
+// The chunkEdit handler shows the form for changing the title and files of
+// a chunk.
+func (app *application) chunkEdit(w http.ResponseWriter, r *http.Request) {
+    chunk, ok := app.chunkFromPath(w, r)
+    if !ok || !app.requireEdit(w, r, chunk) {
+        return
+    }
+
+    form := chunkCreateForm{Title: chunk.Title}
+    for _, f := range chunk.Files {
+        form.Files = append(form.Files, &fileForm{
+            Name:        f.Name,
+            Content:     f.Content,
+            ContentType: f.ContentType,
+            Language:    f.Language,
+        })
+    }
+    app.renderEdit(w, r, http.StatusOK, chunk, form)
+}
+
+// requireEdit sends a 403 Forbidden response and returns false unless the
+// user may edit the chunk.
+func (app *application) requireEdit(w http.ResponseWriter, r *http.Request, chunk *models.Chunk) bool {
+    if !chunk.CanEdit {
+        app.errorResponse(w, r, http.StatusForbidden, "You don't have permission to edit this chunk.", "")
+        return false
+    }
+    return true
+}
+
+// renderEdit shows the edit form for the chunk with the given status.
+func (app *application) renderEdit(w http.ResponseWriter, r *http.Request, status int, chunk *models.Chunk, form chunkCreateForm) {
+    data := app.newTemplateData(r)
+    data.Chunk = chunk
+    data.Form = form
+    data.Languages = highlight.Languages()
+    app.render(w, r, status, "edit.html", data)
+}
+
+// The chunkEditPost handler saves the changes to the title and files of a
+// chunk. The slug, expiry and workspace of a chunk can't be changed.
+func (app *application) chunkEditPost(w http.ResponseWriter, r *http.Request) {
+    // The same limit as for a new chunk, see chunkCreatePost.
+    r.Body = http.MaxBytesReader(w, r.Body, 3*app.maxChunkBytes+64<<10)
+
+    err := r.ParseForm()
+    if err != nil {
+        var maxBytesError *http.MaxBytesError
+        if errors.As(err, &maxBytesError) {
+            app.chunkTooLarge(w, r)
+        } else {
+            app.clientError(w, r, http.StatusBadRequest)
+        }
+        return
+    }
+    chunk, ok := app.chunkFromPath(w, r)
+    if !ok || !app.requireEdit(w, r, chunk) {
+        return
+    }
+
+    form := chunkCreateForm{Title: r.PostForm.Get("title")}
+    form.Files, ok = fileForms(r)
+    if !ok {
+        app.clientError(w, r, http.StatusBadRequest)
+        return
+    }
+    if form.size() > app.maxChunkBytes {
+        app.chunkTooLarge(w, r)
+        return
+    }
+
+    form.checkContent()
+    if !form.Valid() {
+        app.renderEdit(w, r, http.StatusUnprocessableEntity, chunk, form)
+        return
+    }
+
+    err = app.chunks.Update(r.Context(), chunk.Slug, userIDFromContext(r.Context()), form.Title, form.modelFiles())
+    if err != nil {
+        switch {
+        case errors.Is(err, models.ErrNoRecord):
+            app.notFound(w, r)
+        case errors.Is(err, models.ErrQuotaExceeded):
+            form.AddFieldError("quota", "These changes would take the chunk over its owner's quota.")
+            app.renderEdit(w, r, http.StatusForbidden, chunk, form)
+        default:
+            app.serverError(w, r, err)
+        }
+        return
+    }
+
+    app.sessionManager.Put(r.Context(), "flash", "Your changes have been saved.")
+    http.Redirect(w, r, "/c/"+chunk.Slug, http.StatusSeeOther)
+}
+
+// The chunkDownload handler sends all the files of a chunk as a single
+// archive. The format parameter picks between a zip file (the default) and a
+// gzipped tarball.
+func (app *application)chunkDownload(w http.ResponseWriter, r *http.Request){
+    chunk, ok := app.chunkFromPath(w, r)
+    if !ok {
+        return
+    }
+
+    format := r.URL.Query().Get("format")
+    if format == "" {
+        format = "zip"
+    }
+
+    // Write the archive to a buffer first, so that we can still send an
+    // error response if something goes wrong half way through.
+    buf := new(bytes.Buffer)
+    var contentType string
+    var err error
+    switch format {
+    case "zip":
+        contentType = "application/zip"
+        err = writeZip(buf, chunk)
+    case "tar.gz":
+        contentType = "application/gzip"
+        err = writeTarGz(buf, chunk)
+    default:
+        app.clientError(w, r, http.StatusBadRequest)
+        return
+    }
+    if err != nil {
+        app.serverError(w, r, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", contentType)
+    w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chunk-%s.%s"`, chunk.Slug, format))
+    buf.WriteTo(w)
+}
+
+// The usage handler shows how many live chunks the user has and how big
+// they are, against their quota.
+func (app *application) usage(w http.ResponseWriter, r *http.Request) {
+    owner := app.owner(r)
+    u, err := app.chunks.Usage(r.Context(), owner)
+    if err != nil {
+        app.serverError(w, r, err)
+        return
+    }
+    usage := newUsageData(owner, u, app.chunks.QuotaFor(owner))
+
+    if wantsJSON(r) {
+        app.writeJSON(w, http.StatusOK, map[string]any{"usage": usage})
+        return
+    }
+
+    data := app.newTemplateData(r)
+    data.Usage = usage
+    app.render(w, r, http.StatusOK, "usage.html", data)
+}
+
+// chunkFromPath fetches the chunk named by the :slug parameter in a
+// /c/:slug URL. If the chunk can't be found, or there's an error, it sends
+// the response itself and returns false.
+func (app *application) chunkFromPath(w http.ResponseWriter, r *http.Request) (*models.Chunk, bool) {
+    // httprouter stores the values of named parameters in the request
+    // context.
+    params := httprouter.ParamsFromContext(r.Context())
+    slug := params.ByName("slug")
+
+    chunk, err := app.chunks.GetBySlug(r.Context(), slug, userIDFromContext(r.Context()))
+    if err != nil{
+        if errors.Is(err, models.ErrNoRecord){
+            app.notFound(w, r)
+        }else {
+            app.serverError(w, r, err)
+        }
+        return nil, false
+    }
+    return chunk, true
+}
+
+// legacyRedirect returns a handler which keeps links by id working, like
+// /chunkbox/view/1 or the old /chunkbox/view?id=1. It looks up the slug of
+// the chunk and sends a permanent redirect to the /c/:slug URL with the
+// given suffix, keeping any other query string parameters.
+func (app *application) legacyRedirect(suffix string) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        query := r.URL.Query()
+        // Take the id from the :id parameter in the path, if the route has
+        // one, or from the query string.
+        param := httprouter.ParamsFromContext(r.Context()).ByName("id")
+        if param == "" {
+            param = query.Get("id")
+        }
+        id, err :=  strconv.Atoi(param)
+        if err != nil || id < 1{
+            app.notFound(w, r)
+            return
+        }
+
+        // Old links by id only ever pointed at public chunks, so look the
+        // id up as nobody. Redirecting for members would tell anyone who
+        // walks the ids which slugs belong to private chunks.
+        chunk, err := app.chunks.Get(r.Context(), id, 0)
+        if err != nil{
+            if errors.Is(err, models.ErrNoRecord){
+                app.notFound(w, r)
+            }else {
+                app.serverError(w, r, err)
+            }
+            return
+        }
+
+        query.Del("id")
+        url := "/c/" + chunk.Slug + suffix
+        if len(query) > 0 {
+            url += "?" + query.Encode()
+        }
+        http.Redirect(w, r, url, http.StatusMovedPermanently)
+    }
+}
+
+// Create a new userSignupForm struct.
+type userSignupForm struct {
+    Name     string
+    Email    string
+    Password string
+    validator.Validator
+}
+
+// The userSignup handler shows the signup form.
+func (app *application) userSignup(w http.ResponseWriter, r *http.Request) {
+    data := app.newTemplateData(r)
+    data.Form = userSignupForm{}
+    app.render(w, r, http.StatusOK, "signup.html", data)
+}
+
+func (app *application) userSignupPost(w http.ResponseWriter, r *http.Request) {
+    err := r.ParseForm()
+    if err != nil {
+        app.clientError(w, r, http.StatusBadRequest)
+        return
+    }
+
+    form := userSignupForm{
+        Name:     r.PostForm.Get("name"),
+        Email:    strings.TrimSpace(r.PostForm.Get("email")),
+        Password: r.PostForm.Get("password"),
+    }
+
+    // Validate the form contents using our helper functions.
+    form.CheckField(validator.NotBlank(form.Name), "name", "This field cannot be blank")
+    form.CheckField(validator.MaxChars(form.Name, 255), "name", "This field cannot be more than 255 characters long")
+    form.CheckField(validator.NotBlank(form.Email), "email", "This field cannot be blank")
+    form.CheckField(validator.MaxChars(form.Email, 255), "email", "This field cannot be more than 255 characters long")
+    form.CheckField(validator.Matches(form.Email, validator.EmailRX), "email", "This field must be a valid email address")
+    form.CheckField(validator.NotBlank(form.Password), "password", "This field cannot be blank")
+    form.CheckField(validator.MinChars(form.Password, 8), "password", "This field must be at least 8 characters long")
+    // bcrypt only looks at the first 72 bytes of a password.
+    form.CheckField(len(form.Password) <= 72, "password", "This field cannot be more than 72 bytes long")
+
+    // If there are any errors, redisplay the signup form along with a 422
+    // status code.
+    if !form.Valid() {
+        data := app.newTemplateData(r)
+        data.Form = form
+        app.render(w, r, http.StatusUnprocessableEntity, "signup.html", data)
+        return
+    }
+
+    // Try to create a new user record in the database. If the email already
+    // exists then add an error message to the form and re-display it.
+    err = app.users.Insert(r.Context(), form.Name, form.Email, form.Password)
+    if err != nil {
+        if errors.Is(err, models.ErrDuplicateEmail) {
+            form.AddFieldError("email", "Email address is already in use")
+
+            data := app.newTemplateData(r)
+            data.Form = form
+            app.render(w, r, http.StatusUnprocessableEntity, "signup.html", data)
+        } else {
+            app.serverError(w, r, err)
+        }
+        return
+    }
+
+    // Otherwise add a confirmation flash message to the session confirming
+    // that their signup worked.
+    app.sessionManager.Put(r.Context(), "flash", "Your signup was successful. Please log in.")
+
+    // And redirect the user to the login page.
+    http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// Create a new userLoginForm struct.
+type userLoginForm struct {
+    Email    string
+    Password string
+    validator.Validator
+}
+
+// The userLogin handler shows the login form.
+func (app *application) userLogin(w http.ResponseWriter, r *http.Request) {
+    data := app.newTemplateData(r)
+    data.Form = userLoginForm{}
+    app.render(w, r, http.StatusOK, "login.html", data)
+}
+
+func (app *application) userLoginPost(w http.ResponseWriter, r *http.Request) {
+    err := r.ParseForm()
+    if err != nil {
+        app.clientError(w, r, http.StatusBadRequest)
+        return
+    }
+
+    form := userLoginForm{
+        Email:    strings.TrimSpace(r.PostForm.Get("email")),
+        Password: r.PostForm.Get("password"),
+    }
+
+    // Do some validation checks on the form. We check that both email and
+    // password are provided, and also check the format of the email address as
+    // a UX-nicety (in case the user makes a typo).
+    form.CheckField(validator.NotBlank(form.Email), "email", "This field cannot be blank")
+    form.CheckField(validator.Matches(form.Email, validator.EmailRX), "email", "This field must be a valid email address")
+    form.CheckField(validator.NotBlank(form.Password), "password", "This field cannot be blank")
+
+    if !form.Valid() {
+        data := app.newTemplateData(r)
+        data.Form = form
+        app.render(w, r, http.StatusUnprocessableEntity, "login.html", data)
+        return
+    }
+
+    // Check whether the credentials are valid. If they're not, add a generic
+    // non-field error message and re-display the login page.
+    id, err := app.users.Authenticate(r.Context(), form.Email, form.Password)
+    if err != nil {
+        switch {
+        case errors.Is(err, models.ErrInvalidCredentials):
+            form.AddNonFieldError("Email or password is incorrect")
+        case errors.Is(err, models.ErrUserDisabled):
+            form.AddNonFieldError("Your account has been disabled")
+        default:
+            app.serverError(w, r, err)
+            return
+        }
 
+        data := app.newTemplateData(r)
+        data.Form = form
+        app.render(w, r, http.StatusUnprocessableEntity, "login.html", data)
+        return
+    }
+
+    // Use the RenewToken() method on the current session to change the session
+    // ID. It's good practice to generate a new session ID when the
+    // authentication state or privilege levels changes for the user (e.g. login
+    // and logout operations).
+    err = app.sessionManager.RenewToken(r.Context())
+    if err != nil {
+        app.serverError(w, r, err)
+        return
+    }
+
+    // Add the ID of the current user to the session, so that they are now
+    // 'logged in'.
+    app.sessionManager.Put(r.Context(), "authenticatedUserID", id)
+
+    // Someone who was sent here to link their single sign-on login to
+    // this account is asked to confirm it next.
+    if app.sso != nil && app.sessionManager.Exists(r.Context(), "ssoLinkIssuer") {
+        http.Redirect(w, r, "/user/login/sso/link", http.StatusSeeOther)
+        return
+    }
+
+    http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (app *application) userLogoutPost(w http.ResponseWriter, r *http.Request) {
+    // Use the RenewToken() method on the current session to change the session
+    // ID again.
+    err := app.sessionManager.RenewToken(r.Context())
+    if err != nil {
+        app.serverError(w, r, err)
+        return
+    }
+
+    // Remove the authenticatedUserID from the session data so that the user is
+    // 'logged out'.
+    app.sessionManager.Remove(r.Context(), "authenticatedUserID")
+
+    // Add a flash message to the session to confirm to the user that they've been
+    // logged out.
+    app.sessionManager.Put(r.Context(), "flash", "You've been logged out successfully!")
+
+    http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// tokenCreateForm holds the fields of the form for a new API token.
+// Expires is the number of days the token lasts, or 0 for ever.
+type tokenCreateForm struct {
+    Name    string
+    Scopes  []string
+    Expires int
+    validator.Validator
+}
+
+// HasScope reports whether the scope is ticked in the form.
+func (form tokenCreateForm) HasScope(scope string) bool {
+    return validator.PermittedValue(scope, form.Scopes...)
+}
+
+// The settingsTokens handler shows the user's API tokens and the form for a new
+// one. Right after a token has been created it is shown here, once.
+func (app *application) settingsTokens(w http.ResponseWriter, r *http.Request) {
+    tokens, err := app.tokens.ForUser(r.Context(), userIDFromContext(r.Context()))
+    if err != nil {
+        app.serverError(w, r, err)
+        return
+    }
+
+    data := app.newTemplateData(r)
+    data.Tokens = tokens
+    data.NewToken = app.sessionManager.PopString(r.Context(), "newToken")
+    data.Scopes = models.Scopes
+    data.Form = tokenCreateForm{Scopes: []string{models.ScopeRead}, Expires: 90}
+    app.render(w, r, http.StatusOK, "tokens.html", data)
+}
+
+func (app *application) tokenCreatePost(w http.ResponseWriter, r *http.Request) {
+    err := r.ParseForm()
+    if err != nil {
+        app.clientError(w, r, http.StatusBadRequest)
+        return
+    }
+
+    expires, err := strconv.Atoi(r.PostForm.Get("expires"))
+    if err != nil {
+        app.clientError(w, r, http.StatusBadRequest)
+        return
+    }
+
+    form := tokenCreateForm{
+        Name:    strings.TrimSpace(r.PostForm.Get("name")),
+        Scopes:  r.PostForm["scopes"],
+        Expires: expires,
+    }
+
+    form.CheckField(validator.NotBlank(form.Name), "name", "This field cannot be blank")
+    form.CheckField(validator.MaxChars(form.Name, 100), "name", "This field cannot be more than 100 characters long")
+    form.CheckField(len(form.Scopes) > 0, "scopes", "A token needs at least one scope")
+    for _, scope := range form.Scopes {
+        form.CheckField(validator.PermittedValue(scope, models.Scopes...), "scopes", "This scope does not exist")
+    }
+    form.CheckField(validator.PermittedInt(form.Expires, 0, 30, 90, 365), "expires", "This field must equal 0, 30, 90 or 365")
+
+    userID := userIDFromContext(r.Context())
+    if !form.Valid() {
+        tokens, err := app.tokens.ForUser(r.Context(), userID)
+        if err != nil {
+            app.serverError(w, r, err)
+            return
+        }
+        data := app.newTemplateData(r)
+        data.Tokens = tokens
+        data.Scopes = models.Scopes
+        data.Form = form
+        app.render(w, r, http.StatusUnprocessableEntity, "tokens.html", data)
+        return
+    }
+
+    var expiry time.Time
+    if form.Expires != 0 {
+        expiry = time.Now().AddDate(0, 0, form.Expires)
+    }
+    token, err := app.tokens.Insert(r.Context(), userID, form.Name, form.Scopes, expiry)
+    if err != nil {
+        app.serverError(w, r, err)
+        return
+    }
+
+    // The token is shown on the next page and then forgotten, we only keep
+    // its hash. Redirecting means it isn't in a page a refresh would post
+    // again.
+    app.sessionManager.Put(r.Context(), "newToken", token)
+    http.Redirect(w, r, "/settings/tokens", http.StatusSeeOther)
+}
+
+// The tokenRevokePost handler deletes one of the user's API tokens. It
+// stops working straight away.
+func (app *application) tokenRevokePost(w http.ResponseWriter, r *http.Request) {
+    id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+    if err != nil || id < 1 {
+        app.notFound(w, r)
+        return
+    }
+
+    err = app.tokens.Revoke(r.Context(), userIDFromContext(r.Context()), id)
+    if err != nil {
+        if errors.Is(err, models.ErrNoRecord) {
+            app.notFound(w, r)
+        } else {
+            app.serverError(w, r, err)
+        }
+        return
+    }
+
+    app.sessionManager.Put(r.Context(), "flash", "The token has been revoked.")
+    http.Redirect(w, r, "/settings/tokens", http.StatusSeeOther)
+}
+
+// The highlightStyles handler serves the stylesheet for highlighted chunks,
+// which was generated from the chosen theme when the application started.
+func (app *application)highlightStyles(w http.ResponseWriter, r *http.Request){
+    w.Header().Set("Content-Type", "text/css; charset=utf-8")
+    w.Header().Set("Cache-Control", "public, max-age=3600")
+    w.Write(app.highlightCSS)
+}
+
+// readyTimeout is how long the readiness checks may take before the
+// database is considered unavailable.
+const readyTimeout = 2 * time.Second
+
+// The healthz handler tells the orchestrator the process is alive. It
+// deliberately checks nothing else: a database outage shouldn't get every
+// instance restarted.
+func (app *application) healthz(w http.ResponseWriter, r *http.Request) {
+    app.writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
+
+// The readyz handler tells the orchestrator whether we can serve traffic:
+// the database answers, the templates are loaded and all the migrations
+// have been applied. Once graceful shutdown has begun it always fails, so
+// that no new requests are sent our way. Each check is reported as "ok" or
+// the reason it failed.
+func (app *application) readyz(w http.ResponseWriter, r *http.Request) {
+    ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+    defer cancel()
+
+    checks := map[string]string{}
+    ready := true
+    check := func(name string, err error) {
+        if err != nil {
+            checks[name] = err.Error()
+            ready = false
+        } else {
+            checks[name] = "ok"
+        }
+    }
+
+    if app.shuttingDown.Load() {
+        check("shutdown", errors.New("shutting down"))
+    }
+
+    check("database", app.chunks.DB.PingContext(ctx))
+
+    cache, err := app.templates()
+    if err == nil && len(cache) == 0 {
+        err = errors.New("no templates loaded")
+    }
+    check("templates", err)
+
+    pending, err := app.migrations.Pending(ctx)
+    if err == nil && len(pending) > 0 {
+        err = fmt.Errorf("%d pending: %s", len(pending), strings.Join(pending, ", "))
+    }
+    check("migrations", err)
+
+    status := http.StatusOK
+    body := map[string]any{"status": "ok", "checks": checks}
+    if !ready {
+        status = http.StatusServiceUnavailable
+        body["status"] = "unavailable"
+    }
+    app.writeJSON(w, status, body)
 }
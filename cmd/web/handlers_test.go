@@ -0,0 +1,360 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "testing"
+
+    "github.com/cpucortexm/chunkbox/internal/assert"
+    "github.com/cpucortexm/chunkbox/internal/models"
+    "github.com/cpucortexm/chunkbox/internal/models/mocks"
+)
+
+// newCreateForm returns the fields of the create form with a single file
+// holding the content.
+func newCreateForm(title, content string) url.Values {
+    return url.Values{
+        "title":             {title},
+        "expires":           {"7"},
+        "file_name":         {"main.go"},
+        "file_content":      {content},
+        "file_content_type": {models.ContentTypeCode},
+        "file_language":     {""},
+    }
+}
+
+// newCreateRequest returns a POST request for the create form with a
+// single file holding the content.
+func newCreateRequest(title, content string) *http.Request {
+    return newCreateFormRequest(newCreateForm(title, content))
+}
+
+// newCreateFormRequest returns a POST request for the create form with the
+// fields.
+func newCreateFormRequest(form url.Values) *http.Request {
+    r := httptest.NewRequest(http.MethodPost, "/chunkbox/create", strings.NewReader(form.Encode()))
+    r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    r.RemoteAddr = "203.0.113.7:51000"
+    return r
+}
+
+func TestChunkCreatePostTooLarge(t *testing.T) {
+    app := newTestApplication(t)
+    app.maxChunkBytes = 10
+
+    tests := []struct {
+        name    string
+        content string
+    }{
+        {
+            // Bigger than the request body may be, so reading the form
+            // fails.
+            name:    "Oversized body",
+            content: strings.Repeat("a", 70<<10),
+        },
+        {
+            // The body is small enough to read, but the content is over
+            // the limit once it has been decoded.
+            name:    "Oversized content",
+            content: "package main // too long",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            rr := httptest.NewRecorder()
+            app.chunkCreatePost(rr, newCreateRequest("Too large", tt.content))
+
+            assert.Equal(t, rr.Code, http.StatusRequestEntityTooLarge)
+            assert.StringContains(t, rr.Body.String(), "This chunk is too large")
+        })
+    }
+}
+
+func TestChunkCreatePostQuota(t *testing.T) {
+    app := newTestApplication(t)
+    app.maxChunkBytes = 1 << 20
+    app.chunks = &models.ChunkModel{
+        DB:      newTestDB(t),
+        IPQuota: models.Quota{MaxChunks: 1},
+    }
+
+    // The first chunk fits in the quota.
+    rr := httptest.NewRecorder()
+    app.chunkCreatePost(rr, newCreateRequest("First", "package main"))
+    assert.Equal(t, rr.Code, http.StatusSeeOther)
+
+    // The second doesn't, and the form comes back with what was typed in.
+    rr = httptest.NewRecorder()
+    app.chunkCreatePost(rr, newCreateRequest("Second", "package second"))
+    assert.Equal(t, rr.Code, http.StatusForbidden)
+    body := rr.Body.String()
+    assert.StringContains(t, body, "This chunk would take you over your quota")
+    assert.StringContains(t, body, "Second")
+    assert.StringContains(t, body, "package second")
+
+    // JSON clients are told their usage instead.
+    r := newCreateRequest("Third", "package third")
+    r.Header.Set("Accept", "application/json")
+    rr = httptest.NewRecorder()
+    app.chunkCreatePost(rr, r)
+    assert.Equal(t, rr.Code, http.StatusForbidden)
+    assert.StringContains(t, rr.Body.String(), `"chunks":1`)
+
+    // Another IP address has a quota of its own.
+    r = newCreateRequest("Elsewhere", "package main")
+    r.RemoteAddr = "198.51.100.1:51000"
+    rr = httptest.NewRecorder()
+    app.chunkCreatePost(rr, r)
+    assert.Equal(t, rr.Code, http.StatusSeeOther)
+}
+
+func TestLegacyRedirect(t *testing.T) {
+    db := newTestDB(t)
+    app := newTestApplication(t)
+    app.chunks = &models.ChunkModel{DB: db}
+    ctx := context.Background()
+
+    // Alice has a public chunk (id 1), one in her workspace (id 2) and a
+    // private one (id 3).
+    users := &models.UserModel{DB: db}
+    err := users.Insert(ctx, "Alice", "alice@example.com", "pa55word!")
+    assert.NilError(t, err)
+    workspaces := &models.WorkspaceModel{DB: db}
+    err = workspaces.Insert(ctx, 1, "Team", "team")
+    assert.NilError(t, err)
+    files := []*models.File{{Name: "main.go", Content: "package main", ContentType: models.ContentTypeCode}}
+    _, err = app.chunks.Insert(ctx, models.Owner{UserID: 1}, "Public", "public-chunk", files, 7, 0, false)
+    assert.NilError(t, err)
+    _, err = app.chunks.Insert(ctx, models.Owner{UserID: 1, WorkspaceID: 1}, "Team", "team-chunk", files, 7, 0, false)
+    assert.NilError(t, err)
+    _, err = app.chunks.Insert(ctx, models.Owner{UserID: 1}, "Private", "private-chunk", files, 7, 0, true)
+    assert.NilError(t, err)
+
+    tests := []struct {
+        name         string
+        url          string
+        suffix       string
+        userID       int
+        wantCode     int
+        wantLocation string
+    }{
+        {"Public", "/chunkbox/view?id=1", "", 0, http.StatusMovedPermanently, "/c/public-chunk"},
+        {"Public raw", "/chunkbox/raw?id=1&line=2", "/raw", 0, http.StatusMovedPermanently, "/c/public-chunk/raw?line=2"},
+        {"Workspace", "/chunkbox/view?id=2", "", 0, http.StatusNotFound, ""},
+        {"Workspace as a member", "/chunkbox/view?id=2", "", 1, http.StatusNotFound, ""},
+        {"Private", "/chunkbox/view?id=3", "", 0, http.StatusNotFound, ""},
+        {"Private as the owner", "/chunkbox/view?id=3", "", 1, http.StatusNotFound, ""},
+        {"Missing", "/chunkbox/view?id=4", "", 0, http.StatusNotFound, ""},
+        {"Bad ID", "/chunkbox/view?id=one", "", 0, http.StatusNotFound, ""},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+            if tt.userID != 0 {
+                r = r.WithContext(context.WithValue(r.Context(), userIDContextKey, tt.userID))
+            }
+            rr := httptest.NewRecorder()
+            app.legacyRedirect(tt.suffix)(rr, r)
+
+            assert.Equal(t, rr.Code, tt.wantCode)
+            assert.Equal(t, rr.Header().Get("Location"), tt.wantLocation)
+        })
+    }
+}
+
+func TestChunkEdit(t *testing.T) {
+    db := newTestDB(t)
+    app := newTestApplication(t)
+    app.maxChunkBytes = 100
+    app.chunks = &models.ChunkModel{DB: db, UserQuota: models.Quota{MaxBytes: 50}}
+    ctx := context.Background()
+
+    // Alice (1) and Bob (2) are in the test database, which their chunks
+    // refer to, and in the mock user model, which logs them in.
+    users := &models.UserModel{DB: db}
+    for _, name := range []string{"alice", "bob"} {
+        err := users.Insert(ctx, name, name+"@example.com", "pa55word")
+        assert.NilError(t, err)
+        app.users.(*mocks.UserModel).AddUser(name, name+"@example.com", "pa55word")
+    }
+    files := []*models.File{{Name: "main.go", Content: "package main", ContentType: models.ContentTypeCode}}
+    slug, err := app.chunks.Insert(ctx, models.Owner{UserID: 1}, "Original", "", files, 7, 0, false)
+    assert.NilError(t, err)
+    ts := newTestServer(t, app.routes())
+
+    // editForm returns the fields of the edit form with a single file.
+    editForm := func(csrfToken, title, content string) url.Values {
+        return url.Values{
+            "csrf_token":        {csrfToken},
+            "title":             {title},
+            "file_name":         {"main.go"},
+            "file_content":      {content},
+            "file_content_type": {models.ContentTypeCode},
+            "file_language":     {""},
+        }
+    }
+
+    // Someone who isn't logged in is sent to log in first.
+    code, header, _ := ts.get(t, "/c/"+slug+"/edit")
+    assert.Equal(t, code, http.StatusSeeOther)
+    assert.Equal(t, header.Get("Location"), "/user/login")
+
+    // Bob may see the chunk, but not edit it.
+    logIn(t, ts, "bob@example.com")
+    _, _, body := ts.get(t, "/c/"+slug)
+    assert.Equal(t, strings.Contains(body, "/c/"+slug+"/edit"), false)
+    code, _, _ = ts.get(t, "/c/"+slug+"/edit")
+    assert.Equal(t, code, http.StatusForbidden)
+    code, _, _ = ts.postForm(t, "/c/"+slug+"/edit", editForm(extractCSRFToken(t, body), "Bob's", "package bob"))
+    assert.Equal(t, code, http.StatusForbidden)
+
+    // Alice gets a link to the form, filled in with the chunk.
+    logIn(t, ts, "alice@example.com")
+    _, _, body = ts.get(t, "/c/"+slug)
+    assert.StringContains(t, body, "<a href='/c/"+slug+"/edit'>Edit</a>")
+    code, _, body = ts.get(t, "/c/"+slug+"/edit")
+    assert.Equal(t, code, http.StatusOK)
+    assert.StringContains(t, body, "value='Original'")
+    assert.StringContains(t, body, "package main</textarea>")
+    csrfToken := extractCSRFToken(t, body)
+
+    tests := []struct {
+        name     string
+        form     url.Values
+        wantCode int
+        wantBody string
+    }{
+        {
+            name:     "Blank title",
+            form:     editForm(csrfToken, "", "package main"),
+            wantCode: http.StatusUnprocessableEntity,
+            wantBody: "This field cannot be blank",
+        },
+        {
+            name: "Mismatched files",
+            form: func() url.Values {
+                form := editForm(csrfToken, "Changed", "package main")
+                form.Add("file_name", "other.go")
+                return form
+            }(),
+            wantCode: http.StatusBadRequest,
+        },
+        {
+            name:     "Too large",
+            form:     editForm(csrfToken, "Changed", strings.Repeat("x", 101)),
+            wantCode: http.StatusRequestEntityTooLarge,
+        },
+        {
+            name:     "Over quota",
+            form:     editForm(csrfToken, "Changed", strings.Repeat("x", 51)),
+            wantCode: http.StatusForbidden,
+            wantBody: "These changes would take the chunk over its owner&#39;s quota.",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            code, _, body := ts.postForm(t, "/c/"+slug+"/edit", tt.form)
+            assert.Equal(t, code, tt.wantCode)
+            if tt.wantBody != "" {
+                assert.StringContains(t, body, tt.wantBody)
+            }
+
+            chunk, err := app.chunks.GetBySlug(ctx, slug, 1)
+            assert.NilError(t, err)
+            assert.Equal(t, chunk.Title, "Original")
+        })
+    }
+
+    code, header, _ = ts.postForm(t, "/c/"+slug+"/edit", editForm(csrfToken, "Changed", "package changed"))
+    assert.Equal(t, code, http.StatusSeeOther)
+    assert.Equal(t, header.Get("Location"), "/c/"+slug)
+    _, _, body = ts.get(t, "/c/"+slug)
+    assert.StringContains(t, body, "Your changes have been saved.")
+    assert.StringContains(t, body, "Changed")
+    assert.StringContains(t, body, "changed")
+}
+
+func TestChunkCreatePostSlugInvalid(t *testing.T) {
+    app := newTestApplication(t)
+    app.maxChunkBytes = 1 << 20
+
+    tests := []struct {
+        name    string
+        slug    string
+        wantErr string
+    }{
+        {"Too short", "ab", "This field must be at least 3 characters long"},
+        {"Too long", strings.Repeat("a", 65), "This field cannot be more than 64 characters long"},
+        {"Upper case", "Dev-Setup", "This field can only contain lower case letters, digits and hyphens"},
+        {"Underscore", "dev_setup", "This field can only contain lower case letters, digits and hyphens"},
+        {"Slash", "dev/setup", "This field can only contain lower case letters, digits and hyphens"},
+        {"Leading hyphen", "-dev-setup", "This field can only contain lower case letters, digits and hyphens"},
+        {"Trailing hyphen", "dev-setup-", "This field can only contain lower case letters, digits and hyphens"},
+        {"Reclaimed slug", "~12", "This field can only contain lower case letters, digits and hyphens"},
+        {"Reserved static", "static", "This slug is reserved"},
+        {"Reserved api", "api", "This slug is reserved"},
+        {"Reserved chunkbox", "chunkbox", "This slug is reserved"},
+        {"Reserved shared", "shared", "This slug is reserved"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            form := newCreateForm("Dev setup", "make dev")
+            form.Set("slug", tt.slug)
+            rr := httptest.NewRecorder()
+            app.chunkCreatePost(rr, newCreateFormRequest(form))
+
+            // The form comes back with the slug, so it can be fixed.
+            assert.Equal(t, rr.Code, http.StatusUnprocessableEntity)
+            assert.StringContains(t, rr.Body.String(), tt.wantErr)
+            assert.StringContains(t, rr.Body.String(), "make dev")
+        })
+    }
+}
+
+func TestChunkCreatePostSlug(t *testing.T) {
+    db := newTestDB(t)
+    app := newTestApplication(t)
+    app.maxChunkBytes = 1 << 20
+    app.chunks = &models.ChunkModel{DB: db}
+
+    create := func(slug string) *httptest.ResponseRecorder {
+        form := newCreateForm("Dev setup", "make dev")
+        form.Set("slug", slug)
+        rr := httptest.NewRecorder()
+        app.chunkCreatePost(rr, newCreateFormRequest(form))
+        return rr
+    }
+
+    // Spaces around the slug are dropped.
+    rr := create(" dev-setup ")
+    assert.Equal(t, rr.Code, http.StatusSeeOther)
+    assert.Equal(t, rr.Header().Get("Location"), "/c/dev-setup")
+
+    // A slug can only be used by one live chunk at a time.
+    rr = create("dev-setup")
+    assert.Equal(t, rr.Code, http.StatusUnprocessableEntity)
+    assert.StringContains(t, rr.Body.String(), "This slug is already in use")
+
+    // Once that chunk has expired the slug can be used again.
+    _, err := db.Exec(`UPDATE chunks SET expires = DATE_SUB(UTC_TIMESTAMP(), INTERVAL 1 DAY) WHERE slug = 'dev-setup'`)
+    assert.NilError(t, err)
+    rr = create("dev-setup")
+    assert.Equal(t, rr.Code, http.StatusSeeOther)
+    assert.Equal(t, rr.Header().Get("Location"), "/c/dev-setup")
+
+    // With custom slugs switched off, the slug field is ignored and the
+    // chunk gets a random slug.
+    app.features.CustomSlugs = false
+    rr = create("Not A Slug")
+    assert.Equal(t, rr.Code, http.StatusSeeOther)
+    location := rr.Header().Get("Location")
+    assert.Equal(t, strings.HasPrefix(location, "/c/"), true)
+    assert.Equal(t, len(location), len("/c/")+models.DefaultSlugLength)
+}
@@ -6,31 +6,80 @@
 package main
 
 import (
+    "archive/tar"
+    "archive/zip"
     "bytes"
+    "compress/gzip"
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
     "fmt"
+    "html/template"
     "net/http"
+    "io"
     "runtime/debug"
+    "strconv"
+    "strings"
     "time"
+    "unicode"
+
+    "github.com/cpucortexm/chunkbox/internal/models"
+    "github.com/justinas/nosurf"
 )
 
 // Create an newTemplateData() helper, which returns a pointer to a templateData
-// struct initialized with the current year. 
+// struct initialized with the current year, the features switched on, whether
+// the user is logged in (and what they may do) and the CSRF token for any
+// forms. If the request has
+// a session, the flash message (if any) is taken out of it to be shown.
 func (app *application) newTemplateData(r *http.Request) *templateData {
- 
-    return &templateData{
-        CurrentYear: time.Now().Year(),
+    data := &templateData{
+        CurrentYear:     time.Now().Year(),
+        Features:        app.features,
+        IsAuthenticated: userIDFromContext(r.Context()) != 0,
+        UserID:          userIDFromContext(r.Context()),
+        CSRFToken:       nosurf.Token(r),
+        CanModerate:     models.RoleAllows(roleFromContext(r.Context()), models.RoleModerator),
+        IsAdmin:         models.RoleAllows(roleFromContext(r.Context()), models.RoleAdmin),
+    }
+    if app.sso != nil {
+        data.SSOName = app.sso.name
+    }
+    if hasSession(r) {
+        data.Flash = app.sessionManager.PopString(r.Context(), "flash")
+    }
+    return data
+}
+
+// templates returns the template cache. In development mode the cache is
+// rebuilt from the ui file system on every call, so that changes to the
+// templates show up without restarting the server.
+func (app *application) templates() (map[string]*template.Template, error) {
+    if app.dev {
+        return newTemplateCache(app.uiFS)
+    }
+    return app.templateCache, nil
+}
+
+func (app *application) render(w http.ResponseWriter, r *http.Request, status int, page string, data *templateData) {
+    cache, err := app.templates()
+    if err != nil {
+        // This can only happen in development mode, where we'd rather see
+        // what is wrong with the templates in the browser.
+        app.templateError(w, r, err)
+        return
     }
-} 
 
-func (app *application) render(w http.ResponseWriter, status int, page string, data *templateData) {
     // Retrieve the appropriate template set from the cache based on the page
     // name (like 'home.html'). If no entry exists in the cache with the
     // provided name, then create a new error and call the serverError() helper
     // method that we made earlier and return.
-    ts, ok := app.templateCache[page]
+    ts, ok := cache[page]
     if !ok {
         err := fmt.Errorf("the template %s does not exist", page)
-        app.serverError(w, err)
+        app.serverError(w, r, err)
         return
     }
 
@@ -39,10 +88,14 @@ func (app *application) render(w http.ResponseWriter, status int, page string, d
 
     // Write the template to the buffer, instead of straight to the
     // http.ResponseWriter. If there's an error, call our serverError() helper
-    // and then return.
-    err := ts.ExecuteTemplate(buf, "base", data)
+    // (or show the error in development mode) and then return.
+    err = ts.ExecuteTemplate(buf, "base", data)
     if err != nil {
-        app.serverError(w, err)
+        if app.dev {
+            app.templateError(w, r, err)
+        } else {
+            app.serverError(w, r, err)
+        }
         return
     }
     
@@ -53,31 +106,290 @@ func (app *application) render(w http.ResponseWriter, status int, page string, d
     // Write the contents of the buffer to the http.ResponseWriter.
     _, err = buf.WriteTo(w)
     if err != nil{
-        app.serverError(w, err)
+        app.serverError(w, r, err)
     }
 }
 
-// The serverError helper writes an error message and stack trace to the errorLog,
-// then sends a generic 500 Internal Server Error response to the user.
-func (app *application) serverError(w http.ResponseWriter, err error) {
-    trace := fmt.Sprintf("%s\n%s", err.Error(), debug.Stack())
+// statusClientClosedRequest is the status recorded for requests which the
+// client canceled before we could answer them. It isn't a real HTTP status,
+// but nginx uses it for the same thing, so dashboards know what it means.
+const statusClientClosedRequest = 499
+
+// The serverError helper logs the error and a stack trace, then sends a
+// generic 500 Internal Server Error response to the user. The log entry and
+// the response share the request ID, so a user reporting the error can tell
+// us which log entry to look at.
+//
+// Errors from a context are treated differently. If the database took
+// longer than the model's timeout we send a 503 Service Unavailable, as
+// trying again later may well work. If the client has gone away there is
+// nobody to send a response to, but we still set the status to 499, so that
+// logRequest and instrument don't count the request as a success.
+func (app *application) serverError(w http.ResponseWriter, r *http.Request, err error) {
+    requestID := requestIDFromContext(r.Context())
 
-    // report file name and line number one step back in the stack trace, else 
-    // it will show this files line number
-    app.errorLog.Output(2, trace) 
-    http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+    switch {
+    case errors.Is(err, context.Canceled) && r.Context().Err() != nil:
+        app.logger.Info("client canceled", "request_id", requestID, "error", err.Error())
+        w.WriteHeader(statusClientClosedRequest)
+        return
+    case errors.Is(err, context.DeadlineExceeded):
+        app.logger.Warn(err.Error(),
+            "request_id", requestID,
+            "method", r.Method,
+            "path", r.URL.RequestURI(),
+        )
+        w.Header().Set("Retry-After", "5")
+        app.errorResponse(w, r, http.StatusServiceUnavailable,
+            "The server is too busy to handle your request. Please try again shortly.", requestID)
+        return
+    }
+
+    app.logger.Error(err.Error(),
+        "request_id", requestID,
+        "method", r.Method,
+        "path", r.URL.RequestURI(),
+        "trace", string(debug.Stack()),
+    )
+    app.errorResponse(w, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError), requestID)
 }
 
 // The clientError helper sends a specific status code and corresponding description
 // to the user. We'll use this later in the book to send responses like 400 "Bad
 // Request" when there's a problem with the request that the user sent.
-func (app *application) clientError(w http.ResponseWriter, status int) {
-    http.Error(w, http.StatusText(status), status)
+func (app *application) clientError(w http.ResponseWriter, r *http.Request, status int) {
+    app.errorResponse(w, r, status, http.StatusText(status), "")
 }
 
 // For consistency, we'll also implement a notFound helper. This is simply a
 // convenience wrapper around clientError which sends a 404 Not Found response to
 // the user.
-func (app *application) notFound(w http.ResponseWriter) {
-    app.clientError(w, http.StatusNotFound)
+func (app *application) notFound(w http.ResponseWriter, r *http.Request) {
+    app.clientError(w, r, http.StatusNotFound)
+}
+
+// errorResponse sends an error to the user, see sendError.
+func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message string, requestID string) {
+    app.sendError(w, r, &errorData{
+        Status:    status,
+        Title:     http.StatusText(status),
+        Message:   message,
+        RequestID: requestID,
+    })
+}
+
+// sendError sends an error to the user. Clients which accept JSON get a
+// JSON object, everyone else gets the error.html page. If that page can't be
+// rendered (which is likely when the error came from the templates in the
+// first place) we fall back to a plain text response.
+func (app *application) sendError(w http.ResponseWriter, r *http.Request, e *errorData) {
+    if wantsJSON(r) {
+        body := map[string]any{
+            "error": e,
+        }
+        js, err := json.Marshal(body)
+        if err == nil {
+            w.Header().Set("Content-Type", "application/json")
+            w.WriteHeader(e.Status)
+            w.Write(js)
+            return
+        }
+        app.logger.Error(err.Error(), "request_id", requestIDFromContext(r.Context()))
+    }
+
+    // We can't use the render() helper here, as it calls serverError() when
+    // something goes wrong, which would bring us straight back here.
+    cache, _ := app.templates()
+    if ts, ok := cache["error.html"]; ok {
+        data := app.newTemplateData(r)
+        data.Error = e
+
+        buf := new(bytes.Buffer)
+        err := ts.ExecuteTemplate(buf, "base", data)
+        if err == nil {
+            w.Header().Set("Content-Type", "text/html; charset=utf-8")
+            w.WriteHeader(e.Status)
+            buf.WriteTo(w)
+            return
+        }
+        app.logger.Error(err.Error(), "request_id", requestIDFromContext(r.Context()))
+    }
+
+    message := e.Message
+    if e.RequestID != "" {
+        message = fmt.Sprintf("%s (request ID %s)", message, e.RequestID)
+    }
+    http.Error(w, message, e.Status)
+}
+
+// chunkTooLarge sends a 413 Content Too Large response for a chunk which is
+// bigger than we allow.
+func (app *application) chunkTooLarge(w http.ResponseWriter, r *http.Request) {
+    app.errorResponse(w, r, http.StatusRequestEntityTooLarge,
+        fmt.Sprintf("This chunk is too large. The files of a chunk can add up to at most %s.", humanBytes(app.maxChunkBytes)), "")
+}
+
+// owner returns who is making the request, for the quotas.
+func (app *application) owner(r *http.Request) models.Owner {
+    return models.Owner{UserID: userIDFromContext(r.Context()), IP: app.clientIP(r)}
+}
+
+// templateError is used in development mode to show a template error in the
+// browser. The errors from html/template name the template file and line,
+// like "template: view.html:12: function "foo" not defined", which is all we
+// need to find the problem. The page is written by hand, as the templates
+// themselves may be what's broken.
+func (app *application) templateError(w http.ResponseWriter, r *http.Request, err error) {
+    app.logger.Error(err.Error(), "request_id", requestIDFromContext(r.Context()))
+
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    w.WriteHeader(http.StatusInternalServerError)
+    fmt.Fprintf(w, "<!doctype html>\n<title>Template error</title>\n<h1>Template error</h1>\n<pre>%s</pre>\n",
+        template.HTMLEscapeString(err.Error()))
+}
+
+// writeJSON sends data as a JSON response with the given status code.
+func (app *application) writeJSON(w http.ResponseWriter, status int, data any) {
+    js, err := json.Marshal(data)
+    if err != nil {
+        app.logger.Error(err.Error())
+        w.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    w.Write(js)
+}
+
+// wantsJSON reports whether the client asked for a JSON response in its
+// Accept header. The API always speaks JSON.
+func wantsJSON(r *http.Request) bool {
+    return strings.HasPrefix(r.URL.Path, "/api/") ||
+        strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// newRequestID returns a random ID for a request which didn't come with one,
+// see the requestID middleware.
+func newRequestID() string {
+    b := make([]byte, 8)
+    _, err := rand.Read(b)
+    if err != nil {
+        // crypto/rand never fails on the platforms we run on, but a
+        // request without an ID is better than no response at all.
+        return ""
+    }
+    return hex.EncodeToString(b)
+}
+
+// parseLineRange parses the value of the lines query string parameter, which
+// is either a single line like "40" or an inclusive range like "40-55". Line
+// numbers start at 1.
+func parseLineRange(s string) (start, end int, err error) {
+    first, last, isRange := strings.Cut(s, "-")
+    start, err = strconv.Atoi(first)
+    if err != nil {
+        return 0, 0, err
+    }
+    end = start
+    if isRange {
+        end, err = strconv.Atoi(last)
+        if err != nil {
+            return 0, 0, err
+        }
+    }
+    if start < 1 || end < start {
+        return 0, 0, errors.New("invalid line range")
+    }
+    return start, end, nil
+}
+
+// extractLines returns lines start to end of the content. If the range runs
+// past the last line it is cut short, but if it starts past the last line
+// there is nothing to return and ok is false.
+func extractLines(content string, start, end int) (lines string, ok bool) {
+    all := strings.SplitAfter(content, "\n")
+    // A trailing newline leaves an empty string at the end of the slice,
+    // which isn't a line.
+    if all[len(all)-1] == "" {
+        all = all[:len(all)-1]
+    }
+    if start > len(all) {
+        return "", false
+    }
+    if end > len(all) {
+        end = len(all)
+    }
+    return strings.Join(all[start-1:end], ""), true
+}
+
+// validFileName reports whether the name can be used for a file of a chunk.
+// The name becomes the name of an entry in the zip and tar archives, so it
+// must not be able to climb out of the archive directory or smuggle in
+// control characters: no slashes, no "." or "..", and no NUL or other
+// control characters.
+func validFileName(name string) bool {
+    if strings.TrimSpace(name) == "" || name == "." || name == ".." {
+        return false
+    }
+    if strings.ContainsAny(name, `/\`) {
+        return false
+    }
+    for _, r := range name {
+        if unicode.IsControl(r) {
+            return false
+        }
+    }
+    return true
+}
+
+// archiveDir is the directory the files of a chunk are put in when it is
+// downloaded, so that unpacking the archive doesn't scatter them about.
+func archiveDir(chunk *models.Chunk) string {
+    return fmt.Sprintf("chunk-%s/", chunk.Slug)
+}
+
+// writeZip writes the files of the chunk to w as a zip archive.
+func writeZip(w io.Writer, chunk *models.Chunk) error {
+    zw := zip.NewWriter(w)
+    for _, f := range chunk.Files {
+        fw, err := zw.CreateHeader(&zip.FileHeader{
+            Name:     archiveDir(chunk) + f.Name,
+            Method:   zip.Deflate,
+            Modified: chunk.Created,
+        })
+        if err != nil {
+            return err
+        }
+        _, err = io.WriteString(fw, f.Content)
+        if err != nil {
+            return err
+        }
+    }
+    return zw.Close()
+}
+
+// writeTarGz writes the files of the chunk to w as a gzipped tar archive.
+func writeTarGz(w io.Writer, chunk *models.Chunk) error {
+    gw := gzip.NewWriter(w)
+    tw := tar.NewWriter(gw)
+    for _, f := range chunk.Files {
+        err := tw.WriteHeader(&tar.Header{
+            Name:    archiveDir(chunk) + f.Name,
+            Mode:    0644,
+            Size:    int64(len(f.Content)),
+            ModTime: chunk.Created,
+        })
+        if err != nil {
+            return err
+        }
+        _, err = io.WriteString(tw, f.Content)
+        if err != nil {
+            return err
+        }
+    }
+    err := tw.Close()
+    if err != nil {
+        return err
+    }
+    return gw.Close()
 }
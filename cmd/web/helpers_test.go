@@ -0,0 +1,185 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/testutil"
+
+    "github.com/cpucortexm/chunkbox/internal/assert"
+)
+
+func TestParseLineRange(t *testing.T) {
+    tests := []struct {
+        name      string
+        s         string
+        wantStart int
+        wantEnd   int
+        wantErr   bool
+    }{
+        {name: "Single line", s: "5", wantStart: 5, wantEnd: 5},
+        {name: "Range", s: "40-55", wantStart: 40, wantEnd: 55},
+        {name: "One line range", s: "3-3", wantStart: 3, wantEnd: 3},
+        {name: "Line zero", s: "0", wantErr: true},
+        {name: "Negative", s: "-1", wantErr: true},
+        {name: "Backwards", s: "5-3", wantErr: true},
+        {name: "Open ended", s: "3-", wantErr: true},
+        {name: "Open start", s: "-3", wantErr: true},
+        {name: "Empty", s: "", wantErr: true},
+        {name: "Not a number", s: "a-b", wantErr: true},
+        {name: "Three parts", s: "1-2-3", wantErr: true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            start, end, err := parseLineRange(tt.s)
+            assert.Equal(t, err != nil, tt.wantErr)
+            assert.Equal(t, start, tt.wantStart)
+            assert.Equal(t, end, tt.wantEnd)
+        })
+    }
+}
+
+func TestExtractLines(t *testing.T) {
+    tests := []struct {
+        name    string
+        content string
+        start   int
+        end     int
+        want    string
+        wantOK  bool
+    }{
+        {name: "Single line", content: "a\nb\nc\n", start: 2, end: 2, want: "b\n", wantOK: true},
+        {name: "Range", content: "a\nb\nc\n", start: 1, end: 2, want: "a\nb\n", wantOK: true},
+        {name: "Whole content", content: "a\nb\nc\n", start: 1, end: 3, want: "a\nb\nc\n", wantOK: true},
+        {name: "Past the end", content: "a\nb\nc\n", start: 2, end: 10, want: "b\nc\n", wantOK: true},
+        {name: "Starts past the end", content: "a\nb\nc\n", start: 4, end: 5, wantOK: false},
+        {name: "No trailing newline", content: "a\nb\nc", start: 3, end: 3, want: "c", wantOK: true},
+        {name: "No trailing newline past the end", content: "a\nb\nc", start: 2, end: 9, want: "b\nc", wantOK: true},
+        {name: "No trailing newline starts past the end", content: "a\nb\nc", start: 4, end: 4, wantOK: false},
+        {name: "Empty content", content: "", start: 1, end: 1, wantOK: false},
+        {name: "Only a newline", content: "\n", start: 1, end: 1, want: "\n", wantOK: true},
+        {name: "Blank lines", content: "a\n\n\nb\n", start: 2, end: 3, want: "\n\n", wantOK: true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            lines, ok := extractLines(tt.content, tt.start, tt.end)
+            assert.Equal(t, ok, tt.wantOK)
+            assert.Equal(t, lines, tt.want)
+        })
+    }
+}
+
+func TestValidFileName(t *testing.T) {
+    tests := []struct {
+        name     string
+        fileName string
+        want     bool
+    }{
+        {name: "Plain", fileName: "main.go", want: true},
+        {name: "No extension", fileName: "Dockerfile", want: true},
+        {name: "Dot file", fileName: ".gitignore", want: true},
+        {name: "Dots inside", fileName: "notes..txt", want: true},
+        {name: "Spaces inside", fileName: "setup notes.md", want: true},
+        {name: "Unicode", fileName: "résumé.md", want: true},
+        {name: "Empty", fileName: "", want: false},
+        {name: "Only spaces", fileName: "   ", want: false},
+        {name: "Dot", fileName: ".", want: false},
+        {name: "Dot dot", fileName: "..", want: false},
+        {name: "Slash", fileName: "../etc/passwd", want: false},
+        {name: "Backslash", fileName: `..\boot.ini`, want: false},
+        {name: "NUL", fileName: "main.go\x00.txt", want: false},
+        {name: "Newline", fileName: "main\n.go", want: false},
+        {name: "Tab", fileName: "main\t.go", want: false},
+        {name: "Escape", fileName: "\x1b[31mred.txt", want: false},
+        {name: "Delete", fileName: "main\x7f.go", want: false},
+        {name: "C1 control", fileName: "main\u0085.go", want: false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            assert.Equal(t, validFileName(tt.fileName), tt.want)
+        })
+    }
+}
+
+func TestServerError(t *testing.T) {
+    app := newTestApplication(t)
+
+    rr := httptest.NewRecorder()
+    r := httptest.NewRequest(http.MethodGet, "/", nil)
+    app.serverError(rr, r, errors.New("something broke"))
+
+    assert.Equal(t, rr.Code, http.StatusInternalServerError)
+    assert.Equal(t, rr.Header().Get("Retry-After"), "")
+}
+
+func TestServerErrorDeadlineExceeded(t *testing.T) {
+    tests := []struct {
+        name        string
+        accept      string
+        wantType    string
+        wantMessage string
+    }{
+        {
+            name:        "HTML",
+            wantType:    "text/html; charset=utf-8",
+            wantMessage: "The server is too busy to handle your request.",
+        },
+        {
+            name:        "JSON",
+            accept:      "application/json",
+            wantType:    "application/json",
+            wantMessage: `"status":503`,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            app := newTestApplication(t)
+
+            rr := httptest.NewRecorder()
+            r := httptest.NewRequest(http.MethodGet, "/", nil)
+            r.Header.Set("Accept", tt.accept)
+            // The model wraps the error from the database driver.
+            app.serverError(rr, r, fmt.Errorf("models: %w", context.DeadlineExceeded))
+
+            assert.Equal(t, rr.Code, http.StatusServiceUnavailable)
+            assert.Equal(t, rr.Header().Get("Retry-After"), "5")
+            assert.Equal(t, rr.Header().Get("Content-Type"), tt.wantType)
+            assert.StringContains(t, rr.Body.String(), tt.wantMessage)
+        })
+    }
+}
+
+func TestServerErrorClientCanceled(t *testing.T) {
+    app := newTestApplication(t)
+    var logs bytes.Buffer
+    app.logger = slog.New(slog.NewTextHandler(&logs, nil))
+
+    ctx, cancel := context.WithCancel(context.Background())
+    handler := app.logRequest(app.instrument("/test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        cancel()
+        app.serverError(w, r, fmt.Errorf("models: %w", r.Context().Err()))
+    })))
+
+    rr := httptest.NewRecorder()
+    r := httptest.NewRequest(http.MethodGet, "/test", nil).WithContext(ctx)
+    handler.ServeHTTP(rr, r)
+
+    // Nobody reads the response, but the log and the metrics must not
+    // count the request as a success.
+    assert.Equal(t, rr.Body.Len(), 0)
+    assert.StringContains(t, logs.String(), "client canceled")
+    assert.StringContains(t, logs.String(), "status=499")
+    labels := prometheus.Labels{"route": "/test", "method": http.MethodGet, "status": "499"}
+    assert.Equal(t, testutil.ToFloat64(app.metrics.requests.With(labels)), 1.0)
+}
@@ -10,24 +10,59 @@
 package main
 
 import (
+    "context"
     "database/sql"
-    "log"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net"
     "net/http"
     "flag"
     "html/template"
+    "io/fs"
     "os"
+    "os/signal"
+    "slices"
+    "strings"
+    "sync/atomic"
+    "syscall"
+    "time"
+    "github.com/cpucortexm/chunkbox/internal/highlight"
     // Import the models package from internal/models.
     "github.com/cpucortexm/chunkbox/internal/models"
-    _ "github.com/go-sql-driver/mysql" //we need the driver’s init() function to run so that it can register itself with the database/sql package.
+    "github.com/cpucortexm/chunkbox/ui"
+    "github.com/alexedwards/scs/mysqlstore"
+    "github.com/alexedwards/scs/v2"
+    // We need the driver's init() function to run so that it can register
+    // itself with the database/sql package, and we use its error type.
+    "github.com/go-sql-driver/mysql"
 )
 
 // Define an application struct to hold the application-wide dependencies for the
-// web application. For now we'll only include fields for the two custom loggers.
+// web application.
 type application struct {
-    errorLog *log.Logger
-    infoLog  *log.Logger
+    logger   *slog.Logger
     chunks   *models.ChunkModel
+    users    models.UserModelInterface
+    tokens   *models.TokenModel
+    workspaces *models.WorkspaceModel
+    sessionManager *scs.SessionManager
+    sso *ssoProvider // nil when single sign-on is off
     templateCache map[string]*template.Template
+    highlightCSS []byte
+    uiFS fs.FS // templates and static files
+    dev bool // development mode, see the -dev flag
+    features features
+    maxChunkBytes int64 // the most the files of a chunk can add up to
+    // readLimiter and writeLimiter are nil when rate limiting is off.
+    readLimiter  *rateLimiter
+    writeLimiter *rateLimiter
+    trustedProxies []*net.IPNet
+    metrics *metrics
+    migrations *models.MigrationModel
+    // shuttingDown is set once graceful shutdown has begun, which fails
+    // the readiness probe.
+    shuttingDown atomic.Bool
 }
 
 // We dont use DefaultServeMux because it is a global variable, 
@@ -41,90 +76,344 @@ type application struct {
 // here is a local one, unlike the DefaultServeMux
 
 func main() {
-    // Define a new command-line flag with the name 'addr', a default value of ":3001"
-    // and some short help text explaining what the flag controls. The value of the
-    // flag will be stored in the addr variable at runtime.
-    addr := flag.String("addr", ":3001", "HTTP network address")
-    // Define a new command-line flag for the MySQL DSN string.
-    dsn := flag.String("dsn", "web:pass@/chunkbox?parseTime=true", "MySQL data source name")
-    // Importantly, we use the flag.Parse() function to parse the command-line flag.
-    // This reads in the command-line flag value and assigns it to the addr
-    // variable. You need to call this *before* you use the addr variable
-    // otherwise it will always contain the default value of ":3001". If any errors are
-    // encountered during parsing the application will be terminated.
-    flag.Parse()
-    // Use log.New() to create a logger for writing information messages. This takes
-    // three parameters: the destination to write the logs to (os.Stdout), a string
-    // prefix for message (INFO followed by a tab), and flags to indicate what
-    // additional information to include (local date and time). Note that the flags
-    // are joined using the bitwise OR operator |.
-
-    infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
-
-    // Create a logger for writing error messages in the same way, but use stderr as
-    // the destination and use the log.Lshortfile flag to include the relevant
-    // file name and line number.
-    errorLog := log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
-
-    // We pass openDB() the DSN from the command-line flag.
-    db, err := openDB(*dsn)
+    // "chunkbox config print" shows the settings the server would run with,
+    // instead of running it. "chunkbox user set-role EMAIL ROLE" changes the
+    // role of a user, which is how the first admin gets made. The flags are
+    // the same either way.
+    args := os.Args[1:]
+    printConfig := false
+    var setRoleEmail, setRole string
+    if len(args) > 0 && args[0] == "config" {
+        if len(args) < 2 || args[1] != "print" {
+            fmt.Fprintln(os.Stderr, "usage: chunkbox config print [flags]")
+            os.Exit(2)
+        }
+        printConfig = true
+        args = args[2:]
+    } else if len(args) > 0 && args[0] == "user" {
+        if len(args) < 4 || args[1] != "set-role" || !slices.Contains(models.Roles, args[3]) {
+            fmt.Fprintf(os.Stderr, "usage: chunkbox user set-role EMAIL %s [flags]\n", strings.Join(models.Roles, "|"))
+            os.Exit(2)
+        }
+        setRoleEmail, setRole = args[2], args[3]
+        args = args[4:]
+    }
+
+    // Work out the settings from the defaults, the config file, the
+    // environment and the flags. See config.go.
+    cfg, err := loadConfig("chunkbox", args, os.Stderr)
     if err != nil {
-        errorLog.Fatal(err)
+        if errors.Is(err, flag.ErrHelp) {
+            os.Exit(0)
+        }
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(2)
+    }
+    if printConfig {
+        err = cfg.print(os.Stdout)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+        return
+    }
+
+    // Create a structured logger which writes to stdout. Every entry has a
+    // level and a message, plus key/value attributes like the request ID,
+    // so the logs can be parsed by machines as well as read by people.
+    logger, err := newLogger(cfg.Log.Format, cfg.Log.Level)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        os.Exit(2)
+    }
+
+    // We pass openDB() the DSN from the config, with the password added.
+    dsn, err := cfg.dsn()
+    if err != nil {
+        logger.Error(err.Error())
+        os.Exit(1)
+    }
+    db, err := openDB(dsn, cfg, logger)
+    if err != nil {
+        logger.Error(err.Error())
+        os.Exit(1)
     }
     // We also defer a call to db.Close(), so that the connection pool is closed
     // before the main() or program exits. It actually will never run
-    // in this scenario because of errorLog.Fatal() which terminates
+    // in this scenario because of os.Exit() which terminates
     // the program immediately.
     defer db.Close()
+
+    migrations := &models.MigrationModel{DB: db}
+    if cfg.DB.Migrate {
+        applied, err := migrations.Migrate(context.Background())
+        for _, name := range applied {
+            logger.Info("applied migration", "migration", name)
+        }
+        if err != nil {
+            logger.Error(err.Error())
+            os.Exit(1)
+        }
+    }
+
+    if setRoleEmail != "" {
+        users := &models.UserModel{DB: db, Timeout: cfg.DB.QueryTimeout}
+        err = users.SetRoleByEmail(context.Background(), setRoleEmail, setRole)
+        if err != nil {
+            if errors.Is(err, models.ErrNoRecord) {
+                err = fmt.Errorf("no user with the email address %s", setRoleEmail)
+            }
+            logger.Error(err.Error())
+            os.Exit(1)
+        }
+        logger.Info("changed user role", "email", setRoleEmail, "role", setRole)
+        return
+    }
     
-    // Initialize a new template cache...
-    templateCache, err := newTemplateCache()
+    // Pick the file system holding the templates and static files: the
+    // embedded copy, or a directory on disk (which development mode needs).
+    var uiFS fs.FS = ui.Files
+    if cfg.UI.Dir != "" {
+        uiFS = os.DirFS(cfg.UI.Dir)
+    }
+
+    // Initialize a new template cache... In development mode the templates
+    // are parsed again on every request, but parsing them once here still
+    // catches mistakes early.
+    templateCache, err := newTemplateCache(uiFS)
+    if err != nil {
+        logger.Error(err.Error())
+        os.Exit(1)
+    }
+
+    // Generate the stylesheet for highlighted chunks from the chosen theme.
+    // An unknown theme is a configuration mistake, so fail early.
+    highlightCSS, err := highlight.Stylesheet(cfg.UI.Theme)
     if err != nil {
-        errorLog.Fatal(err)
+        logger.Error(err.Error())
+        os.Exit(1)
     }
     // Initialize a new instance of our application struct, containing the
     // dependencies.
+    chunks := &models.ChunkModel{
+        DB:         db,
+        SlugLength: cfg.SlugLength,
+        Timeout:    cfg.DB.QueryTimeout,
+        IPQuota:    cfg.Limits.IPQuota.quota(),
+        UserQuota:  cfg.Limits.UserQuota.quota(),
+    }
+    // Use the scs.New() function to initialize a new session manager. Then we
+    // configure it to use our MySQL database as the session store, and set a
+    // lifetime of 12 hours (so that sessions automatically expire 12 hours
+    // after first being created). The cookie is only sent over HTTPS when
+    // we are serving HTTPS.
+    sessionManager := scs.New()
+    sessionManager.Store = mysqlstore.New(db)
+    sessionManager.Lifetime = 12 * time.Hour
+    sessionManager.Cookie.Secure = cfg.useTLS()
+
     app := &application{
-        errorLog: errorLog,
-        infoLog:  infoLog,
-        chunks: &models.ChunkModel{DB:db},
+        logger:   logger,
+        chunks: chunks,
+        users: &models.UserModel{DB: db, Timeout: cfg.DB.QueryTimeout},
+        tokens: &models.TokenModel{DB: db, Timeout: cfg.DB.QueryTimeout},
+        workspaces: &models.WorkspaceModel{DB: db, Timeout: cfg.DB.QueryTimeout},
+        sessionManager: sessionManager,
         templateCache: templateCache,
+        highlightCSS: highlightCSS,
+        uiFS: uiFS,
+        dev: cfg.UI.Dev,
+        features: cfg.Features,
+        maxChunkBytes: cfg.Limits.MaxChunkBytes,
+        metrics: newMetrics(db, chunks, logger),
+        migrations: migrations,
+    }
+    // The HTTP client for the single sign-on provider is our own, so that
+    // requests to a slow provider time out.
+    if cfg.OIDC.Issuer != "" {
+        app.sso = newSSOProvider(cfg, &http.Client{Timeout: cfg.OIDC.Timeout})
     }
+    if cfg.RateLimit.Enabled {
+        app.readLimiter = newRateLimiter(cfg.RateLimit.ReadRate, cfg.RateLimit.ReadBurst)
+        app.writeLimiter = newRateLimiter(cfg.RateLimit.WriteRate, cfg.RateLimit.WriteBurst)
+    }
+    // The trusted proxies were checked along with the rest of the config.
+    app.trustedProxies, _ = parseCIDRs(cfg.RateLimit.TrustedProxies)
     // Initialize a new http.Server struct. We set the Addr and Handler fields so
-    // that the server uses the same network address and routes as before, and set
-    // the ErrorLog field so that the server now uses the custom errorLog logger in
-    // the event of any problems.
+    // that the server uses the same network address and routes as before. The
+    // server only knows how to log to a *log.Logger, so the ErrorLog field gets
+    // one which passes its messages on to our structured logger at error level.
     srv := &http.Server{
-        Addr:     *addr,
-        ErrorLog: errorLog,
+        Addr:     cfg.Addr,
+        ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelError),
         // call the new app.routes() method to get the servemux containing our routes.
         Handler:  app.routes(),
     }
+    cfg.applyServerLimits(srv)
+
+    // Start the servers in the background, so that main() can wait for a
+    // signal to shut them down. If any of them fails to start there is no
+    // point carrying on: without the admin listener we would be running
+    // blind, for example.
+    servers := []*http.Server{srv}
+    serverErr := make(chan error, 3)
+
+    if cfg.useTLS() {
+        certs, err := newCertReloader(cfg.TLS.Cert, cfg.TLS.Key)
+        if err != nil {
+            logger.Error(err.Error())
+            os.Exit(1)
+        }
+        certs.reloadOnSIGHUP(logger)
+        srv.TLSConfig = newTLSConfig(certs)
 
-    // The value returned from the flag.String() function is a pointer to the flag
-    // value, not the value itself. So we need to dereference the pointer (i.e.
-    // prefix it with the * symbol) before using it. Note that we're using the
-    // log.Printf() function to interpolate the address with the log message.
-    infoLog.Printf("Starting server on %s", *addr)
+        logger.Info("starting server", "addr", cfg.Addr, "tls", true)
+        go func() {
+            // The certificate comes from the TLSConfig, so no files are
+            // passed here.
+            serverErr <- srv.ListenAndServeTLS("", "")
+        }()
 
-    // Instead of the default http.ListenAndServe(), we will use the newly created
-    // http server struct. Call the ListenAndServe() method on our new http.Server struct. 
-    // err is already declared above.
-    err = srv.ListenAndServe()
-    errorLog.Fatal(err)
+        if cfg.TLS.RedirectAddr != "" {
+            redirectSrv := &http.Server{
+                Addr:     cfg.TLS.RedirectAddr,
+                ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelError),
+                Handler:  redirectToHTTPS(cfg.Addr),
+            }
+            cfg.applyServerLimits(redirectSrv)
+            servers = append(servers, redirectSrv)
+            logger.Info("starting redirect server", "addr", cfg.TLS.RedirectAddr)
+            go func() {
+                serverErr <- redirectSrv.ListenAndServe()
+            }()
+        }
+    } else {
+        logger.Info("starting server", "addr", cfg.Addr, "tls", false)
+        go func() {
+            serverErr <- srv.ListenAndServe()
+        }()
+    }
+
+    if cfg.AdminAddr != "" {
+        adminSrv := &http.Server{
+            Addr:     cfg.AdminAddr,
+            ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelError),
+            Handler:  app.adminRoutes(),
+        }
+        cfg.applyServerLimits(adminSrv)
+        servers = append(servers, adminSrv)
+        logger.Info("starting admin server", "addr", cfg.AdminAddr)
+        go func() {
+            serverErr <- adminSrv.ListenAndServe()
+        }()
+    }
+
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+
+    select {
+    case err = <-serverErr:
+        logger.Error(err.Error())
+        os.Exit(1)
+    case <-ctx.Done():
+    }
+    // A second signal kills the process straight away.
+    stop()
+
+    logger.Info("shutting down", "delay", cfg.Shutdown.Delay)
+    app.shuttingDown.Store(true)
+    time.Sleep(cfg.Shutdown.Delay)
+
+    ctx, cancel := context.WithTimeout(context.Background(), cfg.Shutdown.Timeout)
+    defer cancel()
+    err = nil
+    for _, server := range servers {
+        err = errors.Join(err, server.Shutdown(ctx))
+    }
+    app.readLimiter.stop()
+    app.writeLimiter.stop()
+    if err != nil {
+        logger.Error(err.Error())
+        os.Exit(1)
+    }
+    logger.Info("stopped server")
+}
+
+// newLogger returns a logger which writes entries of at least the given
+// level to stdout, either as text (key=value pairs) or as JSON objects.
+func newLogger(format string, level string) (*slog.Logger, error) {
+    var lvl slog.Level
+    err := lvl.UnmarshalText([]byte(level))
+    if err != nil {
+        return nil, fmt.Errorf("invalid log level %q", level)
+    }
+    opts := &slog.HandlerOptions{Level: lvl}
+
+    switch format {
+    case "text":
+        return slog.New(slog.NewTextHandler(os.Stdout, opts)), nil
+    case "json":
+        return slog.New(slog.NewJSONHandler(os.Stdout, opts)), nil
+    default:
+        return nil, fmt.Errorf("invalid log format %q", format)
+    }
 }
 
 
 // The openDB() function wraps sql.Open() and returns a sql.DB connection pool
-// for a given DSN.
-func openDB(dsn string) (*sql.DB, error) {
+// for a given DSN, set up according to the config.
+func openDB(dsn string, cfg *config, logger *slog.Logger) (*sql.DB, error) {
     db, err := sql.Open("mysql", dsn)
     if err != nil {
         return nil, err
     }
-    //create a connection and check for any errors.
-    if err = db.Ping(); err != nil {
+    db.SetMaxOpenConns(cfg.DB.MaxOpenConns)
+    db.SetMaxIdleConns(cfg.DB.MaxIdleConns)
+    // Recycling connections now and then spreads them over the database
+    // servers behind a load balancer, and stops them being cut off by
+    // timeouts on the MySQL side.
+    db.SetConnMaxLifetime(cfg.DB.ConnMaxLifetime)
+    db.SetConnMaxIdleTime(cfg.DB.ConnMaxIdleTime)
+
+    // Create a connection and check for any errors. The database may still
+    // be starting up, as often happens when everything is started at once,
+    // so keep trying until the connect timeout has passed.
+    err = pingWithBackoff(db, cfg.DB.ConnectTimeout, logger)
+    if err != nil {
+        db.Close()
         return nil, err
     }
     return db, nil
 }
+
+// pingWithBackoff pings the database until it answers or the timeout has
+// passed, waiting twice as long after each failure (up to a limit). Errors
+// which trying again won't fix, like a wrong password, are returned
+// straight away.
+func pingWithBackoff(db *sql.DB, timeout time.Duration, logger *slog.Logger) error {
+    const maxWait = 10 * time.Second
+    deadline := time.Now().Add(timeout)
+    wait := 500 * time.Millisecond
+
+    for {
+        ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        err := db.PingContext(ctx)
+        cancel()
+        if err == nil {
+            return nil
+        }
+
+        // The server answering with an error, rather than not answering
+        // at all, means it is up.
+        var mySQLError *mysql.MySQLError
+        if errors.As(err, &mySQLError) || !time.Now().Before(deadline) {
+            return err
+        }
+
+        // The last attempt is made right at the deadline.
+        wait = min(wait, time.Until(deadline))
+        logger.Warn("database not available, retrying", "error", err.Error(), "wait", wait)
+        time.Sleep(wait)
+        wait = min(wait*2, maxWait)
+    }
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/cpucortexm/chunkbox/internal/models"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/collectors"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the Prometheus metrics of the application. They are kept in
+// their own registry rather than the global default one, for the same
+// reason we don't use http.DefaultServeMux.
+type metrics struct {
+    registry      *prometheus.Registry
+    requests      *prometheus.CounterVec
+    duration      *prometheus.HistogramVec
+    panics        prometheus.Counter
+    chunksCreated prometheus.Counter
+    rateLimited   *prometheus.CounterVec
+}
+
+// newMetrics creates and registers the metrics of the application, along
+// with the standard Go runtime, process and sql.DB pool metrics.
+func newMetrics(db *sql.DB, chunks *models.ChunkModel, logger *slog.Logger) *metrics {
+    m := &metrics{
+        registry: prometheus.NewRegistry(),
+        requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Name: "chunkbox_http_requests_total",
+            Help: "Number of HTTP requests handled, by route, method and status.",
+        }, []string{"route", "method", "status"}),
+        duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+            Name:    "chunkbox_http_request_duration_seconds",
+            Help:    "Time taken to handle HTTP requests, by route, method and status.",
+            Buckets: prometheus.DefBuckets,
+        }, []string{"route", "method", "status"}),
+        panics: prometheus.NewCounter(prometheus.CounterOpts{
+            Name: "chunkbox_panics_total",
+            Help: "Number of panics recovered while handling requests.",
+        }),
+        chunksCreated: prometheus.NewCounter(prometheus.CounterOpts{
+            Name: "chunkbox_chunks_created_total",
+            Help: "Number of chunks created.",
+        }),
+        rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Name: "chunkbox_rate_limited_total",
+            Help: "Number of requests turned away by the rate limiter, by kind (read or write).",
+        }, []string{"kind"}),
+    }
+
+    m.registry.MustRegister(
+        m.requests,
+        m.duration,
+        m.panics,
+        m.chunksCreated,
+        m.rateLimited,
+        &chunkCollector{chunks: chunks, logger: logger},
+        collectors.NewDBStatsCollector(db, "chunkbox"),
+        collectors.NewGoCollector(),
+        collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+    )
+    return m
+}
+
+// handler returns the handler for the /metrics endpoint. If a collector
+// fails, like the chunk counts when the database is down, the other metrics
+// are still served.
+func (m *metrics) handler() http.Handler {
+    return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{
+        ErrorHandling: promhttp.ContinueOnError,
+    })
+}
+
+// instrument wraps the handler for a route to count its requests and time
+// them. The route is the pattern the handler was registered with, like
+// /c/:slug, rather than the path of the request, so that every chunk
+// doesn't get metrics of its own.
+func (app *application) instrument(route string, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        sr := &statusRecorder{ResponseWriter: w}
+
+        // The observation is deferred so that requests which panic are
+        // counted too. recoverPanic turns those into a 500 response.
+        completed := false
+        defer func() {
+            status := sr.status
+            if !completed {
+                status = http.StatusInternalServerError
+            } else if status == 0 {
+                status = http.StatusOK
+            }
+            labels := prometheus.Labels{
+                "route":  route,
+                "method": r.Method,
+                "status": strconv.Itoa(status),
+            }
+            app.metrics.requests.With(labels).Inc()
+            app.metrics.duration.With(labels).Observe(time.Since(start).Seconds())
+        }()
+
+        next.ServeHTTP(sr, r)
+        completed = true
+    })
+}
+
+// chunkCollector reports the number of live and expired chunks. The counts
+// come from the database each time the metrics are scraped, so they are
+// right even when several instances share the database.
+type chunkCollector struct {
+    chunks *models.ChunkModel
+    logger *slog.Logger
+}
+
+var chunksDesc = prometheus.NewDesc(
+    "chunkbox_chunks",
+    "Number of chunks in the database, by state (live or expired).",
+    []string{"state"}, nil,
+)
+
+func (c *chunkCollector) Describe(ch chan<- *prometheus.Desc) {
+    ch <- chunksDesc
+}
+
+func (c *chunkCollector) Collect(ch chan<- prometheus.Metric) {
+    // The scrape doesn't give us a context, so the model's own timeout is
+    // all that stops a slow database from holding it up.
+    live, expired, err := c.chunks.Counts(context.Background())
+    if err != nil {
+        c.logger.Error(err.Error())
+        ch <- prometheus.NewInvalidMetric(chunksDesc, err)
+        return
+    }
+    ch <- prometheus.MustNewConstMetric(chunksDesc, prometheus.GaugeValue, float64(live), "live")
+    ch <- prometheus.MustNewConstMetric(chunksDesc, prometheus.GaugeValue, float64(expired), "expired")
+}
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/cpucortexm/chunkbox/internal/models"
+	"github.com/justinas/nosurf"
 )
 
 func secureHeaders(next http.Handler) http.Handler {
@@ -15,16 +23,93 @@ func secureHeaders(next http.Handler) http.Handler {
         w.Header().Set("X-Frame-Options", "deny")
         w.Header().Set("X-XSS-Protection", "0")
 
+        // Tell browsers to only ever use HTTPS for this site from now on.
+        // This only makes sense when we are serving HTTPS, as browsers
+        // ignore the header on plain HTTP responses anyway.
+        if r.TLS != nil {
+            w.Header().Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+        }
+
         next.ServeHTTP(w, r)
     })
 }
 
-// log IP address of the user, and which URL and method are being requested
+// requestIDRX limits the request IDs we accept from the X-Request-ID header,
+// as they end up in our logs and response headers.
+var requestIDRX = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// requestID gives every request an ID, which is stored in the request
+// context and sent back in the X-Request-ID header. If a proxy in front of
+// us already set X-Request-ID we keep its ID, so that its logs and ours can
+// be matched up.
+func requestID(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get("X-Request-ID")
+        if !requestIDRX.MatchString(id) {
+            id = newRequestID()
+        }
+        w.Header().Set("X-Request-ID", id)
+
+        ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+        next.ServeHTTP(w, r.WithContext(ctx))
+    })
+}
+
+// statusRecorder wraps a http.ResponseWriter to remember the status code and
+// the number of bytes written, which logRequest needs once the handler has
+// returned.
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+    bytes  int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+    if sr.status == 0 {
+        sr.status = status
+    }
+    sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+    // Like the real ResponseWriter, a Write() without a WriteHeader() means
+    // 200 OK.
+    if sr.status == 0 {
+        sr.status = http.StatusOK
+    }
+    n, err := sr.ResponseWriter.Write(b)
+    sr.bytes += n
+    return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+    return sr.ResponseWriter
+}
+
+// logRequest logs each request once it has been handled, so that the log
+// entry can include the response status, its size and how long it took.
 func (app *application) logRequest(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        app.infoLog.Printf("%s - %s %s %s", r.RemoteAddr, r.Proto, r.Method, r.URL.RequestURI())
+        start := time.Now()
+        sr := &statusRecorder{ResponseWriter: w}
 
-        next.ServeHTTP(w, r)
+        next.ServeHTTP(sr, r)
+
+        // A handler which writes nothing at all still sends 200 OK.
+        if sr.status == 0 {
+            sr.status = http.StatusOK
+        }
+        app.logger.Info("request",
+            "request_id", requestIDFromContext(r.Context()),
+            "remote_addr", r.RemoteAddr,
+            "proto", r.Proto,
+            "method", r.Method,
+            "path", r.URL.RequestURI(),
+            "status", sr.status,
+            "bytes", sr.bytes,
+            "duration", time.Since(start),
+        )
     })
 }
 
@@ -36,14 +121,153 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
             // Use the builtin recover function to check if there has been a
             // panic or not. If there has...
             if err := recover(); err != nil {
+                // Count the panic in the metrics.
+                app.metrics.panics.Inc()
                 // Set a "Connection: close" header on the response.
                 w.Header().Set("Connection", "close")
                 // Call the app.serverError helper method to return a 500
                 // Internal Server response.
-                app.serverError(w, fmt.Errorf("%s", err))
+                app.serverError(w, r, fmt.Errorf("%s", err))
             }
         }()
 
         next.ServeHTTP(w, r)
     })
 }
+
+// loadAndSave loads the session of the request and saves any changes to it
+// afterwards, see scs. Only the routes for people using a browser have a
+// session, and scs panics when asked about a session it didn't load, so we
+// also note in the request context that there is one.
+func (app *application) loadAndSave(next http.Handler) http.Handler {
+    return app.sessionManager.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ctx := context.WithValue(r.Context(), sessionContextKey, true)
+        next.ServeHTTP(w, r.WithContext(ctx))
+    }))
+}
+
+// hasSession reports whether the request has a session.
+func hasSession(r *http.Request) bool {
+    ok, _ := r.Context().Value(sessionContextKey).(bool)
+    return ok
+}
+
+// noSurf protects the routes with a session against cross-site request
+// forgery. Every POST request has to carry the token from the CSRF cookie
+// in its csrf_token field, which a page on another site can't know.
+func (app *application) noSurf(next http.Handler) http.Handler {
+    csrfHandler := nosurf.New(next)
+    csrfHandler.SetBaseCookie(http.Cookie{
+        HttpOnly: true,
+        Path:     "/",
+        Secure:   app.sessionManager.Cookie.Secure,
+    })
+    csrfHandler.SetFailureHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        app.errorResponse(w, r, http.StatusBadRequest,
+            "Your form has expired or didn't come from this site. Please go back, reload the page and try again.", "")
+    }))
+    return csrfHandler
+}
+
+// authenticate checks whether the session belongs to a logged in user, and
+// if so stores their ID and role in the request context. A user who has
+// been deleted or disabled since logging in is treated as logged out.
+func (app *application) authenticate(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id := app.sessionManager.GetInt(r.Context(), "authenticatedUserID")
+        if id == 0 {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        user, err := app.users.Get(r.Context(), id)
+        if err != nil && !errors.Is(err, models.ErrNoRecord) {
+            app.serverError(w, r, err)
+            return
+        }
+        if err == nil && !user.Disabled {
+            ctx := context.WithValue(r.Context(), userIDContextKey, user.ID)
+            ctx = context.WithValue(ctx, roleContextKey, user.Role)
+            r = r.WithContext(ctx)
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// requireAuthentication sends people who aren't logged in to the login
+// page. The pages behind it aren't stored in caches, as they are different
+// for every user.
+func (app *application) requireAuthentication(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if userIDFromContext(r.Context()) == 0 {
+            http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+            return
+        }
+        w.Header().Add("Cache-Control", "no-store")
+        next.ServeHTTP(w, r)
+    })
+}
+
+// requireRole only lets users with the role (or a more powerful one)
+// through. It goes after requireAuthentication, so everyone who gets here
+// is logged in; the others get a 403 Forbidden.
+func (app *application) requireRole(role string) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if !models.RoleAllows(roleFromContext(r.Context()), role) {
+                app.clientError(w, r, http.StatusForbidden)
+                return
+            }
+            next.ServeHTTP(w, r)
+        })
+    }
+}
+
+// authenticateToken checks the API token in the Authorization header, like
+// "Authorization: Bearer cbx_...", and stores the token and its user in the
+// request context. Every API request needs a valid token; the response to
+// one without says why in a WWW-Authenticate header (RFC 6750).
+func (app *application) authenticateToken(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Add("Vary", "Authorization")
+
+        scheme, plaintext, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+        if !strings.EqualFold(scheme, "Bearer") || plaintext == "" {
+            w.Header().Set("WWW-Authenticate", `Bearer realm="chunkbox"`)
+            app.errorResponse(w, r, http.StatusUnauthorized, "This request needs an API token.", "")
+            return
+        }
+
+        token, err := app.tokens.Authenticate(r.Context(), strings.TrimSpace(plaintext))
+        if err != nil {
+            if errors.Is(err, models.ErrInvalidCredentials) {
+                w.Header().Set("WWW-Authenticate", `Bearer realm="chunkbox", error="invalid_token"`)
+                app.errorResponse(w, r, http.StatusUnauthorized, "The API token is invalid, expired or revoked.", "")
+            } else {
+                app.serverError(w, r, err)
+            }
+            return
+        }
+
+        ctx := context.WithValue(r.Context(), userIDContextKey, token.UserID)
+        ctx = context.WithValue(ctx, tokenContextKey, token)
+        next.ServeHTTP(w, r.WithContext(ctx))
+    })
+}
+
+// requireScope only lets requests through whose API token has the scope.
+func (app *application) requireScope(scope string) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            token := tokenFromContext(r.Context())
+            if token == nil || !token.HasScope(scope) {
+                w.Header().Set("WWW-Authenticate",
+                    fmt.Sprintf(`Bearer realm="chunkbox", error="insufficient_scope", scope="%s"`, scope))
+                app.errorResponse(w, r, http.StatusForbidden,
+                    fmt.Sprintf("This request needs an API token with the %s scope.", scope), "")
+                return
+            }
+            next.ServeHTTP(w, r)
+        })
+    }
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "golang.org/x/time/rate"
+)
+
+// rateLimiter keeps a token bucket for each client. A client may make burst
+// requests in one go, after which the bucket refills at limit requests per
+// second.
+type rateLimiter struct {
+    limit rate.Limit
+    burst int
+    // now returns the current time. It is only replaced by tests, which
+    // want to see the buckets refill without waiting.
+    now func() time.Time
+
+    mu      sync.Mutex
+    buckets map[string]*bucket
+    // done is closed by stop to end the goroutine which forgets idle
+    // clients.
+    done chan struct{}
+}
+
+type bucket struct {
+    limiter  *rate.Limiter
+    lastSeen time.Time
+}
+
+// bucketIdleTime is how long a bucket is kept after its client was last
+// seen. By then it has filled up again, so forgetting it changes nothing.
+const bucketIdleTime = 5 * time.Minute
+
+// newRateLimiter returns a rate limiter, and starts a goroutine which
+// forgets about idle clients so the map doesn't grow forever. Call stop once
+// the limiter is no longer needed.
+func newRateLimiter(limit float64, burst int) *rateLimiter {
+    rl := &rateLimiter{
+        limit:   rate.Limit(limit),
+        burst:   burst,
+        now:     time.Now,
+        buckets: make(map[string]*bucket),
+        done:    make(chan struct{}),
+    }
+    go func() {
+        ticker := time.NewTicker(time.Minute)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ticker.C:
+                rl.forgetIdle()
+            case <-rl.done:
+                return
+            }
+        }
+    }()
+    return rl
+}
+
+// forgetIdle deletes the buckets of clients we haven't seen for a while.
+func (rl *rateLimiter) forgetIdle() {
+    rl.mu.Lock()
+    defer rl.mu.Unlock()
+
+    for key, b := range rl.buckets {
+        if rl.now().Sub(b.lastSeen) > bucketIdleTime {
+            delete(rl.buckets, key)
+        }
+    }
+}
+
+// stop ends the goroutine which forgets idle clients. It does nothing to a
+// nil limiter, so it is safe to call when rate limiting is off.
+func (rl *rateLimiter) stop() {
+    if rl == nil {
+        return
+    }
+    close(rl.done)
+}
+
+// allow takes a token from the bucket of the client with the given key. It
+// reports whether there was one, and how many are left.
+func (rl *rateLimiter) allow(key string) (ok bool, remaining float64) {
+    rl.mu.Lock()
+    defer rl.mu.Unlock()
+
+    b, found := rl.buckets[key]
+    if !found {
+        b = &bucket{limiter: rate.NewLimiter(rl.limit, rl.burst)}
+        rl.buckets[key] = b
+    }
+    now := rl.now()
+    b.lastSeen = now
+
+    ok = b.limiter.AllowN(now, 1)
+    return ok, b.limiter.TokensAt(now)
+}
+
+// secondsUntil returns how many seconds, rounded up, it takes for a bucket
+// holding the given number of tokens to refill to want tokens.
+func (rl *rateLimiter) secondsUntil(tokens float64, want float64) int {
+    if tokens >= want {
+        return 0
+    }
+    return int(math.Ceil((want - tokens) / float64(rl.limit)))
+}
+
+// rateLimit limits how often each client can call us. Requests which change
+// something (anything but GET and HEAD) have a much lower limit than reads.
+// Every response says how much of the limit is left in the RateLimit-*
+// headers, and a client over the limit gets a 429 Too Many Requests with a
+// Retry-After header saying when to try again.
+func (app *application) rateLimit(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        rl, kind := app.readLimiter, "read"
+        if r.Method != http.MethodGet && r.Method != http.MethodHead {
+            rl, kind = app.writeLimiter, "write"
+        }
+
+        ok, remaining := rl.allow(kind + ":" + app.rateLimitKey(r))
+
+        w.Header().Set("RateLimit-Limit", strconv.Itoa(rl.burst))
+        w.Header().Set("RateLimit-Remaining", strconv.Itoa(int(remaining)))
+        w.Header().Set("RateLimit-Reset", strconv.Itoa(rl.secondsUntil(remaining, float64(rl.burst))))
+
+        if !ok {
+            app.metrics.rateLimited.WithLabelValues(kind).Inc()
+            w.Header().Set("Retry-After", strconv.Itoa(rl.secondsUntil(remaining, 1)))
+            app.errorResponse(w, r, http.StatusTooManyRequests,
+                "You are making requests too quickly. Please slow down and try again shortly.", "")
+            return
+        }
+
+        next.ServeHTTP(w, r)
+    })
+}
+
+// rateLimitKey returns the key of the bucket a request counts against.
+// Each API token gets its own bucket, so that one busy script doesn't hold
+// up its user's other scripts, and logged in users get one wherever they
+// are. Everyone else shares a bucket with their IP address.
+func (app *application) rateLimitKey(r *http.Request) string {
+    if token := tokenFromContext(r.Context()); token != nil {
+        return "token:" + strconv.Itoa(token.ID)
+    }
+    if id := userIDFromContext(r.Context()); id != 0 {
+        return "user:" + strconv.Itoa(id)
+    }
+    return "ip:" + app.clientIP(r)
+}
+
+// clientIP returns the IP address of the client. Usually that is simply the
+// address the request came from. If that is one of our trusted proxies, we
+// believe what it put in X-Forwarded-For instead: each proxy appends the
+// address it got the request from, so the client is the rightmost address
+// which isn't a trusted proxy. Anything to the left of that could have been
+// made up by the client.
+func (app *application) clientIP(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+    if !app.trustedProxy(host) {
+        return host
+    }
+
+    hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+    for i := len(hops) - 1; i >= 0; i-- {
+        hop := strings.TrimSpace(hops[i])
+        if net.ParseIP(hop) == nil {
+            // A malformed entry means we can't trust anything to its left.
+            break
+        }
+        host = hop
+        if !app.trustedProxy(hop) {
+            break
+        }
+    }
+    return host
+}
+
+// trustedProxy reports whether the address belongs to one of the trusted
+// proxies.
+func (app *application) trustedProxy(addr string) bool {
+    ip := net.ParseIP(addr)
+    if ip == nil {
+        return false
+    }
+    for _, network := range app.trustedProxies {
+        if network.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// parseCIDRs parses a list of networks like "10.0.0.0/8". A plain address
+// is taken to be a network of its own.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+    var networks []*net.IPNet
+    for _, cidr := range cidrs {
+        if !strings.Contains(cidr, "/") {
+            ip := net.ParseIP(cidr)
+            if ip == nil {
+                return nil, fmt.Errorf("invalid address %q", cidr)
+            }
+            bits := 8 * len(ip.To4())
+            if bits == 0 {
+                bits = 8 * net.IPv6len
+            }
+            cidr = fmt.Sprintf("%s/%d", cidr, bits)
+        }
+        _, network, err := net.ParseCIDR(cidr)
+        if err != nil {
+            return nil, err
+        }
+        networks = append(networks, network)
+    }
+    return networks, nil
+}
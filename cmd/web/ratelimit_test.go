@@ -0,0 +1,334 @@
+package main
+
+import (
+    "context"
+    "io"
+    "log/slog"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/cpucortexm/chunkbox/internal/assert"
+    "github.com/cpucortexm/chunkbox/internal/models"
+)
+
+func TestParseCIDRs(t *testing.T) {
+    tests := []struct {
+        name    string
+        cidrs   []string
+        want    []string
+        wantErr bool
+    }{
+        {name: "None", cidrs: nil, want: nil},
+        {name: "IPv4 network", cidrs: []string{"10.0.0.0/8"}, want: []string{"10.0.0.0/8"}},
+        {name: "IPv4 address", cidrs: []string{"192.0.2.1"}, want: []string{"192.0.2.1/32"}},
+        {name: "IPv6 network", cidrs: []string{"2001:db8::/32"}, want: []string{"2001:db8::/32"}},
+        {name: "IPv6 address", cidrs: []string{"2001:db8::1"}, want: []string{"2001:db8::1/128"}},
+        {name: "Host bits are masked", cidrs: []string{"10.1.2.3/16"}, want: []string{"10.1.0.0/16"}},
+        {name: "Several", cidrs: []string{"10.0.0.0/8", "::1"}, want: []string{"10.0.0.0/8", "::1/128"}},
+        {name: "Bad address", cidrs: []string{"10.0.0"}, wantErr: true},
+        {name: "Bad prefix", cidrs: []string{"10.0.0.0/33"}, wantErr: true},
+        {name: "Hostname", cidrs: []string{"proxy.example.com"}, wantErr: true},
+        {name: "One bad among good", cidrs: []string{"10.0.0.0/8", "nope"}, wantErr: true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            networks, err := parseCIDRs(tt.cidrs)
+            assert.Equal(t, err != nil, tt.wantErr)
+            assert.Equal(t, len(networks), len(tt.want))
+            for i := range networks {
+                if i < len(tt.want) {
+                    assert.Equal(t, networks[i].String(), tt.want[i])
+                }
+            }
+        })
+    }
+}
+
+func TestClientIP(t *testing.T) {
+    trusted, err := parseCIDRs([]string{"10.0.0.0/8", "2001:db8:ffff::/48"})
+    assert.NilError(t, err)
+    app := &application{trustedProxies: trusted}
+
+    tests := []struct {
+        name          string
+        remoteAddr    string
+        xForwardedFor []string
+        want          string
+    }{
+        {
+            name:       "Direct client",
+            remoteAddr: "203.0.113.7:51000",
+            want:       "203.0.113.7",
+        },
+        {
+            name:          "Untrusted client sends X-Forwarded-For",
+            remoteAddr:    "203.0.113.7:51000",
+            xForwardedFor: []string{"198.51.100.1"},
+            want:          "203.0.113.7",
+        },
+        {
+            name:          "Untrusted proxy",
+            remoteAddr:    "192.0.2.10:443",
+            xForwardedFor: []string{"198.51.100.1"},
+            want:          "192.0.2.10",
+        },
+        {
+            name:          "Trusted proxy",
+            remoteAddr:    "10.0.0.5:443",
+            xForwardedFor: []string{"198.51.100.1"},
+            want:          "198.51.100.1",
+        },
+        {
+            name:       "Trusted proxy without X-Forwarded-For",
+            remoteAddr: "10.0.0.5:443",
+            want:       "10.0.0.5",
+        },
+        {
+            name:          "Two trusted proxies",
+            remoteAddr:    "10.0.0.5:443",
+            xForwardedFor: []string{"198.51.100.1, 10.0.0.6"},
+            want:          "198.51.100.1",
+        },
+        {
+            name:          "Spoofed entries to the left of the client",
+            remoteAddr:    "10.0.0.5:443",
+            xForwardedFor: []string{"1.2.3.4, 10.0.0.99, 198.51.100.1, 10.0.0.6"},
+            want:          "198.51.100.1",
+        },
+        {
+            name:          "Client claims to be a trusted proxy",
+            remoteAddr:    "10.0.0.5:443",
+            xForwardedFor: []string{"1.2.3.4, 10.0.0.7"},
+            want:          "1.2.3.4",
+        },
+        {
+            name:          "Untrusted hop in the middle",
+            remoteAddr:    "10.0.0.5:443",
+            xForwardedFor: []string{"198.51.100.1, 192.0.2.10, 10.0.0.6"},
+            want:          "192.0.2.10",
+        },
+        {
+            name:          "Several headers",
+            remoteAddr:    "10.0.0.5:443",
+            xForwardedFor: []string{"1.2.3.4", "198.51.100.1, 10.0.0.6"},
+            want:          "198.51.100.1",
+        },
+        {
+            name:          "Malformed entry",
+            remoteAddr:    "10.0.0.5:443",
+            xForwardedFor: []string{"1.2.3.4, garbage, 10.0.0.6"},
+            want:          "10.0.0.6",
+        },
+        {
+            name:          "Only a malformed entry",
+            remoteAddr:    "10.0.0.5:443",
+            xForwardedFor: []string{"unknown"},
+            want:          "10.0.0.5",
+        },
+        {
+            name:       "IPv6 client",
+            remoteAddr: "[2001:db8::1]:51000",
+            want:       "2001:db8::1",
+        },
+        {
+            name:          "IPv6 untrusted client sends X-Forwarded-For",
+            remoteAddr:    "[2001:db8::1]:51000",
+            xForwardedFor: []string{"198.51.100.1"},
+            want:          "2001:db8::1",
+        },
+        {
+            name:          "IPv6 trusted proxy",
+            remoteAddr:    "[2001:db8:ffff::2]:443",
+            xForwardedFor: []string{"2001:db8:1::42"},
+            want:          "2001:db8:1::42",
+        },
+        {
+            name:          "Mixed IPv4 and IPv6 hops",
+            remoteAddr:    "[2001:db8:ffff::2]:443",
+            xForwardedFor: []string{"1.2.3.4, 198.51.100.1, 10.0.0.6"},
+            want:          "198.51.100.1",
+        },
+        {
+            name:       "Remote address without a port",
+            remoteAddr: "203.0.113.7",
+            want:       "203.0.113.7",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest(http.MethodGet, "/", nil)
+            r.RemoteAddr = tt.remoteAddr
+            for _, value := range tt.xForwardedFor {
+                r.Header.Add("X-Forwarded-For", value)
+            }
+
+            assert.Equal(t, app.clientIP(r), tt.want)
+        })
+    }
+}
+
+func TestRateLimitKey(t *testing.T) {
+    app := &application{}
+
+    tests := []struct {
+        name string
+        ctx  func(ctx context.Context) context.Context
+        want string
+    }{
+        {
+            name: "Anonymous",
+            ctx:  func(ctx context.Context) context.Context { return ctx },
+            want: "ip:203.0.113.7",
+        },
+        {
+            name: "Logged in",
+            ctx: func(ctx context.Context) context.Context {
+                return context.WithValue(ctx, userIDContextKey, 42)
+            },
+            want: "user:42",
+        },
+        {
+            name: "API token",
+            ctx: func(ctx context.Context) context.Context {
+                ctx = context.WithValue(ctx, userIDContextKey, 42)
+                return context.WithValue(ctx, tokenContextKey, &models.Token{ID: 7})
+            },
+            want: "token:7",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest(http.MethodGet, "/", nil)
+            r.RemoteAddr = "203.0.113.7:51000"
+            r = r.WithContext(tt.ctx(r.Context()))
+
+            assert.Equal(t, app.rateLimitKey(r), tt.want)
+        })
+    }
+}
+
+// newTestLimiter returns a rate limiter whose clock only moves when the
+// test moves it. The limiter is stopped when the test finishes.
+func newTestLimiter(t *testing.T, limit float64, burst int) (*rateLimiter, *time.Time) {
+    rl := newRateLimiter(limit, burst)
+    t.Cleanup(rl.stop)
+    now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    rl.now = func() time.Time { return now }
+    return rl, &now
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+    rl, now := newTestLimiter(t, 2, 3)
+
+    // The whole burst is allowed at once, and then nothing more.
+    for i := 3; i > 0; i-- {
+        ok, remaining := rl.allow("ip:a")
+        assert.Equal(t, ok, true)
+        assert.Equal(t, remaining, float64(i-1))
+    }
+    ok, remaining := rl.allow("ip:a")
+    assert.Equal(t, ok, false)
+    assert.Equal(t, rl.secondsUntil(remaining, 1), 1)
+    assert.Equal(t, rl.secondsUntil(remaining, 3), 2)
+
+    // Other clients have buckets of their own.
+    ok, _ = rl.allow("ip:b")
+    assert.Equal(t, ok, true)
+
+    // At two tokens a second, half a second gives one request back.
+    *now = now.Add(500 * time.Millisecond)
+    ok, _ = rl.allow("ip:a")
+    assert.Equal(t, ok, true)
+    ok, _ = rl.allow("ip:a")
+    assert.Equal(t, ok, false)
+
+    // However long the client waits, the bucket holds no more than the
+    // burst.
+    *now = now.Add(time.Hour)
+    for i := 0; i < 3; i++ {
+        ok, _ = rl.allow("ip:a")
+        assert.Equal(t, ok, true)
+    }
+    ok, _ = rl.allow("ip:a")
+    assert.Equal(t, ok, false)
+
+    // Once a client has been idle for long enough its bucket is forgotten,
+    // but a client seen recently keeps its own.
+    *now = now.Add(bucketIdleTime + time.Second)
+    rl.allow("ip:b")
+    rl.forgetIdle()
+    _, found := rl.buckets["ip:a"]
+    assert.Equal(t, found, false)
+    _, found = rl.buckets["ip:b"]
+    assert.Equal(t, found, true)
+}
+
+func TestRateLimiterStop(t *testing.T) {
+    rl := newRateLimiter(1, 1)
+    rl.stop()
+
+    select {
+    case <-rl.done:
+    default:
+        t.Fatal("stop didn't close the done channel")
+    }
+
+    // Stopping a limiter which was never started is fine too.
+    var off *rateLimiter
+    off.stop()
+}
+
+func TestRateLimit(t *testing.T) {
+    logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+    app := &application{
+        logger:  logger,
+        metrics: newMetrics(nil, nil, logger),
+    }
+    app.readLimiter, _ = newTestLimiter(t, 1, 2)
+    app.writeLimiter, _ = newTestLimiter(t, 1, 1)
+
+    next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("OK"))
+    })
+    handler := app.rateLimit(next)
+
+    send := func(method, remoteAddr string) *httptest.ResponseRecorder {
+        r := httptest.NewRequest(method, "/", nil)
+        r.RemoteAddr = remoteAddr
+        r.Header.Set("Accept", "application/json")
+        rr := httptest.NewRecorder()
+        handler.ServeHTTP(rr, r)
+        return rr
+    }
+
+    rr := send(http.MethodGet, "203.0.113.7:1")
+    assert.Equal(t, rr.Code, http.StatusOK)
+    assert.Equal(t, rr.Header().Get("RateLimit-Limit"), "2")
+    assert.Equal(t, rr.Header().Get("RateLimit-Remaining"), "1")
+    assert.Equal(t, rr.Header().Get("RateLimit-Reset"), "1")
+
+    rr = send(http.MethodGet, "203.0.113.7:2")
+    assert.Equal(t, rr.Code, http.StatusOK)
+    assert.Equal(t, rr.Header().Get("RateLimit-Remaining"), "0")
+
+    rr = send(http.MethodGet, "203.0.113.7:3")
+    assert.Equal(t, rr.Code, http.StatusTooManyRequests)
+    assert.Equal(t, rr.Header().Get("Retry-After"), "1")
+    assert.StringContains(t, rr.Body.String(), "too quickly")
+
+    // Writes are counted separately from reads.
+    rr = send(http.MethodPost, "203.0.113.7:4")
+    assert.Equal(t, rr.Code, http.StatusOK)
+    assert.Equal(t, rr.Header().Get("RateLimit-Limit"), "1")
+    rr = send(http.MethodPost, "203.0.113.7:5")
+    assert.Equal(t, rr.Code, http.StatusTooManyRequests)
+
+    // And another client isn't held up.
+    rr = send(http.MethodGet, "198.51.100.1:1")
+    assert.Equal(t, rr.Code, http.StatusOK)
+}
@@ -5,36 +5,182 @@
 -------------------------------------------------------------*/
 package main
 
-import "net/http"
+import (
+    "io/fs"
+    "net/http"
+
+    "github.com/cpucortexm/chunkbox/internal/models"
+    "github.com/julienschmidt/httprouter"
+    "github.com/justinas/alice"
+)
 
 // Update the signature for the routes() method so that it returns a
 // http.Handler instead of *http.ServeMux.
 func (app *application) routes() http.Handler{
 
-    // Initialise new server mux and register a home function
-    // as handler for the "/" URL pattern
-    mux := http.NewServeMux()
+    // Initialize the router. Unlike http.ServeMux, httprouter matches on the
+    // request method as well as the path, and supports named parameters
+    // like :slug in the path.
+    router := httprouter.New()
+
+    // rateLimit limits how often each client can call us, see ratelimit.go.
+    // It runs after the user has been identified, so that logged in users
+    // and API tokens get buckets of their own. When rate limiting is off it
+    // does nothing.
+    rateLimit := alice.Constructor(func(next http.Handler) http.Handler { return next })
+    if app.readLimiter != nil {
+        rateLimit = app.rateLimit
+    }
+
+    // The middleware chains for the different kinds of route. Static files
+    // need nothing but the rate limit. The pages have a session, which
+    // tells us who is logged in, and their forms are protected against
+    // CSRF. Some pages are only for logged in users, and the admin area
+    // only for moderators and admins. The API uses tokens instead of
+    // sessions.
+    static := alice.New(rateLimit)
+    dynamic := alice.New(app.loadAndSave, app.noSurf, app.authenticate, rateLimit)
+    protected := dynamic.Append(app.requireAuthentication)
+    moderator := protected.Append(app.requireRole(models.RoleModerator))
+    admin := protected.Append(app.requireRole(models.RoleAdmin))
+    api := alice.New(app.authenticateToken, rateLimit)
+
+    // Use our own helpers for the 404 Not Found and 405 Method Not Allowed
+    // responses, so they get the same error pages as everything else.
+    // httprouter has already set the Allow header by the time
+    // MethodNotAllowed is called. Requests which match no route share a
+    // single "unmatched" route in the metrics.
+    router.NotFound = app.instrument("unmatched", static.ThenFunc(app.notFound))
+    router.MethodNotAllowed = app.instrument("unmatched", static.ThenFunc(func(w http.ResponseWriter, r *http.Request) {
+        app.clientError(w, r, http.StatusMethodNotAllowed)
+    }))
+
+    // handle registers a handler with the router, instrumented for the
+    // metrics under the path pattern of the route.
+    handle := func(method, path string, handler http.Handler) {
+        router.Handler(method, path, app.instrument(path, handler))
+    }
+
+    // Create a file server which serves files out of the "static" directory
+    // of the ui file system. That is the embedded ui.Files unless -ui-dir
+    // points at a directory on disk. fs.Sub() can only fail for an invalid
+    // path, which "static" isn't.
+    staticFS, _ := fs.Sub(app.uiFS, "static")
+    fileServer := http.FileServer(http.FS(staticFS))
+
+    // Register the file server as the handler for all URL paths that start
+    // with "/static/". For matching paths, we strip the "/static" prefix
+    // before the request reaches the file server.
+    handle(http.MethodGet, "/static/*filepath", static.Then(http.StripPrefix("/static", fileServer)))
+    handle(http.MethodGet, "/chunkbox/highlight.css", static.ThenFunc(app.highlightStyles))
 
-    // Create a file server which serves files out of the "./ui/static" directory.
-    // Note that the path given to the http.Dir function is relative to the project
-    // directory root.
-    fileServer := http.FileServer(http.Dir("./ui/static/"))
+    handle(http.MethodGet, "/", dynamic.ThenFunc(app.home))
+    // Chunks live under /c/:slug.
+    handle(http.MethodGet, "/c/:slug", dynamic.ThenFunc(app.chunkView))
+    handle(http.MethodGet, "/c/:slug/raw", dynamic.ThenFunc(app.chunkRaw))
+    // Downloads and forking can be switched off in the config, in which
+    // case their routes don't exist.
+    if app.features.Downloads {
+        handle(http.MethodGet, "/c/:slug/download", dynamic.ThenFunc(app.chunkDownload))
+    }
+    if app.features.Forking {
+        handle(http.MethodGet, "/c/:slug/fork", dynamic.ThenFunc(app.chunkFork))
+    }
+    // Editing and sharing a chunk need a user who may do so, which the
+    // model checks.
+    handle(http.MethodGet, "/c/:slug/edit", protected.ThenFunc(app.chunkEdit))
+    handle(http.MethodPost, "/c/:slug/edit", protected.ThenFunc(app.chunkEditPost))
+    handle(http.MethodPost, "/c/:slug/share", protected.ThenFunc(app.chunkSharePost))
+    handle(http.MethodPost, "/c/:slug/share/:id/remove", protected.ThenFunc(app.chunkUnsharePost))
+    handle(http.MethodPost, "/c/:slug/visibility", protected.ThenFunc(app.chunkVisibilityPost))
+    handle(http.MethodGet, "/shared", protected.ThenFunc(app.sharedWithMe))
+    handle(http.MethodGet, "/chunkbox/create", dynamic.ThenFunc(app.chunkCreate))
+    handle(http.MethodPost, "/chunkbox/create", dynamic.ThenFunc(app.chunkCreatePost))
+    handle(http.MethodGet, "/usage", dynamic.ThenFunc(app.usage))
 
-    // Use the mux.Handle() function to register the file server as the handler for
-    // all URL paths that start with "/static/". For matching paths, we strip the
-    // "/static" prefix before the request reaches the file server.
-    mux.Handle("/static/", http.StripPrefix("/static", fileServer))
+    handle(http.MethodGet, "/user/signup", dynamic.ThenFunc(app.userSignup))
+    handle(http.MethodPost, "/user/signup", dynamic.ThenFunc(app.userSignupPost))
+    handle(http.MethodGet, "/user/login", dynamic.ThenFunc(app.userLogin))
+    handle(http.MethodPost, "/user/login", dynamic.ThenFunc(app.userLoginPost))
+    if app.sso != nil {
+        handle(http.MethodGet, "/user/login/sso", dynamic.ThenFunc(app.ssoLogin))
+        handle(http.MethodGet, "/user/login/sso/callback", dynamic.ThenFunc(app.ssoCallback))
+        handle(http.MethodGet, "/user/login/sso/link", protected.ThenFunc(app.ssoLink))
+        handle(http.MethodPost, "/user/login/sso/link", protected.ThenFunc(app.ssoLinkPost))
+    }
+    handle(http.MethodPost, "/user/logout", protected.ThenFunc(app.userLogoutPost))
 
-    mux.HandleFunc("/", app.home)
-    mux.HandleFunc("/chunkbox/view", app.chunkView)
-    mux.HandleFunc("/chunkbox/create", app.chunkCreate)
+    handle(http.MethodGet, "/settings/tokens", protected.ThenFunc(app.settingsTokens))
+    handle(http.MethodPost, "/settings/tokens", protected.ThenFunc(app.tokenCreatePost))
+    handle(http.MethodPost, "/settings/tokens/:id/revoke", protected.ThenFunc(app.tokenRevokePost))
 
-   // Pass the servemux as the 'next' parameter to the secureHeaders middleware.
+    handle(http.MethodGet, "/workspaces", protected.ThenFunc(app.workspaceList))
+    handle(http.MethodPost, "/workspaces", protected.ThenFunc(app.workspaceCreatePost))
+    handle(http.MethodGet, "/w/:slug", protected.ThenFunc(app.workspaceView))
+    handle(http.MethodGet, "/w/:slug/members", protected.ThenFunc(app.workspaceMembers))
+    handle(http.MethodPost, "/w/:slug/members", protected.ThenFunc(app.workspaceMemberAddPost))
+    handle(http.MethodPost, "/w/:slug/members/:id/role", protected.ThenFunc(app.workspaceMemberRolePost))
+    handle(http.MethodPost, "/w/:slug/members/:id/remove", protected.ThenFunc(app.workspaceMemberRemovePost))
+
+    handle(http.MethodGet, "/admin", moderator.ThenFunc(app.adminHome))
+    handle(http.MethodGet, "/admin/chunks", moderator.ThenFunc(app.adminChunks))
+    handle(http.MethodPost, "/admin/chunks/:slug/delete", moderator.ThenFunc(app.adminChunkDeletePost))
+    handle(http.MethodPost, "/admin/chunks/:slug/extend", moderator.ThenFunc(app.adminChunkExtendPost))
+    handle(http.MethodGet, "/admin/users", admin.ThenFunc(app.adminUsers))
+    handle(http.MethodPost, "/admin/users/:id/role", admin.ThenFunc(app.adminUserRolePost))
+    handle(http.MethodPost, "/admin/users/:id/disabled", admin.ThenFunc(app.adminUserDisabledPost))
+    handle(http.MethodGet, "/admin/stats", admin.ThenFunc(app.adminStats))
+
+    // The API, for scripts and the command line. Each route needs a token
+    // with the right scope.
+    handle(http.MethodGet, "/api/chunks/:slug", api.Append(app.requireScope(models.ScopeRead)).ThenFunc(app.apiChunkView))
+    handle(http.MethodPost, "/api/chunks", api.Append(app.requireScope(models.ScopeWrite)).ThenFunc(app.apiChunkCreate))
+    handle(http.MethodDelete, "/api/chunks/:slug", api.Append(app.requireScope(models.ScopeDelete)).ThenFunc(app.apiChunkDelete))
+
+    // Links by id, either in the path or the old ?id= form, redirect to
+    // the /c/:slug URLs.
+    handle(http.MethodGet, "/chunkbox/view/:id", dynamic.Then(app.legacyRedirect("")))
+    handle(http.MethodGet, "/chunkbox/view", dynamic.Then(app.legacyRedirect("")))
+    handle(http.MethodGet, "/chunkbox/raw", dynamic.Then(app.legacyRedirect("/raw")))
+    if app.features.Downloads {
+        handle(http.MethodGet, "/chunkbox/download", dynamic.Then(app.legacyRedirect("/download")))
+    }
+    if app.features.Forking {
+        handle(http.MethodGet, "/chunkbox/fork", dynamic.Then(app.legacyRedirect("/fork")))
+    }
+
+   // Pass the router as the 'next' parameter to the secureHeaders middleware.
    // Because secureHeaders is just a function, and the function returns a
    // http.Handler we don't need to do anything else.
-   // Wrap the existing chain with the logRequest middleware.
    // Middleware flow below
-   // logRequest ↔ secureHeaders ↔ servemux ↔ application handler
-   // Finally wrap with the recoverpanic middleware
-    return app.recoverPanic(app.logRequest(secureHeaders(mux)))
+   // requestID ↔ logRequest ↔ recoverPanic ↔ secureHeaders ↔ router ↔ route chain ↔ application handler
+   // requestID comes first so that everything after it, including the
+   // error page for a panic, knows the request ID. recoverPanic sits inside
+   // logRequest so that requests which panicked are still logged, with
+   // their 500 status. The route chains above come after secureHeaders, so
+   // that a 429 page gets the same headers as any other.
+    standard := alice.New(requestID, app.logRequest, app.recoverPanic, secureHeaders).Then(router)
+
+    // The health and readiness probes are polled every few seconds, so
+    // they are answered before the middleware chain to keep them out of
+    // the request log and the metrics.
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Path {
+        case "/healthz":
+            app.healthz(w, r)
+        case "/readyz":
+            app.readyz(w, r)
+        default:
+            standard.ServeHTTP(w, r)
+        }
+    })
+}
+
+// adminRoutes returns the handler for the admin listener, which serves the
+// Prometheus metrics. It is kept off the public listener, as the metrics
+// say more about the server than users need to know.
+func (app *application) adminRoutes() http.Handler {
+    router := httprouter.New()
+    router.Handler(http.MethodGet, "/metrics", app.metrics.handler())
+    return router
 }
@@ -0,0 +1,180 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "github.com/cpucortexm/chunkbox/internal/models"
+    "github.com/cpucortexm/chunkbox/internal/validator"
+    "github.com/julienschmidt/httprouter"
+)
+
+// Sharing chunks with particular users and workspaces. The model decides
+// who may do what, see models/grants.go; the handlers only use
+// chunk.CanShare to give a clearer error than the 404 Not Found the model
+// would lead to.
+
+// sharedPageSize is how many chunks the "shared with me" page lists.
+const sharedPageSize = 20
+
+// shareForm holds the fields of the sharing dialog. A chunk is shared with
+// either the user with the email address or the workspace with the slug.
+type shareForm struct {
+    Email      string
+    Workspace  string
+    Permission string
+    validator.Validator
+}
+
+// requireShare sends a 403 Forbidden response and returns false unless the
+// user may share the chunk.
+func (app *application) requireShare(w http.ResponseWriter, r *http.Request, chunk *models.Chunk) bool {
+    if !chunk.CanShare {
+        app.errorResponse(w, r, http.StatusForbidden, "Only the owners of a chunk can change who it is shared with.", "")
+        return false
+    }
+    return true
+}
+
+// The chunkSharePost handler shares the chunk with a user or workspace, or
+// changes the permission of an existing grant.
+func (app *application) chunkSharePost(w http.ResponseWriter, r *http.Request) {
+    err := r.ParseForm()
+    if err != nil {
+        app.clientError(w, r, http.StatusBadRequest)
+        return
+    }
+    chunk, ok := app.chunkFromPath(w, r)
+    if !ok || !app.requireShare(w, r, chunk) {
+        return
+    }
+
+    form := shareForm{
+        Email:      strings.TrimSpace(r.PostForm.Get("email")),
+        Workspace:  r.PostForm.Get("workspace"),
+        Permission: r.PostForm.Get("permission"),
+    }
+
+    form.CheckField(form.Email != "" || form.Workspace != "", "email", "Enter an email address or pick a workspace")
+    form.CheckField(form.Email == "" || form.Workspace == "", "email", "Share with a user or a workspace, not both at once")
+    if form.Email != "" {
+        form.CheckField(validator.Matches(form.Email, validator.EmailRX), "email", "This field must be a valid email address")
+    }
+    form.CheckField(validator.PermittedValue(form.Permission, models.Permissions...), "permission", "This permission does not exist")
+
+    if form.Valid() {
+        grantee := form.Email
+        if form.Email != "" {
+            err = app.chunks.ShareWithUser(r.Context(), chunk.ID, userIDFromContext(r.Context()), form.Email, form.Permission)
+        } else {
+            grantee = form.Workspace
+            err = app.chunks.ShareWithWorkspace(r.Context(), chunk.ID, userIDFromContext(r.Context()), form.Workspace, form.Permission)
+        }
+        switch {
+        case err == nil:
+            app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("The chunk has been shared with %s.", grantee))
+            http.Redirect(w, r, "/c/"+chunk.Slug, http.StatusSeeOther)
+            return
+        case errors.Is(err, models.ErrUnknownGrantee) && form.Email != "":
+            form.AddFieldError("email", "There is no user with this email address")
+        case errors.Is(err, models.ErrUnknownGrantee):
+            form.AddFieldError("workspace", "You are not a member of this workspace")
+        case errors.Is(err, models.ErrNoRecord):
+            app.notFound(w, r)
+            return
+        default:
+            app.serverError(w, r, err)
+            return
+        }
+    }
+
+    app.renderView(w, r, http.StatusUnprocessableEntity, chunk, form)
+}
+
+// The chunkUnsharePost handler removes one of the grants of the chunk.
+func (app *application) chunkUnsharePost(w http.ResponseWriter, r *http.Request) {
+    chunk, ok := app.chunkFromPath(w, r)
+    if !ok || !app.requireShare(w, r, chunk) {
+        return
+    }
+    id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+    if err != nil || id < 1 {
+        app.notFound(w, r)
+        return
+    }
+
+    err = app.chunks.Unshare(r.Context(), chunk.ID, userIDFromContext(r.Context()), id)
+    if err != nil {
+        if errors.Is(err, models.ErrNoRecord) {
+            app.notFound(w, r)
+        } else {
+            app.serverError(w, r, err)
+        }
+        return
+    }
+
+    app.sessionManager.Put(r.Context(), "flash", "The chunk is no longer shared with them.")
+    http.Redirect(w, r, "/c/"+chunk.Slug, http.StatusSeeOther)
+}
+
+// The chunkVisibilityPost handler makes the chunk private, or public again,
+// depending on the private field. Chunks in a workspace are always private
+// to it.
+func (app *application) chunkVisibilityPost(w http.ResponseWriter, r *http.Request) {
+    err := r.ParseForm()
+    if err != nil {
+        app.clientError(w, r, http.StatusBadRequest)
+        return
+    }
+    private, err := strconv.ParseBool(r.PostForm.Get("private"))
+    if err != nil {
+        app.clientError(w, r, http.StatusBadRequest)
+        return
+    }
+    chunk, ok := app.chunkFromPath(w, r)
+    if !ok || !app.requireShare(w, r, chunk) {
+        return
+    }
+    if chunk.WorkspaceID != 0 {
+        app.clientError(w, r, http.StatusBadRequest)
+        return
+    }
+
+    err = app.chunks.SetPrivate(r.Context(), chunk.ID, userIDFromContext(r.Context()), private)
+    if err != nil {
+        if errors.Is(err, models.ErrNoRecord) {
+            app.notFound(w, r)
+        } else {
+            app.serverError(w, r, err)
+        }
+        return
+    }
+
+    message := "The chunk is now public."
+    if private {
+        message = "The chunk is now private."
+    }
+    app.sessionManager.Put(r.Context(), "flash", message)
+    http.Redirect(w, r, "/c/"+chunk.Slug, http.StatusSeeOther)
+}
+
+// The sharedWithMe handler lists the chunks which have been shared with the
+// user, directly or through one of their workspaces.
+func (app *application) sharedWithMe(w http.ResponseWriter, r *http.Request) {
+    page := pageParam(r)
+
+    chunks, more, err := app.chunks.SharedWith(r.Context(), userIDFromContext(r.Context()), sharedPageSize, (page-1)*sharedPageSize)
+    if err != nil {
+        app.serverError(w, r, err)
+        return
+    }
+
+    data := app.newTemplateData(r)
+    data.Chunks = chunks
+    data.Page = page
+    data.MorePages = more
+    app.render(w, r, http.StatusOK, "shared.html", data)
+}
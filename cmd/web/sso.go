@@ -0,0 +1,410 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+    "sync"
+
+    "github.com/coreos/go-oidc/v3/oidc"
+    "github.com/cpucortexm/chunkbox/internal/models"
+    "golang.org/x/oauth2"
+)
+
+// ssoProvider logs users in with an OpenID Connect provider, using the
+// authorization code flow with PKCE. Everything about the provider, from
+// its endpoints to the keys its ID tokens are signed with, comes from its
+// discovery document.
+type ssoProvider struct {
+    name   string // shown on the login button
+    issuer string
+    // client makes all the requests to the provider. Pointing it (and the
+    // issuer) at a stand-in provider is all it takes to test the login.
+    client *http.Client
+    config oauth2.Config
+
+    emailClaim     string
+    nameClaim      string
+    allowedDomains []string
+
+    mu       sync.Mutex
+    provider *oidc.Provider
+    verifier *oidc.IDTokenVerifier
+}
+
+// newSSOProvider returns the provider described by the config. It doesn't
+// contact the provider yet, see discover.
+func newSSOProvider(cfg *config, client *http.Client) *ssoProvider {
+    scopes := []string{oidc.ScopeOpenID}
+    for _, scope := range cfg.OIDC.Scopes {
+        if scope != oidc.ScopeOpenID {
+            scopes = append(scopes, scope)
+        }
+    }
+    return &ssoProvider{
+        name:   cfg.OIDC.Name,
+        issuer: cfg.OIDC.Issuer,
+        client: client,
+        config: oauth2.Config{
+            ClientID:     cfg.OIDC.ClientID,
+            ClientSecret: cfg.OIDC.ClientSecret,
+            RedirectURL:  cfg.OIDC.RedirectURL,
+            Scopes:       scopes,
+        },
+        emailClaim:     cfg.OIDC.EmailClaim,
+        nameClaim:      cfg.OIDC.NameClaim,
+        allowedDomains: cfg.OIDC.AllowedDomains,
+    }
+}
+
+// context returns a context which makes the oidc and oauth2 packages use
+// our HTTP client.
+func (s *ssoProvider) context(ctx context.Context) context.Context {
+    return oidc.ClientContext(ctx, s.client)
+}
+
+// discover fetches the discovery document of the provider the first time
+// it is needed, and keeps it. Until it succeeds it is tried again on every
+// login, so that the provider being down when we start doesn't stop us
+// from starting, or break single sign-on until we are restarted. The keys
+// are fetched from the JWKS endpoint when a token is verified, and again
+// whenever a token is signed with a key we haven't seen.
+func (s *ssoProvider) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if s.provider == nil {
+        provider, err := oidc.NewProvider(s.context(ctx), s.issuer)
+        if err != nil {
+            return nil, nil, fmt.Errorf("oidc discovery: %w", err)
+        }
+        s.provider = provider
+        // The verifier checks the signature, issuer, audience and expiry of
+        // ID tokens. The keys are fetched with the client from the context
+        // given to NewProvider(), but not its deadline, which is why that
+        // can be the context of the request.
+        s.verifier = provider.Verifier(&oidc.Config{ClientID: s.config.ClientID})
+        s.config.Endpoint = provider.Endpoint()
+    }
+    config := s.config
+    return &config, s.verifier, nil
+}
+
+// errSSODenied is wrapped by the errors for users who the provider vouched
+// for, but who we don't let in.
+var errSSODenied = errors.New("sso: denied")
+
+// errSSOInvalidToken is wrapped by the errors for ID tokens which fail
+// verification: a bad signature, the wrong issuer or audience, an expired
+// token, or the nonce of another login. The provider doesn't send those, so
+// they are most likely forged or replayed, and are turned away like any
+// other bad request rather than blamed on the provider.
+var errSSOInvalidToken = errors.New("sso: invalid id_token")
+
+// identity is what we learn about a user from their ID token.
+type identity struct {
+    issuer  string
+    subject string
+    email   string
+    name    string
+}
+
+// identity maps the claims of a verified ID token to a user, using the
+// claims named in the config. The email address must be in one of the
+// allowed domains (if any), and the provider must say that it has verified
+// it: the address decides which account the user gets, so we can't take
+// the word of someone who may have typed in another person's address.
+func (s *ssoProvider) identity(token *oidc.IDToken) (*identity, error) {
+    var claims map[string]any
+    err := token.Claims(&claims)
+    if err != nil {
+        return nil, err
+    }
+
+    email, _ := claims[s.emailClaim].(string)
+    email = strings.TrimSpace(email)
+    name, _ := claims[s.nameClaim].(string)
+    name = strings.TrimSpace(name)
+
+    if email == "" {
+        return nil, fmt.Errorf("%w: no %s claim", errSSODenied, s.emailClaim)
+    }
+    if verified, _ := claims["email_verified"].(bool); !verified {
+        return nil, fmt.Errorf("%w: email address %s not verified", errSSODenied, email)
+    }
+    if !s.domainAllowed(email) {
+        return nil, fmt.Errorf("%w: email address %s not in an allowed domain", errSSODenied, email)
+    }
+    if name == "" {
+        name, _, _ = strings.Cut(email, "@")
+    }
+
+    return &identity{issuer: token.Issuer, subject: token.Subject, email: email, name: name}, nil
+}
+
+// domainAllowed reports whether the email address is in one of the allowed
+// domains. If no domains are configured, all are allowed.
+func (s *ssoProvider) domainAllowed(email string) bool {
+    if len(s.allowedDomains) == 0 {
+        return true
+    }
+    at := strings.LastIndex(email, "@")
+    if at < 0 {
+        return false
+    }
+    domain := email[at+1:]
+    for _, allowed := range s.allowedDomains {
+        if strings.EqualFold(domain, allowed) {
+            return true
+        }
+    }
+    return false
+}
+
+// The ssoLogin handler sends the user to the provider to log in. The state
+// ties the callback to this session, the nonce ties the ID token to this
+// login, and the PKCE verifier means a stolen authorization code is no
+// use to anybody else. All three are kept in the session until the user
+// comes back.
+func (app *application) ssoLogin(w http.ResponseWriter, r *http.Request) {
+    config, _, err := app.sso.discover(r.Context())
+    if err != nil {
+        app.ssoUnavailable(w, r, err)
+        return
+    }
+
+    state := oauth2.GenerateVerifier()
+    nonce := oauth2.GenerateVerifier()
+    verifier := oauth2.GenerateVerifier()
+    app.sessionManager.Put(r.Context(), "ssoState", state)
+    app.sessionManager.Put(r.Context(), "ssoNonce", nonce)
+    app.sessionManager.Put(r.Context(), "ssoVerifier", verifier)
+
+    url := config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+    http.Redirect(w, r, url, http.StatusFound)
+}
+
+// The ssoCallback handler is where the provider sends the user back to,
+// with an authorization code. We exchange the code for an ID token, check
+// it, and log in the user it names, creating an account for them if this
+// is their first time.
+func (app *application) ssoCallback(w http.ResponseWriter, r *http.Request) {
+    state := app.sessionManager.PopString(r.Context(), "ssoState")
+    nonce := app.sessionManager.PopString(r.Context(), "ssoNonce")
+    verifier := app.sessionManager.PopString(r.Context(), "ssoVerifier")
+
+    query := r.URL.Query()
+    if state == "" || query.Get("state") != state {
+        app.errorResponse(w, r, http.StatusBadRequest,
+            "Your login has expired or didn't start on this site. Please try logging in again.", "")
+        return
+    }
+    // The provider reports errors, like the user refusing to log in, in
+    // the query string.
+    if e := query.Get("error"); e != "" {
+        app.ssoFailed(w, r, fmt.Errorf("%w: provider returned %s: %s", errSSODenied, e, query.Get("error_description")))
+        return
+    }
+
+    config, idVerifier, err := app.sso.discover(r.Context())
+    if err != nil {
+        app.ssoUnavailable(w, r, err)
+        return
+    }
+
+    ctx := app.sso.context(r.Context())
+    token, err := config.Exchange(ctx, query.Get("code"), oauth2.VerifierOption(verifier))
+    if err != nil {
+        app.ssoUnavailable(w, r, fmt.Errorf("oidc token exchange: %w", err))
+        return
+    }
+    rawIDToken, ok := token.Extra("id_token").(string)
+    if !ok {
+        app.ssoUnavailable(w, r, errors.New("oidc token exchange: no id_token in the response"))
+        return
+    }
+    idToken, err := idVerifier.Verify(ctx, rawIDToken)
+    if err != nil {
+        app.ssoFailed(w, r, fmt.Errorf("%w: %v", errSSOInvalidToken, err))
+        return
+    }
+    if idToken.Nonce != nonce {
+        app.ssoFailed(w, r, fmt.Errorf("%w: nonce does not match", errSSOInvalidToken))
+        return
+    }
+
+    id, err := app.sso.identity(idToken)
+    if err != nil {
+        app.ssoFailed(w, r, err)
+        return
+    }
+
+    userID, err := app.users.Provision(r.Context(), id.issuer, id.subject, id.name, id.email)
+    if err != nil {
+        switch {
+        case errors.Is(err, models.ErrUserDisabled):
+            app.ssoFailed(w, r, fmt.Errorf("%w: user %s is disabled", errSSODenied, id.email))
+        case errors.Is(err, models.ErrLinkRequired):
+            app.ssoLinkRequired(w, r, id)
+        default:
+            app.serverError(w, r, err)
+        }
+        return
+    }
+
+    // Log the user in, just like userLoginPost does.
+    err = app.sessionManager.RenewToken(r.Context())
+    if err != nil {
+        app.serverError(w, r, err)
+        return
+    }
+    app.sessionManager.Put(r.Context(), "authenticatedUserID", userID)
+
+    http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// ssoLinkRequired asks someone whose email address belongs to a user with a
+// password to log in with that password first. The identity waits in the
+// session until they have, and then ssoLink asks them to confirm linking
+// it to their account. Until then the provider alone can't get anyone into
+// an account which has a password.
+func (app *application) ssoLinkRequired(w http.ResponseWriter, r *http.Request, id *identity) {
+    app.sessionManager.Put(r.Context(), "ssoLinkIssuer", id.issuer)
+    app.sessionManager.Put(r.Context(), "ssoLinkSubject", id.subject)
+    app.sessionManager.Put(r.Context(), "ssoLinkEmail", id.email)
+
+    form := userLoginForm{Email: id.email}
+    form.AddNonFieldError("There is already an account for " + id.email + ". Log in with its password to link your " +
+        app.sso.name + " login to it.")
+    data := app.newTemplateData(r)
+    data.Form = form
+    app.render(w, r, http.StatusConflict, "login.html", data)
+}
+
+// pendingLink returns the identity waiting in the session to be linked to
+// the logged in user, see ssoLinkRequired. If there is none, or it is for
+// another user's email address, it is dropped and ok is false.
+func (app *application) pendingLink(r *http.Request) (id *identity, ok bool, err error) {
+    id = &identity{
+        issuer:  app.sessionManager.GetString(r.Context(), "ssoLinkIssuer"),
+        subject: app.sessionManager.GetString(r.Context(), "ssoLinkSubject"),
+        email:   app.sessionManager.GetString(r.Context(), "ssoLinkEmail"),
+    }
+    if id.issuer == "" || id.subject == "" {
+        return nil, false, nil
+    }
+
+    user, err := app.users.Get(r.Context(), userIDFromContext(r.Context()))
+    if err != nil {
+        return nil, false, err
+    }
+    if !strings.EqualFold(user.Email, id.email) {
+        app.dropPendingLink(r)
+        return nil, false, nil
+    }
+    return id, true, nil
+}
+
+// dropPendingLink removes the identity waiting to be linked from the
+// session.
+func (app *application) dropPendingLink(r *http.Request) {
+    app.sessionManager.Remove(r.Context(), "ssoLinkIssuer")
+    app.sessionManager.Remove(r.Context(), "ssoLinkSubject")
+    app.sessionManager.Remove(r.Context(), "ssoLinkEmail")
+}
+
+// ssoLinkForm holds what the sso_link.html page shows.
+type ssoLinkForm struct {
+    Email string
+}
+
+// The ssoLink handler asks the logged in user to confirm linking the
+// identity waiting in the session to their account.
+func (app *application) ssoLink(w http.ResponseWriter, r *http.Request) {
+    id, ok, err := app.pendingLink(r)
+    if err != nil {
+        app.serverError(w, r, err)
+        return
+    }
+    if !ok {
+        http.Redirect(w, r, "/", http.StatusSeeOther)
+        return
+    }
+
+    data := app.newTemplateData(r)
+    data.Form = ssoLinkForm{Email: id.email}
+    app.render(w, r, http.StatusOK, "sso_link.html", data)
+}
+
+// The ssoLinkPost handler links the identity waiting in the session to the
+// logged in user if they confirmed it, and forgets about it either way.
+func (app *application) ssoLinkPost(w http.ResponseWriter, r *http.Request) {
+    err := r.ParseForm()
+    if err != nil {
+        app.clientError(w, r, http.StatusBadRequest)
+        return
+    }
+    id, ok, err := app.pendingLink(r)
+    if err != nil {
+        app.serverError(w, r, err)
+        return
+    }
+    if !ok {
+        http.Redirect(w, r, "/", http.StatusSeeOther)
+        return
+    }
+    app.dropPendingLink(r)
+
+    if r.PostForm.Get("confirm") != "yes" {
+        app.sessionManager.Put(r.Context(), "flash", "Your "+app.sso.name+" login has not been linked to your account.")
+        http.Redirect(w, r, "/", http.StatusSeeOther)
+        return
+    }
+
+    err = app.users.LinkIdentity(r.Context(), userIDFromContext(r.Context()), id.issuer, id.subject)
+    if err != nil {
+        if errors.Is(err, models.ErrIdentityTaken) {
+            app.errorResponse(w, r, http.StatusConflict,
+                "This "+app.sso.name+" login already belongs to another account.", "")
+        } else {
+            app.serverError(w, r, err)
+        }
+        return
+    }
+
+    app.sessionManager.Put(r.Context(), "flash", "Your "+app.sso.name+" login has been linked. You can use it to log in from now on.")
+    http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// ssoFailed shows the login page again, saying why single sign-on didn't
+// work. The details are only logged. A user we don't let in gets a 403
+// Forbidden, an ID token which fails verification a 400 Bad Request.
+func (app *application) ssoFailed(w http.ResponseWriter, r *http.Request, err error) {
+    app.logger.Warn(err.Error(), "request_id", requestIDFromContext(r.Context()))
+
+    status := http.StatusForbidden
+    if errors.Is(err, errSSOInvalidToken) {
+        status = http.StatusBadRequest
+    }
+
+    form := userLoginForm{}
+    form.AddNonFieldError("You could not be logged in with " + app.sso.name + ". Your account may not be allowed to use this site.")
+    data := app.newTemplateData(r)
+    data.Form = form
+    app.render(w, r, status, "login.html", data)
+}
+
+// ssoUnavailable sends a 502 Bad Gateway response when the provider can't
+// be reached, or gives us something we can't use.
+func (app *application) ssoUnavailable(w http.ResponseWriter, r *http.Request, err error) {
+    if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+        app.serverError(w, r, err)
+        return
+    }
+    requestID := requestIDFromContext(r.Context())
+    app.logger.Error(err.Error(), "request_id", requestID)
+    app.errorResponse(w, r, http.StatusBadGateway,
+        "Single sign-on isn't working at the moment. Please try again later.", requestID)
+}
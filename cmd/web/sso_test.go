@@ -0,0 +1,642 @@
+package main
+
+import (
+    "context"
+    "crypto"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "log/slog"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/cpucortexm/chunkbox/internal/assert"
+    "github.com/cpucortexm/chunkbox/internal/models/mocks"
+)
+
+// fakeIdP is a stand-in OpenID Connect provider. It serves a discovery
+// document, its signing key and a token endpoint, all from httptest. The
+// authorization endpoint is never visited: a test reads the parameters our
+// ssoLogin handler put in the redirect to it, and calls authorize to get
+// the code the provider would have sent the user back with.
+type fakeIdP struct {
+    *httptest.Server
+    clientID     string
+    clientSecret string
+    key          *rsa.PrivateKey
+    keyID        string
+
+    // signWith, if set, signs the ID tokens in place of the published key.
+    signWith *rsa.PrivateKey
+
+    discoveries atomic.Int32 // requests for the discovery document
+    keyFetches  atomic.Int32 // requests for the keys
+
+    mu    sync.Mutex
+    codes map[string]authorization
+}
+
+// authorization is what the provider remembers about a code it handed
+// out, until it is exchanged for tokens.
+type authorization struct {
+    challenge string
+    nonce     string
+    claims    map[string]any
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+    t.Helper()
+
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    idp := &fakeIdP{
+        clientID:     "chunkbox",
+        clientSecret: "s3cret",
+        key:          key,
+        keyID:        "test-key",
+        codes:        make(map[string]authorization),
+    }
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+    mux.HandleFunc("/keys", idp.keys)
+    mux.HandleFunc("/token", idp.token)
+    idp.Server = httptest.NewServer(mux)
+    t.Cleanup(idp.Close)
+    return idp
+}
+
+func (idp *fakeIdP) discovery(w http.ResponseWriter, r *http.Request) {
+    idp.discoveries.Add(1)
+    writeJSON(w, http.StatusOK, map[string]any{
+        "issuer":                                idp.URL,
+        "authorization_endpoint":                idp.URL + "/authorize",
+        "token_endpoint":                        idp.URL + "/token",
+        "jwks_uri":                              idp.URL + "/keys",
+        "response_types_supported":              []string{"code"},
+        "subject_types_supported":               []string{"public"},
+        "id_token_signing_alg_values_supported": []string{"RS256"},
+        "code_challenge_methods_supported":      []string{"S256"},
+    })
+}
+
+func (idp *fakeIdP) keys(w http.ResponseWriter, r *http.Request) {
+    idp.keyFetches.Add(1)
+    writeJSON(w, http.StatusOK, map[string]any{
+        "keys": []map[string]string{{
+            "kty": "RSA",
+            "use": "sig",
+            "alg": "RS256",
+            "kid": idp.keyID,
+            "n":   b64(idp.key.N.Bytes()),
+            "e":   b64(big.NewInt(int64(idp.key.E)).Bytes()),
+        }},
+    })
+}
+
+// authorize plays the part of the authorization endpoint: it checks the
+// parameters of the redirect our ssoLogin handler sent the user to, and
+// returns a code for a user with the given claims. Claims set to nil are
+// left out of the ID token.
+func (idp *fakeIdP) authorize(t *testing.T, params url.Values, claims map[string]any) string {
+    t.Helper()
+
+    assert.Equal(t, params.Get("response_type"), "code")
+    assert.Equal(t, params.Get("client_id"), idp.clientID)
+    assert.Equal(t, params.Get("code_challenge_method"), "S256")
+    if params.Get("state") == "" || params.Get("nonce") == "" || params.Get("code_challenge") == "" {
+        t.Fatalf("missing state, nonce or code_challenge in %v", params)
+    }
+
+    code := b64([]byte(time.Now().String() + params.Get("state")))
+    idp.mu.Lock()
+    idp.codes[code] = authorization{
+        challenge: params.Get("code_challenge"),
+        nonce:     params.Get("nonce"),
+        claims:    claims,
+    }
+    idp.mu.Unlock()
+    return code
+}
+
+// token exchanges a code for an ID token, checking the client and the
+// PKCE verifier like a real provider would.
+func (idp *fakeIdP) token(w http.ResponseWriter, r *http.Request) {
+    err := r.ParseForm()
+    if err != nil {
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+        return
+    }
+    clientID, clientSecret, ok := r.BasicAuth()
+    if !ok {
+        clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+    }
+    if clientID != idp.clientID || clientSecret != idp.clientSecret {
+        writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+        return
+    }
+
+    idp.mu.Lock()
+    auth, ok := idp.codes[r.PostForm.Get("code")]
+    delete(idp.codes, r.PostForm.Get("code"))
+    idp.mu.Unlock()
+
+    sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+    if !ok || r.PostForm.Get("grant_type") != "authorization_code" || b64(sum[:]) != auth.challenge {
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+        return
+    }
+
+    now := time.Now()
+    claims := map[string]any{
+        "iss":   idp.URL,
+        "aud":   idp.clientID,
+        "iat":   now.Unix(),
+        "exp":   now.Add(time.Hour).Unix(),
+        "nonce": auth.nonce,
+    }
+    for name, value := range auth.claims {
+        if value == nil {
+            delete(claims, name)
+        } else {
+            claims[name] = value
+        }
+    }
+
+    writeJSON(w, http.StatusOK, map[string]any{
+        "access_token": "access-token",
+        "token_type":   "Bearer",
+        "expires_in":   3600,
+        "id_token":     idp.sign(claims),
+    })
+}
+
+// sign returns the claims as a JWT signed with RS256.
+func (idp *fakeIdP) sign(claims map[string]any) string {
+    header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": idp.keyID})
+    payload, _ := json.Marshal(claims)
+    signingInput := b64(header) + "." + b64(payload)
+
+    key := idp.key
+    if idp.signWith != nil {
+        key = idp.signWith
+    }
+    sum := sha256.Sum256([]byte(signingInput))
+    signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+    if err != nil {
+        panic(err)
+    }
+    return signingInput + "." + b64(signature)
+}
+
+func b64(b []byte) string {
+    return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
+
+// ssoTest is an application with single sign-on through a fake provider.
+type ssoTest struct {
+    idp   *fakeIdP
+    users *mocks.UserModel
+    ts    *testServer
+    logs  *logBuffer
+}
+
+func newSSOTest(t *testing.T, allowedDomains ...string) *ssoTest {
+    t.Helper()
+
+    idp := newFakeIdP(t)
+    cfg := defaultConfig()
+    cfg.OIDC.Issuer = idp.URL
+    cfg.OIDC.Name = "Example SSO"
+    cfg.OIDC.ClientID = idp.clientID
+    cfg.OIDC.ClientSecret = idp.clientSecret
+    cfg.OIDC.RedirectURL = "http://chunkbox.test/user/login/sso/callback"
+    cfg.OIDC.AllowedDomains = allowedDomains
+
+    logs := &logBuffer{}
+    app := newTestApplication(t)
+    app.logger = slog.New(slog.NewTextHandler(logs, nil))
+    app.sso = newSSOProvider(cfg, idp.Client())
+    return &ssoTest{
+        idp:   idp,
+        users: app.users.(*mocks.UserModel),
+        ts:    newTestServer(t, app.routes()),
+        logs:  logs,
+    }
+}
+
+// startLogin follows the login button, and returns the parameters of the
+// redirect to the provider.
+func (st *ssoTest) startLogin(t *testing.T) url.Values {
+    t.Helper()
+
+    code, header, _ := st.ts.get(t, "/user/login/sso")
+    assert.Equal(t, code, http.StatusFound)
+    location, err := url.Parse(header.Get("Location"))
+    assert.NilError(t, err)
+    assert.Equal(t, location.Scheme+"://"+location.Host+location.Path, st.idp.URL+"/authorize")
+    return location.Query()
+}
+
+// callback comes back from the provider with the code and state.
+func (st *ssoTest) callback(t *testing.T, code, state string) (int, http.Header, string) {
+    t.Helper()
+
+    return st.ts.get(t, "/user/login/sso/callback?"+url.Values{"code": {code}, "state": {state}}.Encode())
+}
+
+// login logs in through the provider as the user with the claims.
+func (st *ssoTest) login(t *testing.T, claims map[string]any) (int, http.Header, string) {
+    t.Helper()
+
+    params := st.startLogin(t)
+    return st.callback(t, st.idp.authorize(t, params, claims), params.Get("state"))
+}
+
+// loggedIn reports whether the test client is logged in. The link page is
+// only for logged in users, and sends them home when there is nothing to
+// link.
+func (st *ssoTest) loggedIn(t *testing.T) bool {
+    t.Helper()
+
+    code, header, _ := st.ts.get(t, "/user/login/sso/link")
+    assert.Equal(t, code, http.StatusSeeOther)
+    return header.Get("Location") == "/"
+}
+
+// aliceClaims returns the claims of a user whose email address the provider has
+// verified.
+func aliceClaims() map[string]any {
+    return map[string]any{
+        "sub":            "alice-123",
+        "email":          "alice@example.com",
+        "email_verified": true,
+        "name":           "Alice",
+    }
+}
+
+func TestSSOFirstLogin(t *testing.T) {
+    st := newSSOTest(t)
+
+    code, header, _ := st.login(t, aliceClaims())
+    assert.Equal(t, code, http.StatusSeeOther)
+    assert.Equal(t, header.Get("Location"), "/")
+    assert.Equal(t, st.loggedIn(t), true)
+
+    // The user was created, and linked to the identity.
+    assert.Equal(t, st.users.Count(), 1)
+    id := st.users.Identity(st.idp.URL, "alice-123")
+    assert.Equal(t, id, 1)
+    user, err := st.users.Get(context.Background(), id)
+    assert.NilError(t, err)
+    assert.Equal(t, user.Email, "alice@example.com")
+    assert.Equal(t, user.Name, "Alice")
+
+    // The provider was discovered once, and its keys fetched to check the
+    // signature.
+    assert.Equal(t, st.idp.discoveries.Load(), int32(1))
+    assert.Equal(t, st.idp.keyFetches.Load() >= 1, true)
+
+    // Logging in again gets the same user, and doesn't discover the
+    // provider again.
+    st.ts.resetCookies(t)
+    code, _, _ = st.login(t, aliceClaims())
+    assert.Equal(t, code, http.StatusSeeOther)
+    assert.Equal(t, st.loggedIn(t), true)
+    assert.Equal(t, st.users.Count(), 1)
+    assert.Equal(t, st.idp.discoveries.Load(), int32(1))
+}
+
+func TestSSOFirstLoginWithoutName(t *testing.T) {
+    st := newSSOTest(t)
+
+    claims := aliceClaims()
+    claims["name"] = nil
+    code, _, _ := st.login(t, claims)
+    assert.Equal(t, code, http.StatusSeeOther)
+
+    user, err := st.users.Get(context.Background(), 1)
+    assert.NilError(t, err)
+    assert.Equal(t, user.Name, "alice")
+}
+
+func TestSSOSignature(t *testing.T) {
+    st := newSSOTest(t)
+
+    // A token signed with a key the provider didn't publish is rejected.
+    forger, err := rsa.GenerateKey(rand.Reader, 2048)
+    assert.NilError(t, err)
+    st.idp.signWith = forger
+
+    code, _, body := st.login(t, aliceClaims())
+    assert.Equal(t, code, http.StatusBadRequest)
+    assert.StringContains(t, body, "You could not be logged in with Example SSO")
+    assert.Equal(t, st.loggedIn(t), false)
+    assert.Equal(t, st.users.Count(), 0)
+
+    // It is logged as a warning, not as an error of ours.
+    assert.StringContains(t, st.logs.String(), `level=WARN msg="sso: invalid id_token: failed to verify signature`)
+}
+
+func TestSSOTokenClaims(t *testing.T) {
+    tests := []struct {
+        name   string
+        claims map[string]any
+    }{
+        {name: "Other issuer", claims: map[string]any{"iss": "https://evil.example.com"}},
+        {name: "Other audience", claims: map[string]any{"aud": "someone-else"}},
+        {name: "Expired", claims: map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            st := newSSOTest(t)
+
+            claims := aliceClaims()
+            for name, value := range tt.claims {
+                claims[name] = value
+            }
+            code, _, _ := st.login(t, claims)
+            assert.Equal(t, code, http.StatusBadRequest)
+            assert.Equal(t, st.loggedIn(t), false)
+            assert.Equal(t, st.users.Count(), 0)
+            assert.StringContains(t, st.logs.String(), `level=WARN msg="sso: invalid id_token`)
+        })
+    }
+}
+
+func TestSSOState(t *testing.T) {
+    st := newSSOTest(t)
+
+    params := st.startLogin(t)
+    authCode := st.idp.authorize(t, params, aliceClaims())
+
+    // A callback with the wrong state is turned away, and uses up the
+    // state in the session, so the right one doesn't work afterwards
+    // either.
+    code, _, body := st.callback(t, authCode, "not-the-state")
+    assert.Equal(t, code, http.StatusBadRequest)
+    assert.StringContains(t, body, "Your login has expired")
+    code, _, _ = st.callback(t, authCode, params.Get("state"))
+    assert.Equal(t, code, http.StatusBadRequest)
+    assert.Equal(t, st.loggedIn(t), false)
+
+    // So is a callback in a browser which never started the login, even
+    // with the right state.
+    params = st.startLogin(t)
+    authCode = st.idp.authorize(t, params, aliceClaims())
+    st.ts.resetCookies(t)
+    code, _, _ = st.callback(t, authCode, params.Get("state"))
+    assert.Equal(t, code, http.StatusBadRequest)
+    assert.Equal(t, st.users.Count(), 0)
+}
+
+func TestSSONonce(t *testing.T) {
+    st := newSSOTest(t)
+
+    // An ID token issued for another login has the wrong nonce.
+    params := st.startLogin(t)
+    params.Set("nonce", "another-login")
+    code, _, body := st.callback(t, st.idp.authorize(t, params, aliceClaims()), params.Get("state"))
+    assert.Equal(t, code, http.StatusBadRequest)
+    assert.StringContains(t, body, "You could not be logged in with Example SSO")
+    assert.Equal(t, st.loggedIn(t), false)
+    assert.StringContains(t, st.logs.String(), `level=WARN msg="sso: invalid id_token: nonce does not match"`)
+
+    // And one without a nonce at all is no better.
+    claims := aliceClaims()
+    claims["nonce"] = nil
+    code, _, _ = st.login(t, claims)
+    assert.Equal(t, code, http.StatusBadRequest)
+    assert.Equal(t, st.users.Count(), 0)
+    assert.Equal(t, strings.Contains(st.logs.String(), "level=ERROR"), false)
+}
+
+func TestSSOPKCE(t *testing.T) {
+    st := newSSOTest(t)
+
+    // A code handed out for another login's challenge can't be exchanged
+    // with this login's verifier, so a stolen code is no use.
+    other := st.startLogin(t)
+    params := st.startLogin(t)
+    params.Set("code_challenge", other.Get("code_challenge"))
+    code, _, _ := st.callback(t, st.idp.authorize(t, params, aliceClaims()), params.Get("state"))
+    assert.Equal(t, code, http.StatusBadGateway)
+    assert.Equal(t, st.loggedIn(t), false)
+    assert.Equal(t, st.users.Count(), 0)
+}
+
+func TestSSOProviderError(t *testing.T) {
+    st := newSSOTest(t)
+
+    params := st.startLogin(t)
+    query := url.Values{"error": {"access_denied"}, "state": {params.Get("state")}}
+    code, _, body := st.ts.get(t, "/user/login/sso/callback?"+query.Encode())
+    assert.Equal(t, code, http.StatusForbidden)
+    assert.StringContains(t, body, "You could not be logged in with Example SSO")
+}
+
+func TestSSOEmailVerified(t *testing.T) {
+    tests := []struct {
+        name     string
+        verified any
+        wantCode int
+    }{
+        {name: "Verified", verified: true, wantCode: http.StatusSeeOther},
+        {name: "Not verified", verified: false, wantCode: http.StatusForbidden},
+        {name: "Claim missing", verified: nil, wantCode: http.StatusForbidden},
+        {name: "Claim is a string", verified: "true", wantCode: http.StatusForbidden},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            st := newSSOTest(t)
+            st.users.AddUser("Real Alice", "alice@example.com", "pa55word")
+
+            claims := aliceClaims()
+            claims["email"] = "alice@example.org"
+            claims["email_verified"] = tt.verified
+            code, _, _ := st.login(t, claims)
+            assert.Equal(t, code, tt.wantCode)
+            assert.Equal(t, st.loggedIn(t), tt.wantCode == http.StatusSeeOther)
+
+            // Whatever the provider says, an identity with the address of a
+            // password account isn't linked to it straight away.
+            claims["sub"] = "alice-456"
+            claims["email"] = "alice@example.com"
+            st.ts.resetCookies(t)
+            code, _, _ = st.login(t, claims)
+            if tt.wantCode == http.StatusSeeOther {
+                assert.Equal(t, code, http.StatusConflict)
+            } else {
+                assert.Equal(t, code, http.StatusForbidden)
+            }
+            assert.Equal(t, st.loggedIn(t), false)
+            assert.Equal(t, st.users.Identity(st.idp.URL, "alice-456"), 0)
+        })
+    }
+}
+
+func TestSSOAllowedDomains(t *testing.T) {
+    tests := []struct {
+        name     string
+        email    string
+        wantCode int
+    }{
+        {name: "Allowed", email: "alice@example.com", wantCode: http.StatusSeeOther},
+        {name: "Allowed in other case", email: "alice@EXAMPLE.com", wantCode: http.StatusSeeOther},
+        {name: "Second domain", email: "alice@example.net", wantCode: http.StatusSeeOther},
+        {name: "Other domain", email: "alice@evil.com", wantCode: http.StatusForbidden},
+        {name: "Subdomain", email: "alice@mail.example.com", wantCode: http.StatusForbidden},
+        {name: "Suffix", email: "alice@badexample.com", wantCode: http.StatusForbidden},
+        {name: "Domain in the local part", email: "example.com@evil.com", wantCode: http.StatusForbidden},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            st := newSSOTest(t, "example.com", "example.net")
+
+            claims := aliceClaims()
+            claims["email"] = tt.email
+            code, _, _ := st.login(t, claims)
+            assert.Equal(t, code, tt.wantCode)
+            assert.Equal(t, st.loggedIn(t), tt.wantCode == http.StatusSeeOther)
+            if tt.wantCode != http.StatusSeeOther {
+                assert.Equal(t, st.users.Count(), 0)
+            }
+        })
+    }
+}
+
+func TestSSODisabledUser(t *testing.T) {
+    st := newSSOTest(t)
+
+    code, _, _ := st.login(t, aliceClaims())
+    assert.Equal(t, code, http.StatusSeeOther)
+    err := st.users.SetDisabled(context.Background(), 1, true)
+    assert.NilError(t, err)
+
+    // The disabled user is logged out, and can't log in again.
+    assert.Equal(t, st.loggedIn(t), false)
+    code, _, body := st.login(t, aliceClaims())
+    assert.Equal(t, code, http.StatusForbidden)
+    assert.StringContains(t, body, "You could not be logged in with Example SSO")
+    assert.Equal(t, st.loggedIn(t), false)
+
+    // Nor can they get in through a new identity with the same address.
+    claims := aliceClaims()
+    claims["sub"] = "alice-456"
+    code, _, _ = st.login(t, claims)
+    assert.Equal(t, code, http.StatusForbidden)
+    assert.Equal(t, st.users.Identity(st.idp.URL, "alice-456"), 0)
+}
+
+
+func TestSSOExistingPasswordAccount(t *testing.T) {
+    st := newSSOTest(t)
+    id := st.users.AddUser("Alice", "alice@example.com", "pa55word")
+
+    // The provider alone doesn't get anyone into an account with a
+    // password. They are asked to log in with the password instead.
+    code, _, body := st.login(t, aliceClaims())
+    assert.Equal(t, code, http.StatusConflict)
+    assert.StringContains(t, body, "There is already an account for alice@example.com")
+    assert.Equal(t, st.loggedIn(t), false)
+    assert.Equal(t, st.users.Identity(st.idp.URL, "alice-123"), 0)
+
+    // Once they have, they are asked to confirm the link.
+    _, _, body = st.ts.get(t, "/user/login")
+    code, header, _ := st.ts.postForm(t, "/user/login", url.Values{
+        "email":      {"alice@example.com"},
+        "password":   {"pa55word"},
+        "csrf_token": {extractCSRFToken(t, body)},
+    })
+    assert.Equal(t, code, http.StatusSeeOther)
+    assert.Equal(t, header.Get("Location"), "/user/login/sso/link")
+
+    code, _, body = st.ts.get(t, "/user/login/sso/link")
+    assert.Equal(t, code, http.StatusOK)
+    assert.StringContains(t, body, "<strong>alice@example.com</strong>")
+    assert.Equal(t, st.users.Identity(st.idp.URL, "alice-123"), 0)
+
+    code, header, _ = st.ts.postForm(t, "/user/login/sso/link", url.Values{
+        "confirm":    {"yes"},
+        "csrf_token": {extractCSRFToken(t, body)},
+    })
+    assert.Equal(t, code, http.StatusSeeOther)
+    assert.Equal(t, header.Get("Location"), "/")
+    assert.Equal(t, st.users.Identity(st.idp.URL, "alice-123"), id)
+
+    // From then on the provider logs them straight in.
+    st.ts.resetCookies(t)
+    code, header, _ = st.login(t, aliceClaims())
+    assert.Equal(t, code, http.StatusSeeOther)
+    assert.Equal(t, header.Get("Location"), "/")
+    assert.Equal(t, st.loggedIn(t), true)
+    assert.Equal(t, st.users.Count(), 1)
+}
+
+func TestSSOLinkDeclined(t *testing.T) {
+    st := newSSOTest(t)
+    st.users.AddUser("Alice", "alice@example.com", "pa55word")
+
+    code, _, _ := st.login(t, aliceClaims())
+    assert.Equal(t, code, http.StatusConflict)
+
+    _, _, body := st.ts.get(t, "/user/login")
+    st.ts.postForm(t, "/user/login", url.Values{
+        "email":      {"alice@example.com"},
+        "password":   {"pa55word"},
+        "csrf_token": {extractCSRFToken(t, body)},
+    })
+    _, _, body = st.ts.get(t, "/user/login/sso/link")
+    code, _, _ = st.ts.postForm(t, "/user/login/sso/link", url.Values{
+        "confirm":    {"no"},
+        "csrf_token": {extractCSRFToken(t, body)},
+    })
+    assert.Equal(t, code, http.StatusSeeOther)
+    assert.Equal(t, st.users.Identity(st.idp.URL, "alice-123"), 0)
+
+    // Nothing is left waiting to be linked.
+    code, header, _ := st.ts.get(t, "/user/login/sso/link")
+    assert.Equal(t, code, http.StatusSeeOther)
+    assert.Equal(t, header.Get("Location"), "/")
+}
+
+func TestSSOLinkOtherAccount(t *testing.T) {
+    st := newSSOTest(t)
+    st.users.AddUser("Alice", "alice@example.com", "pa55word")
+    st.users.AddUser("Bob", "bob@example.com", "b0bpassword")
+
+    // Logging in to another account doesn't link Alice's identity to it.
+    code, _, _ := st.login(t, aliceClaims())
+    assert.Equal(t, code, http.StatusConflict)
+
+    _, _, body := st.ts.get(t, "/user/login")
+    st.ts.postForm(t, "/user/login", url.Values{
+        "email":      {"bob@example.com"},
+        "password":   {"b0bpassword"},
+        "csrf_token": {extractCSRFToken(t, body)},
+    })
+    code, header, _ := st.ts.get(t, "/user/login/sso/link")
+    assert.Equal(t, code, http.StatusSeeOther)
+    assert.Equal(t, header.Get("Location"), "/")
+    assert.Equal(t, st.users.Identity(st.idp.URL, "alice-123"), 0)
+}
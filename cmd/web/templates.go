@@ -6,9 +6,13 @@
 package main
 
 import(
+    "fmt"
     "html/template"
-    "path/filepath"
+    "io/fs"
+    "path"
     "time"
+    "github.com/cpucortexm/chunkbox/internal/highlight"
+    "github.com/cpucortexm/chunkbox/internal/markdown"
     "github.com/cpucortexm/chunkbox/internal/models"
  )
 // Define a templateData type to act as the holding structure for
@@ -17,6 +21,95 @@ type templateData struct {
     CurrentYear int
     Chunk *models.Chunk
     Chunks []*models.Chunk // Chunks field for holding a slice of chunks
+    Forks []*models.Chunk // Forks of the chunk being viewed
+    Form any // Form holds the values and errors of a submitted form
+    Languages []highlight.Language // Languages offered in the create form
+    ShowSource bool // Show the source of a Markdown chunk instead of rendering it
+    Error *errorData // The error shown by error.html
+    Features features // The optional features which are switched on
+    Usage *usageData // The usage shown by usage.html
+    Flash string // A message for the user, shown once
+    IsAuthenticated bool // Whether the user is logged in
+    UserID int // The ID of the logged in user, or 0
+    CSRFToken string // The token every POST form must include
+    Tokens []*models.Token // The user's API tokens, shown by tokens.html
+    NewToken string // A token which was just created, shown just this once
+    Scopes []string // The scopes an API token can have
+    SSOName string // The name of the single sign-on provider, if there is one
+    CanModerate bool // Whether the user is a moderator or admin
+    IsAdmin bool // Whether the user is an admin
+    Users []*models.User // The users listed in the admin area
+    Roles []string // The roles a user can have
+    Query string // The search query of a list
+    Page int // The page of a list, starting at 1
+    MorePages bool // Whether a list has more pages
+    ExtendDays []int // The numbers of days a chunk can be extended by
+    Stats *statsData // The stats shown by admin_stats.html
+    Workspaces []*models.Workspace // The workspaces the user belongs to
+    Workspace *models.Workspace // The workspace being shown
+    Members []*models.Member // The members of the workspace
+    WorkspaceRoles []string // The roles a member of a workspace can have
+    Grants []*models.Grant // Who the chunk being viewed is shared with
+    Permissions []string // The permissions a grant can give
+}
+
+// errorData describes an error response. It is shown on the error.html page
+// and sent as JSON to clients which ask for it. RequestID is only set for
+// server errors.
+type errorData struct {
+    Status    int    `json:"status"`
+    Title     string `json:"-"`
+    Message   string `json:"message"`
+    RequestID string `json:"request_id,omitempty"`
+    Usage     *usageData `json:"usage,omitempty"` // Set when a quota is exceeded
+    Fields    map[string]string `json:"fields,omitempty"` // What is wrong with each field, for the API
+}
+
+// usageData describes the live chunks someone has, and their quota. A zero
+// maximum means there is no limit.
+type usageData struct {
+    LoggedIn  bool  `json:"logged_in"`
+    Chunks    int   `json:"chunks"`
+    MaxChunks int   `json:"max_chunks"`
+    Bytes     int64 `json:"bytes"`
+    MaxBytes  int64 `json:"max_bytes"`
+}
+
+// statsData holds the system stats for admins.
+type statsData struct {
+    Chunks struct {
+        Live    int `json:"live"`
+        Expired int `json:"expired"`
+    } `json:"chunks"`
+    Users struct {
+        Total    int `json:"total"`
+        Disabled int `json:"disabled"`
+    } `json:"users"`
+    DB dbStats `json:"db"`
+}
+
+// dbStats is the part of sql.DBStats we show, see there for what it means.
+type dbStats struct {
+    MaxOpenConnections int    `json:"max_open_connections"`
+    OpenConnections    int    `json:"open_connections"`
+    InUse              int    `json:"in_use"`
+    Idle               int    `json:"idle"`
+    WaitCount          int64  `json:"wait_count"`
+    WaitDuration       string `json:"wait_duration"`
+    MaxIdleClosed      int64  `json:"max_idle_closed"`
+    MaxIdleTimeClosed  int64  `json:"max_idle_time_closed"`
+    MaxLifetimeClosed  int64  `json:"max_lifetime_closed"`
+}
+
+// newUsageData combines the usage of an owner with their quota.
+func newUsageData(owner models.Owner, u models.Usage, q models.Quota) *usageData {
+    return &usageData{
+        LoggedIn:  owner.UserID != 0,
+        Chunks:    u.Chunks,
+        MaxChunks: q.MaxChunks,
+        Bytes:     u.Bytes,
+        MaxBytes:  q.MaxBytes,
+    }
 }
 
 // Create a humanDate function which returns a nicely formatted string
@@ -25,22 +118,56 @@ func humanDate(t time.Time) string {
     return t.Format("02 Jan 2006 at 15:04")
 }
 
+// humanBytes returns a size in bytes in the largest unit which keeps it at
+// 1 or more, like "1.5 MB".
+func humanBytes(n int64) string {
+    const unit = 1024
+    if n < unit {
+        return fmt.Sprintf("%d bytes", n)
+    }
+    div, exp := int64(unit), 0
+    for m := n / unit; m >= unit && exp < 3; m /= unit {
+        div *= unit
+        exp++
+    }
+    return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGT"[exp])
+}
+
+// anchorPrefix returns the prefix of the line anchors for the file at the
+// given position in a chunk. The first file keeps the plain #L12 form, so
+// that links to single file chunks stay short, later files get #F2-L12 and
+// so on.
+func anchorPrefix(position int) string {
+    if position == 0 {
+        return "L"
+    }
+    return fmt.Sprintf("F%d-L", position+1)
+}
+
 // Initialize a template.FuncMap object and store it in a global variable. This is
 // essentially a string-keyed map which acts as a lookup between the names of 
 // custom template functions and the functions themselves.
 var functions = template.FuncMap{
     "humanDate": humanDate,
+    "humanBytes": humanBytes,
+    "highlight": highlight.HTML,
+    "highlightLines": highlight.LineNumberedHTML,
+    "anchorPrefix": anchorPrefix,
+    "markdown": markdown.Render,
+    "add": func(a, b int) int { return a + b },
 }
 
-func newTemplateCache() (map[string]*template.Template, error){
+// newTemplateCache parses the templates in the ui file system, which is
+// either the embedded ui.Files or a directory on disk (see the -ui-dir flag).
+func newTemplateCache(uiFS fs.FS) (map[string]*template.Template, error){
     // Initialize a new map to act as the cache.
     cache := map[string]*template.Template{}
 
-    // Use the filepath.Glob() function to get a slice of all filepaths that
-    // match the pattern "./ui/html/pages/*.html". This will essentially gives
-    // us a slice of all the filepaths for our application 'page' templates
-    // like: [ui/html/pages/home.html ui/html/pages/view.html]
-    pages, err := filepath.Glob("./ui/html/pages/*.html")
+    // Use the fs.Glob() function to get a slice of all filepaths in the ui
+    // file system that match the pattern "html/pages/*.html". This will
+    // essentially gives us a slice of all the filepaths for our application
+    // 'page' templates like: [html/pages/home.html html/pages/view.html]
+    pages, err := fs.Glob(uiFS, "html/pages/*.html")
 
     if err != nil {
         return nil, err
@@ -49,25 +176,21 @@ func newTemplateCache() (map[string]*template.Template, error){
     for _, page := range pages {
         // Extract the file name (like 'home.html') from the full filepath
         // and assign it to the name variable.
-        name := filepath.Base(page)
-        // The template.FuncMap must be registered with the template set before you
-        // call the ParseFiles() method. This means we have to use template.New() to
-        // create an empty template set, use the Funcs() method to register the
-        // template.FuncMap, and then parse the file as normal.
-        ts, err := template.New(name).Funcs(functions).ParseFiles("./ui/html/base.html")
-        if err != nil {
-            return nil, err
-        }
-        // Call ParseGlob() *on this template set* to add any partials.
+        name := path.Base(page)
 
-        ts, err = ts.ParseGlob("./ui/html/partials/*.html")
-        
-        if err != nil {
-            return nil, err
+        // Create a slice containing the filepath patterns for the templates we
+        // want to parse: the base template, any partials, and the page itself.
+        patterns := []string{
+            "html/base.html",
+            "html/partials/*.html",
+            page,
         }
-    
-        // Call ParseFiles() *on this template set* to add the  page template.
-        ts, err = ts.ParseFiles(page)
+
+        // The template.FuncMap must be registered with the template set before you
+        // call the ParseFS() method. This means we have to use template.New() to
+        // create an empty template set, use the Funcs() method to register the
+        // template.FuncMap, and then parse the files as normal.
+        ts, err := template.New(name).Funcs(functions).ParseFS(uiFS, patterns...)
         if err != nil {
             return nil, err
         }
@@ -77,4 +200,3 @@ func newTemplateCache() (map[string]*template.Template, error){
     }
     return cache, nil
 }
-
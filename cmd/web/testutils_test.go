@@ -0,0 +1,221 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "database/sql"
+    "html"
+    "io"
+    "log/slog"
+    "net/http"
+    "net/http/cookiejar"
+    "net/http/httptest"
+    "net/url"
+    "os"
+    "regexp"
+    "sync"
+    "testing"
+
+    "github.com/alexedwards/scs/v2"
+    "github.com/cpucortexm/chunkbox/internal/models"
+    "github.com/cpucortexm/chunkbox/internal/models/mocks"
+    "github.com/cpucortexm/chunkbox/ui"
+)
+
+// newTestApplication returns an application with the embedded templates,
+// an in-memory session store and a mock user model. Tests set up whatever
+// else the routes they call need.
+func newTestApplication(t *testing.T) *application {
+    t.Helper()
+
+    templateCache, err := newTemplateCache(ui.Files)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+    return &application{
+        logger:         logger,
+        users:          &mocks.UserModel{},
+        sessionManager: scs.New(),
+        templateCache:  templateCache,
+        uiFS:           ui.Files,
+        features:       defaultConfig().Features,
+        metrics:        newMetrics(nil, nil, logger),
+    }
+}
+
+// logBuffer collects log output. The handlers of a test server log from
+// their own goroutines, so it is guarded by a mutex.
+type logBuffer struct {
+    mu  sync.Mutex
+    buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.String()
+}
+
+// testServer is an httptest.Server with a client which keeps cookies, so
+// that it has a session, and doesn't follow redirects, so that the tests
+// can see them.
+type testServer struct {
+    *httptest.Server
+}
+
+func newTestServer(t *testing.T, h http.Handler) *testServer {
+    ts := &testServer{httptest.NewServer(h)}
+    t.Cleanup(ts.Close)
+
+    ts.resetCookies(t)
+    ts.Client().CheckRedirect = func(req *http.Request, via []*http.Request) error {
+        return http.ErrUseLastResponse
+    }
+    return ts
+}
+
+// resetCookies gives the client an empty cookie jar, as if it were a new
+// browser.
+func (ts *testServer) resetCookies(t *testing.T) {
+    t.Helper()
+
+    jar, err := cookiejar.New(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ts.Client().Jar = jar
+}
+
+// get sends a GET request for the URL path (or full URL) and returns the
+// status, headers and body of the response.
+func (ts *testServer) get(t *testing.T, urlPath string) (int, http.Header, string) {
+    t.Helper()
+
+    u := urlPath
+    if len(u) > 0 && u[0] == '/' {
+        u = ts.URL + u
+    }
+    rs, err := ts.Client().Get(u)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return readResponse(t, rs)
+}
+
+// postForm sends a POST request with the form to the URL path, and returns
+// the status, headers and body of the response.
+func (ts *testServer) postForm(t *testing.T, urlPath string, form url.Values) (int, http.Header, string) {
+    t.Helper()
+
+    rs, err := ts.Client().PostForm(ts.URL+urlPath, form)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return readResponse(t, rs)
+}
+
+func readResponse(t *testing.T, rs *http.Response) (int, http.Header, string) {
+    t.Helper()
+
+    defer rs.Body.Close()
+    body, err := io.ReadAll(rs.Body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return rs.StatusCode, rs.Header, string(bytes.TrimSpace(body))
+}
+
+var csrfTokenRX = regexp.MustCompile(`<input type='hidden' name='csrf_token' value='(.+)'>`)
+
+// extractCSRFToken returns the CSRF token from a page with a form.
+func extractCSRFToken(t *testing.T, body string) string {
+    t.Helper()
+
+    matches := csrfTokenRX.FindStringSubmatch(body)
+    if len(matches) < 2 {
+        t.Fatal("no csrf token found in body")
+    }
+    return html.UnescapeString(matches[1])
+}
+
+// newTestDB connects to the test database named by the CHUNKBOX_TEST_DSN
+// environment variable and migrates it, for the handlers which can't do
+// without one. Every table is dropped when the test finishes, so it must be
+// a database which is used for nothing else. Without the variable the test
+// is skipped.
+func newTestDB(t *testing.T) *sql.DB {
+    t.Helper()
+
+    dsn := os.Getenv("CHUNKBOX_TEST_DSN")
+    if dsn == "" {
+        t.Skip("CHUNKBOX_TEST_DSN isn't set")
+    }
+
+    db, err := sql.Open("mysql", dsn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    dropTestTables(t, db)
+    t.Cleanup(func() {
+        dropTestTables(t, db)
+        db.Close()
+    })
+
+    _, err = (&models.MigrationModel{DB: db}).Migrate(context.Background())
+    if err != nil {
+        t.Fatal(err)
+    }
+    return db
+}
+
+// dropTestTables drops every table in the test database, with the foreign
+// key checks turned off so that the order doesn't matter.
+func dropTestTables(t *testing.T, db *sql.DB) {
+    t.Helper()
+
+    ctx := context.Background()
+    conn, err := db.Conn(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    rows, err := conn.QueryContext(ctx, `SELECT table_name FROM information_schema.tables
+    WHERE table_schema = DATABASE()`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var tables []string
+    for rows.Next() {
+        var table string
+        err = rows.Scan(&table)
+        if err != nil {
+            t.Fatal(err)
+        }
+        tables = append(tables, table)
+    }
+    rows.Close()
+    if err = rows.Err(); err != nil {
+        t.Fatal(err)
+    }
+
+    stmts := []string{"SET FOREIGN_KEY_CHECKS = 0"}
+    for _, table := range tables {
+        stmts = append(stmts, "DROP TABLE `"+table+"`")
+    }
+    stmts = append(stmts, "SET FOREIGN_KEY_CHECKS = 1")
+    for _, stmt := range stmts {
+        _, err = conn.ExecContext(ctx, stmt)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+}
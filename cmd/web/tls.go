@@ -0,0 +1,120 @@
+package main
+
+import (
+    "crypto/tls"
+    "log/slog"
+    "net"
+    "net/http"
+    "os"
+    "os/signal"
+    "strings"
+    "sync"
+    "syscall"
+)
+
+// certReloader holds the TLS certificate and key, and loads them again
+// from disk when the process gets a SIGHUP. That way a renewed certificate
+// can be picked up without dropping any connections.
+type certReloader struct {
+    certFile string
+    keyFile  string
+
+    mu   sync.RWMutex
+    cert *tls.Certificate
+}
+
+// newCertReloader loads the certificate and key. It fails if they can't be
+// loaded, as there is no point in starting without them.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+    cr := &certReloader{certFile: certFile, keyFile: keyFile}
+    err := cr.reload()
+    if err != nil {
+        return nil, err
+    }
+    return cr, nil
+}
+
+// reload loads the certificate and key from disk. If they can't be loaded
+// the current ones are kept.
+func (cr *certReloader) reload() error {
+    cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+    if err != nil {
+        return err
+    }
+    cr.mu.Lock()
+    cr.cert = &cert
+    cr.mu.Unlock()
+    return nil
+}
+
+// getCertificate is used as the GetCertificate function of the tls.Config,
+// which asks for the certificate on every handshake.
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+    cr.mu.RLock()
+    defer cr.mu.RUnlock()
+    return cr.cert, nil
+}
+
+// reloadOnSIGHUP reloads the certificate whenever the process gets a SIGHUP,
+// until the process exits.
+func (cr *certReloader) reloadOnSIGHUP(logger *slog.Logger) {
+    sighup := make(chan os.Signal, 1)
+    signal.Notify(sighup, syscall.SIGHUP)
+    go func() {
+        for range sighup {
+            err := cr.reload()
+            if err != nil {
+                logger.Error("reloading TLS certificate", "error", err.Error())
+                continue
+            }
+            logger.Info("reloaded TLS certificate", "cert", cr.certFile)
+        }
+    }()
+}
+
+// newTLSConfig returns the TLS settings for the server: TLS 1.2 or later,
+// only the elliptic curves with assembly implementations, and for TLS 1.2
+// only cipher suites with forward secrecy and authenticated encryption (the
+// TLS 1.3 suites can't be configured, and are all fine).
+func newTLSConfig(cr *certReloader) *tls.Config {
+    return &tls.Config{
+        MinVersion:       tls.VersionTLS12,
+        CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+        CipherSuites: []uint16{
+            tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+            tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+            tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+            tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+            tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+            tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+        },
+        GetCertificate: cr.getCertificate,
+    }
+}
+
+// redirectToHTTPS returns the handler for the plain HTTP listener, which
+// sends every request to the same URL on the HTTPS listener at httpsAddr.
+func redirectToHTTPS(httpsAddr string) http.Handler {
+    // Leave the port out of the URL when it is the default one.
+    _, port, _ := net.SplitHostPort(httpsAddr)
+    if port == "443" {
+        port = ""
+    }
+
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        host := r.Host
+        if h, _, err := net.SplitHostPort(host); err == nil {
+            host = h
+        }
+        if port != "" {
+            host = net.JoinHostPort(host, port)
+        } else if strings.Contains(host, ":") {
+            // An IPv6 address needs its brackets back.
+            host = "[" + host + "]"
+        }
+
+        // 308 Permanent Redirect, unlike 301, makes the client repeat a
+        // POST request as a POST.
+        http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+    })
+}
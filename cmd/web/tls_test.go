@@ -0,0 +1,74 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+
+    "github.com/cpucortexm/chunkbox/internal/assert"
+)
+
+func TestRedirectToHTTPS(t *testing.T) {
+    tests := []struct {
+        name      string
+        httpsAddr string
+        method    string
+        url       string
+        want      string
+    }{
+        {
+            name:      "Default port",
+            httpsAddr: ":443",
+            method:    http.MethodGet,
+            url:       "http://example.com/c/dev-setup?lines=3-5&file=main.go",
+            want:      "https://example.com/c/dev-setup?lines=3-5&file=main.go",
+        },
+        {
+            name:      "Other port",
+            httpsAddr: ":8443",
+            method:    http.MethodGet,
+            url:       "http://example.com:8080/c/dev-setup?lines=3-5",
+            want:      "https://example.com:8443/c/dev-setup?lines=3-5",
+        },
+        {
+            name:      "Address with a host",
+            httpsAddr: "0.0.0.0:443",
+            method:    http.MethodGet,
+            url:       "http://example.com:80/",
+            want:      "https://example.com/",
+        },
+        {
+            name:      "POST",
+            httpsAddr: ":443",
+            method:    http.MethodPost,
+            url:       "http://example.com/chunkbox/create",
+            want:      "https://example.com/chunkbox/create",
+        },
+        {
+            name:      "IPv6 on the default port",
+            httpsAddr: ":443",
+            method:    http.MethodGet,
+            url:       "http://[2001:db8::1]:80/c/dev-setup",
+            want:      "https://[2001:db8::1]/c/dev-setup",
+        },
+        {
+            name:      "IPv6 on another port",
+            httpsAddr: ":8443",
+            method:    http.MethodGet,
+            url:       "http://[2001:db8::1]:8080/c/dev-setup",
+            want:      "https://[2001:db8::1]:8443/c/dev-setup",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            rr := httptest.NewRecorder()
+            r := httptest.NewRequest(tt.method, tt.url, nil)
+            redirectToHTTPS(tt.httpsAddr).ServeHTTP(rr, r)
+
+            // A 308 rather than a 301, so that a POST is repeated as a POST.
+            assert.Equal(t, rr.Code, http.StatusPermanentRedirect)
+            assert.Equal(t, rr.Header().Get("Location"), tt.want)
+        })
+    }
+}
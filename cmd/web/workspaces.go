@@ -0,0 +1,304 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "github.com/cpucortexm/chunkbox/internal/models"
+    "github.com/cpucortexm/chunkbox/internal/validator"
+    "github.com/julienschmidt/httprouter"
+)
+
+// Workspaces let a team own chunks together, see models.WorkspaceModel.
+// Each workspace has its own page of latest chunks under /w/:slug, which
+// only its members can see. Anyone else gets a 404 Not Found, just as if
+// the workspace didn't exist.
+
+// workspacePageSize is how many chunks a workspace page lists.
+const workspacePageSize = 20
+
+// workspaceCreateForm holds the fields of the form for a new workspace.
+type workspaceCreateForm struct {
+    Name string
+    Slug string
+    validator.Validator
+}
+
+// workspaceMemberForm holds the fields of the form for adding a member to a
+// workspace.
+type workspaceMemberForm struct {
+    Email string
+    Role  string
+    validator.Validator
+}
+
+// The workspaceList handler shows the user's workspaces and the form for a
+// new one.
+func (app *application) workspaceList(w http.ResponseWriter, r *http.Request) {
+    app.renderWorkspaces(w, r, http.StatusOK, workspaceCreateForm{})
+}
+
+// renderWorkspaces shows the workspaces.html page with the form.
+func (app *application) renderWorkspaces(w http.ResponseWriter, r *http.Request, status int, form workspaceCreateForm) {
+    workspaces, err := app.workspaces.ForUser(r.Context(), userIDFromContext(r.Context()))
+    if err != nil {
+        app.serverError(w, r, err)
+        return
+    }
+
+    data := app.newTemplateData(r)
+    data.Workspaces = workspaces
+    data.Form = form
+    app.render(w, r, status, "workspaces.html", data)
+}
+
+func (app *application) workspaceCreatePost(w http.ResponseWriter, r *http.Request) {
+    err := r.ParseForm()
+    if err != nil {
+        app.clientError(w, r, http.StatusBadRequest)
+        return
+    }
+
+    form := workspaceCreateForm{
+        Name: strings.TrimSpace(r.PostForm.Get("name")),
+        Slug: strings.TrimSpace(r.PostForm.Get("slug")),
+    }
+
+    form.CheckField(validator.NotBlank(form.Name), "name", "This field cannot be blank")
+    form.CheckField(validator.MaxChars(form.Name, 100), "name", "This field cannot be more than 100 characters long")
+    form.CheckField(validator.MinChars(form.Slug, 3), "slug", "This field must be at least 3 characters long")
+    form.CheckField(validator.MaxChars(form.Slug, 64), "slug", "This field cannot be more than 64 characters long")
+    form.CheckField(validator.Matches(form.Slug, slugRX), "slug", "This field can only contain lower case letters, digits and hyphens")
+
+    if !form.Valid() {
+        app.renderWorkspaces(w, r, http.StatusUnprocessableEntity, form)
+        return
+    }
+
+    err = app.workspaces.Insert(r.Context(), userIDFromContext(r.Context()), form.Name, form.Slug)
+    if err != nil {
+        if errors.Is(err, models.ErrDuplicateSlug) {
+            form.AddFieldError("slug", "This slug is already in use")
+            app.renderWorkspaces(w, r, http.StatusUnprocessableEntity, form)
+        } else {
+            app.serverError(w, r, err)
+        }
+        return
+    }
+
+    app.sessionManager.Put(r.Context(), "flash", "Your workspace has been created.")
+    http.Redirect(w, r, "/w/"+form.Slug, http.StatusSeeOther)
+}
+
+// workspaceFromPath fetches the workspace named by the :slug parameter in a
+// /w/:slug URL, if the user belongs to it. Otherwise, or if there's an
+// error, it sends the response itself and returns false.
+func (app *application) workspaceFromPath(w http.ResponseWriter, r *http.Request) (*models.Workspace, bool) {
+    slug := httprouter.ParamsFromContext(r.Context()).ByName("slug")
+
+    workspace, err := app.workspaces.Get(r.Context(), slug, userIDFromContext(r.Context()))
+    if err != nil {
+        if errors.Is(err, models.ErrNoRecord) {
+            app.notFound(w, r)
+        } else {
+            app.serverError(w, r, err)
+        }
+        return nil, false
+    }
+    return workspace, true
+}
+
+// The workspaceView handler lists the latest chunks of a workspace,
+// optionally only those whose slug or title contains the q parameter.
+func (app *application) workspaceView(w http.ResponseWriter, r *http.Request) {
+    workspace, ok := app.workspaceFromPath(w, r)
+    if !ok {
+        return
+    }
+    query := r.URL.Query().Get("q")
+    page := pageParam(r)
+
+    chunks, more, err := app.chunks.InWorkspace(r.Context(), workspace.ID, query, workspacePageSize, (page-1)*workspacePageSize)
+    if err != nil {
+        app.serverError(w, r, err)
+        return
+    }
+
+    data := app.newTemplateData(r)
+    data.Workspace = workspace
+    data.Chunks = chunks
+    data.Query = query
+    data.Page = page
+    data.MorePages = more
+    app.render(w, r, http.StatusOK, "workspace.html", data)
+}
+
+// The workspaceMembers handler lists the members of a workspace. Owners
+// also get the forms for managing them.
+func (app *application) workspaceMembers(w http.ResponseWriter, r *http.Request) {
+    workspace, ok := app.workspaceFromPath(w, r)
+    if !ok {
+        return
+    }
+    app.renderMembers(w, r, http.StatusOK, workspace, workspaceMemberForm{Role: models.WorkspaceMember})
+}
+
+// renderMembers shows the workspace_members.html page with the form.
+func (app *application) renderMembers(w http.ResponseWriter, r *http.Request, status int, workspace *models.Workspace, form workspaceMemberForm) {
+    members, err := app.workspaces.Members(r.Context(), workspace.ID)
+    if err != nil {
+        app.serverError(w, r, err)
+        return
+    }
+
+    data := app.newTemplateData(r)
+    data.Workspace = workspace
+    data.Members = members
+    data.WorkspaceRoles = models.WorkspaceRoles
+    data.Form = form
+    app.render(w, r, status, "workspace_members.html", data)
+}
+
+// requireOwner sends a 403 Forbidden response and returns false unless the
+// user is an owner of the workspace.
+func (app *application) requireOwner(w http.ResponseWriter, r *http.Request, workspace *models.Workspace) bool {
+    if !workspace.IsOwner() {
+        app.errorResponse(w, r, http.StatusForbidden, "Only the owners of a workspace can manage its members.", "")
+        return false
+    }
+    return true
+}
+
+// The workspaceMemberAddPost handler adds the user with the email address
+// in the form to the workspace.
+func (app *application) workspaceMemberAddPost(w http.ResponseWriter, r *http.Request) {
+    err := r.ParseForm()
+    if err != nil {
+        app.clientError(w, r, http.StatusBadRequest)
+        return
+    }
+    workspace, ok := app.workspaceFromPath(w, r)
+    if !ok || !app.requireOwner(w, r, workspace) {
+        return
+    }
+
+    form := workspaceMemberForm{
+        Email: strings.TrimSpace(r.PostForm.Get("email")),
+        Role:  r.PostForm.Get("role"),
+    }
+
+    form.CheckField(validator.NotBlank(form.Email), "email", "This field cannot be blank")
+    form.CheckField(validator.Matches(form.Email, validator.EmailRX), "email", "This field must be a valid email address")
+    form.CheckField(validator.PermittedValue(form.Role, models.WorkspaceRoles...), "role", "This role does not exist")
+
+    if form.Valid() {
+        err = app.workspaces.AddMember(r.Context(), workspace.ID, form.Email, form.Role)
+        switch {
+        case errors.Is(err, models.ErrNoRecord):
+            form.AddFieldError("email", "There is no user with this email address")
+        case errors.Is(err, models.ErrAlreadyMember):
+            form.AddFieldError("email", "This user is already a member")
+        case err != nil:
+            app.serverError(w, r, err)
+            return
+        }
+    }
+    if !form.Valid() {
+        app.renderMembers(w, r, http.StatusUnprocessableEntity, workspace, form)
+        return
+    }
+
+    app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("%s has been added to the workspace.", form.Email))
+    http.Redirect(w, r, "/w/"+workspace.Slug+"/members", http.StatusSeeOther)
+}
+
+// memberFromPath parses the :id parameter of a /w/:slug/members/:id URL. If
+// the ID is no good it sends a 404 Not Found and returns false.
+func (app *application) memberFromPath(w http.ResponseWriter, r *http.Request) (int, bool) {
+    id, err := strconv.Atoi(httprouter.ParamsFromContext(r.Context()).ByName("id"))
+    if err != nil || id < 1 {
+        app.notFound(w, r)
+        return 0, false
+    }
+    return id, true
+}
+
+// memberChangeFailed sends the response for an error from changing or
+// removing a member of a workspace.
+func (app *application) memberChangeFailed(w http.ResponseWriter, r *http.Request, err error) {
+    switch {
+    case errors.Is(err, models.ErrNoRecord):
+        app.notFound(w, r)
+    case errors.Is(err, models.ErrLastOwner):
+        app.errorResponse(w, r, http.StatusConflict, "A workspace needs at least one owner. Make someone else an owner first.", "")
+    default:
+        app.serverError(w, r, err)
+    }
+}
+
+// The workspaceMemberRolePost handler gives a member of the workspace the
+// role in the role field.
+func (app *application) workspaceMemberRolePost(w http.ResponseWriter, r *http.Request) {
+    err := r.ParseForm()
+    if err != nil {
+        app.clientError(w, r, http.StatusBadRequest)
+        return
+    }
+    role := r.PostForm.Get("role")
+    if !validator.PermittedValue(role, models.WorkspaceRoles...) {
+        app.clientError(w, r, http.StatusBadRequest)
+        return
+    }
+    workspace, ok := app.workspaceFromPath(w, r)
+    if !ok || !app.requireOwner(w, r, workspace) {
+        return
+    }
+    id, ok := app.memberFromPath(w, r)
+    if !ok {
+        return
+    }
+
+    err = app.workspaces.SetMemberRole(r.Context(), workspace.ID, id, role)
+    if err != nil {
+        app.memberChangeFailed(w, r, err)
+        return
+    }
+
+    app.sessionManager.Put(r.Context(), "flash", "The member's role has been changed.")
+    http.Redirect(w, r, "/w/"+workspace.Slug+"/members", http.StatusSeeOther)
+}
+
+// The workspaceMemberRemovePost handler takes a member out of the workspace.
+// Owners can remove anyone, and every member can remove themselves to
+// leave the workspace.
+func (app *application) workspaceMemberRemovePost(w http.ResponseWriter, r *http.Request) {
+    workspace, ok := app.workspaceFromPath(w, r)
+    if !ok {
+        return
+    }
+    id, ok := app.memberFromPath(w, r)
+    if !ok {
+        return
+    }
+    self := id == userIDFromContext(r.Context())
+    if !self && !app.requireOwner(w, r, workspace) {
+        return
+    }
+
+    err := app.workspaces.RemoveMember(r.Context(), workspace.ID, id)
+    if err != nil {
+        app.memberChangeFailed(w, r, err)
+        return
+    }
+
+    if self {
+        app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("You have left %s.", workspace.Name))
+        http.Redirect(w, r, "/workspaces", http.StatusSeeOther)
+        return
+    }
+    app.sessionManager.Put(r.Context(), "flash", "The member has been removed.")
+    http.Redirect(w, r, "/w/"+workspace.Slug+"/members", http.StatusSeeOther)
+}
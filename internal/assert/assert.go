@@ -0,0 +1,33 @@
+package assert
+
+import (
+    "strings"
+    "testing"
+)
+
+// Equal fails the test if actual isn't equal to expected.
+func Equal[T comparable](t *testing.T, actual, expected T) {
+    t.Helper()
+
+    if actual != expected {
+        t.Errorf("got: %v; want: %v", actual, expected)
+    }
+}
+
+// StringContains fails the test unless actual contains expectedSubstring.
+func StringContains(t *testing.T, actual, expectedSubstring string) {
+    t.Helper()
+
+    if !strings.Contains(actual, expectedSubstring) {
+        t.Errorf("got: %q; expected to contain: %q", actual, expectedSubstring)
+    }
+}
+
+// NilError fails the test now if actual isn't nil.
+func NilError(t *testing.T, actual error) {
+    t.Helper()
+
+    if actual != nil {
+        t.Fatalf("got: %v; expected: nil", actual)
+    }
+}
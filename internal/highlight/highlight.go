@@ -0,0 +1,185 @@
+// Package highlight wraps the chroma library to turn chunk content into
+// syntax highlighted HTML. The HTML uses CSS classes rather than inline
+// styles, so it is allowed by the Content-Security-Policy set in the
+// secureHeaders middleware. The colours for those classes come from the
+// stylesheet generated by Stylesheet().
+package highlight
+
+import (
+    "bytes"
+    "fmt"
+    "html/template"
+    "regexp"
+    "sort"
+    "strings"
+
+    "github.com/alecthomas/chroma/v2"
+    "github.com/alecthomas/chroma/v2/formatters/html"
+    "github.com/alecthomas/chroma/v2/lexers"
+    "github.com/alecthomas/chroma/v2/styles"
+)
+
+// PlainText is the language stored for chunks which should not be
+// highlighted at all, and the result of Detect() when nothing matches.
+const PlainText = "text"
+
+// Language describes a language that can be selected when creating a
+// chunk. Alias is the value stored in the database, Name is the label shown
+// to the user.
+type Language struct {
+    Alias string
+    Name  string
+}
+
+// The formatter is safe for concurrent use, so we create it once. WithClasses
+// makes chroma emit class="..." attributes instead of style="..." ones.
+var formatter = html.New(html.WithClasses(true))
+
+// lineFormatter returns a formatter which also renders line numbers, each
+// linking to an anchor made of the prefix and the line number (like #L12).
+func lineFormatter(prefix string) *html.Formatter {
+    return html.New(
+        html.WithClasses(true),
+        html.WithLineNumbers(true),
+        html.WithLinkableLineNumbers(true, prefix),
+    )
+}
+
+// Build the list of languages once at startup from the lexers registered
+// with chroma, sorted by their display name.
+var languages = func() []Language {
+    langs := []Language{}
+    for _, lexer := range lexers.GlobalLexerRegistry.Lexers {
+        config := lexer.Config()
+        langs = append(langs, Language{Alias: alias(config), Name: config.Name})
+    }
+    sort.Slice(langs, func(i, j int) bool {
+        return strings.ToLower(langs[i].Name) < strings.ToLower(langs[j].Name)
+    })
+    return langs
+}()
+
+// alias returns the identifier we store for a lexer, which is its first
+// alias if it has one, or its lower cased name if it doesn't.
+func alias(config *chroma.Config) string {
+    if len(config.Aliases) > 0 {
+        return config.Aliases[0]
+    }
+    return strings.ToLower(config.Name)
+}
+
+// Languages returns all the languages which can be highlighted.
+func Languages() []Language {
+    return languages
+}
+
+// Supported reports whether the language is known to the highlighter.
+func Supported(language string) bool {
+    return language != "" && lexers.Get(language) != nil
+}
+
+// A few cheap signatures for popular languages. They are checked before
+// chroma's own analysers, which are only implemented for some lexers and
+// tend to claim anything with a "func" in it for GDScript.
+var signatures = []struct {
+    language string
+    rx       *regexp.Regexp
+}{
+    {"go", regexp.MustCompile(`(?m)^package \w+\s*$`)},
+    {"php", regexp.MustCompile(`^\s*<\?php`)},
+    {"html", regexp.MustCompile(`(?i)^\s*<!doctype html|^\s*<html[\s>]`)},
+    {"xml", regexp.MustCompile(`^\s*<\?xml `)},
+    {"docker", regexp.MustCompile(`(?m)^FROM \S+(\s+AS \S+)?\s*$`)},
+    {"sql", regexp.MustCompile(`(?i)^\s*(SELECT|INSERT INTO|UPDATE|DELETE FROM|CREATE TABLE|ALTER TABLE)\s`)},
+    {"json", regexp.MustCompile(`^\s*[{\[]\s*"`)},
+    {"yaml", regexp.MustCompile(`(?m)^---\s*$|^[\w-]+:\s*\n\s+[\w-]+:`)},
+}
+
+// Detect makes a best guess at the language of the content. It tries our
+// own signatures, then the interpreter named in a shebang line, then
+// chroma's analysers, and finally falls back to PlainText.
+func Detect(content string) string {
+    for _, s := range signatures {
+        if s.rx.MatchString(content) {
+            return s.language
+        }
+    }
+    if strings.HasPrefix(content, "#!") {
+        line, _, _ := strings.Cut(content, "\n")
+        fields := strings.Fields(strings.TrimPrefix(line, "#!"))
+        if len(fields) > 0 {
+            // Handle both "#!/bin/bash" and "#!/usr/bin/env python3".
+            interpreter := fields[len(fields)-1]
+            interpreter = interpreter[strings.LastIndex(interpreter, "/")+1:]
+            if lexer := lexers.Get(strings.TrimRight(interpreter, "0123456789.")); lexer != nil {
+                return alias(lexer.Config())
+            }
+        }
+    }
+    if lexer := lexers.Analyse(content); lexer != nil {
+        return alias(lexer.Config())
+    }
+    return PlainText
+}
+
+// DetectFile is like Detect(), but first tries to work out the language from
+// the file name, like "main.go" or "Dockerfile".
+func DetectFile(name, content string) string {
+    if lexer := lexers.Match(name); lexer != nil {
+        return alias(lexer.Config())
+    }
+    return Detect(content)
+}
+
+// HTML returns the content highlighted as the given language. Unknown
+// languages are rendered as plain text rather than treated as an error.
+func HTML(content, language string) (template.HTML, error) {
+    return format(formatter, content, language)
+}
+
+// LineNumberedHTML is like HTML(), but also renders a linkable number in
+// front of each line. The id of each line number is the anchor prefix
+// followed by the line number, so use a different prefix for each block of
+// code on a page.
+func LineNumberedHTML(content, language, anchorPrefix string) (template.HTML, error) {
+    return format(lineFormatter(anchorPrefix), content, language)
+}
+
+func format(f *html.Formatter, content, language string) (template.HTML, error) {
+    lexer := lexers.Get(language)
+    if lexer == nil {
+        lexer = lexers.Fallback
+    }
+    iterator, err := chroma.Coalesce(lexer).Tokenise(nil, content)
+    if err != nil {
+        return "", err
+    }
+    // The style is only used for inline styles, which are disabled, so any
+    // style will do here.
+    var buf bytes.Buffer
+    err = f.Format(&buf, styles.Fallback, iterator)
+    if err != nil {
+        return "", err
+    }
+    // The formatter escapes the content itself, so it is safe to mark the
+    // result as trusted HTML.
+    return template.HTML(buf.String()), nil
+}
+
+// Stylesheet generates the CSS for the classes emitted by HTML() and
+// LineNumberedHTML() from the named chroma theme (like "github" or
+// "monokai").
+func Stylesheet(theme string) ([]byte, error) {
+    style, ok := styles.Registry[theme]
+    if !ok {
+        return nil, fmt.Errorf("highlight: unknown theme %q", theme)
+    }
+    var buf bytes.Buffer
+    // The line numbered formatter writes the rules for the line numbers on
+    // top of everything the plain formatter needs.
+    err := lineFormatter("L").WriteCSS(&buf, style)
+    if err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
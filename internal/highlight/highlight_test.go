@@ -0,0 +1,152 @@
+package highlight
+
+import (
+    "strings"
+    "testing"
+
+    "github.com/cpucortexm/chunkbox/internal/assert"
+)
+
+func TestDetect(t *testing.T) {
+    tests := []struct {
+        name    string
+        content string
+        want    string
+    }{
+        {
+            name:    "Go",
+            content: "package main\n\nfunc main() {}\n",
+            want:    "go",
+        },
+        {
+            name:    "PHP",
+            content: "<?php\necho 'hello';\n",
+            want:    "php",
+        },
+        {
+            name:    "HTML",
+            content: "<!DOCTYPE html>\n<html><body></body></html>\n",
+            want:    "html",
+        },
+        {
+            name:    "SQL",
+            content: "SELECT id, title FROM chunks;\n",
+            want:    "sql",
+        },
+        {
+            name:    "JSON",
+            content: "{\"title\": \"An old silent pond\"}\n",
+            want:    "json",
+        },
+        {
+            name:    "Dockerfile",
+            content: "FROM golang:1.22 AS build\nRUN go build ./...\n",
+            want:    "docker",
+        },
+        {
+            name:    "Shebang",
+            content: "#!/bin/bash\necho hello\n",
+            want:    "bash",
+        },
+        {
+            name:    "Env shebang with version",
+            content: "#!/usr/bin/env python3\nprint('hello')\n",
+            want:    "python",
+        },
+        {
+            name:    "Prose",
+            content: "An old silent pond\nA frog jumps into the pond\n",
+            want:    PlainText,
+        },
+        {
+            name:    "Empty",
+            content: "",
+            want:    PlainText,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            assert.Equal(t, Detect(tt.content), tt.want)
+        })
+    }
+}
+
+func TestDetectFile(t *testing.T) {
+    tests := []struct {
+        name     string
+        fileName string
+        content  string
+        want     string
+    }{
+        {
+            name:     "Extension",
+            fileName: "main.go",
+            content:  "",
+            want:     "go",
+        },
+        {
+            name:     "Extension wins over content",
+            fileName: "query.py",
+            content:  "SELECT id FROM chunks;\n",
+            want:     "python",
+        },
+        {
+            name:     "Whole name",
+            fileName: "Dockerfile",
+            content:  "",
+            want:     "docker",
+        },
+        {
+            name:     "Unknown extension falls back to content",
+            fileName: "main.unknown",
+            content:  "package main\n",
+            want:     "go",
+        },
+        {
+            name:     "Nothing matches",
+            fileName: "notes",
+            content:  "An old silent pond\n",
+            want:     PlainText,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            assert.Equal(t, DetectFile(tt.fileName, tt.content), tt.want)
+        })
+    }
+}
+
+func TestSupported(t *testing.T) {
+    assert.Equal(t, Supported("go"), true)
+    assert.Equal(t, Supported(PlainText), true)
+    assert.Equal(t, Supported("no-such-language"), false)
+    assert.Equal(t, Supported(""), false)
+}
+
+func TestHTML(t *testing.T) {
+    code, err := HTML("package main", "go")
+    assert.NilError(t, err)
+    // The colours come from the stylesheet, as the CSP forbids inline
+    // styles.
+    assert.StringContains(t, string(code), `class="`)
+    assert.Equal(t, strings.Contains(string(code), "style="), false)
+}
+
+func TestHTMLFallback(t *testing.T) {
+    // An unknown language is shown as escaped plain text, not an error.
+    code, err := HTML("<script>alert(1)</script>", "no-such-language")
+    assert.NilError(t, err)
+    assert.StringContains(t, string(code), "&lt;script&gt;")
+    assert.Equal(t, strings.Contains(string(code), "<script>"), false)
+}
+
+func TestStylesheet(t *testing.T) {
+    css, err := Stylesheet("github")
+    assert.NilError(t, err)
+    assert.StringContains(t, string(css), ".chroma")
+
+    _, err = Stylesheet("no-such-theme")
+    assert.Equal(t, err != nil, true)
+}
@@ -0,0 +1,88 @@
+// Package markdown renders chunks written in Markdown to HTML. The source is
+// parsed as GitHub Flavored Markdown, fenced code blocks are highlighted with
+// the highlight package, and the result is passed through an HTML sanitizer
+// before it is handed to the templates.
+package markdown
+
+import (
+    "bytes"
+    "html/template"
+    "regexp"
+
+    "github.com/cpucortexm/chunkbox/internal/highlight"
+    "github.com/microcosm-cc/bluemonday"
+    "github.com/yuin/goldmark"
+    "github.com/yuin/goldmark/ast"
+    "github.com/yuin/goldmark/extension"
+    "github.com/yuin/goldmark/renderer"
+    "github.com/yuin/goldmark/util"
+)
+
+// The goldmark converter is safe for concurrent use. We don't enable the
+// html.WithUnsafe() option, so raw HTML in the source is dropped by goldmark
+// before the sanitizer even sees it.
+var converter = goldmark.New(
+    goldmark.WithExtensions(extension.GFM),
+    goldmark.WithRendererOptions(
+        // A priority lower than the default HTML renderer (1000) makes our
+        // fenced code block renderer win.
+        renderer.WithNodeRenderers(util.Prioritized(&codeBlockRenderer{}, 200)),
+    ),
+)
+
+// The sanitizer policy starts from bluemonday's policy for user generated
+// content, which strips scripts, event handlers and style attributes (the
+// latter would be blocked by our Content-Security-Policy anyway). We add the
+// class attribute used by highlighted code, and the disabled checkboxes that
+// GFM renders for task lists.
+var policy = func() *bluemonday.Policy {
+    p := bluemonday.UGCPolicy()
+    p.AllowAttrs("class").Matching(regexp.MustCompile(`^[a-zA-Z0-9 _-]+$`)).OnElements("pre", "code", "span")
+    p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+    p.AllowAttrs("checked", "disabled").OnElements("input")
+    return p
+}()
+
+// Render converts the Markdown source into sanitized HTML.
+func Render(source string) (template.HTML, error) {
+    var buf bytes.Buffer
+    err := converter.Convert([]byte(source), &buf)
+    if err != nil {
+        return "", err
+    }
+    return template.HTML(policy.SanitizeBytes(buf.Bytes())), nil
+}
+
+// codeBlockRenderer renders fenced code blocks through the highlight package,
+// so that code in Markdown chunks looks the same as code chunks.
+type codeBlockRenderer struct{}
+
+func (r *codeBlockRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+    reg.Register(ast.KindFencedCodeBlock, r.renderFencedCodeBlock)
+}
+
+func (r *codeBlockRenderer) renderFencedCodeBlock(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+    if !entering {
+        return ast.WalkContinue, nil
+    }
+    n := node.(*ast.FencedCodeBlock)
+
+    var code bytes.Buffer
+    lines := n.Lines()
+    for i := 0; i < lines.Len(); i++ {
+        line := lines.At(i)
+        code.Write(line.Value(source))
+    }
+
+    // The info string after the opening fence names the language. If it is
+    // missing or unknown, HTML() renders the block as plain text.
+    html, err := highlight.HTML(code.String(), string(n.Language(source)))
+    if err != nil {
+        return ast.WalkStop, err
+    }
+    _, err = w.WriteString(string(html))
+    if err != nil {
+        return ast.WalkStop, err
+    }
+    return ast.WalkSkipChildren, nil
+}
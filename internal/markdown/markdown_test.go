@@ -0,0 +1,92 @@
+package markdown
+
+import (
+    "strings"
+    "testing"
+
+    "github.com/cpucortexm/chunkbox/internal/assert"
+)
+
+func TestRender(t *testing.T) {
+    tests := []struct {
+        name     string
+        source   string
+        contains []string
+        excludes []string
+    }{
+        {
+            name:     "Heading and emphasis",
+            source:   "# Setup\n\nRun it *now*, **twice**.\n",
+            contains: []string{"<h1>Setup</h1>", "<em>now</em>", "<strong>twice</strong>"},
+        },
+        {
+            name:     "Link",
+            source:   "See [the docs](https://example.com/docs).\n",
+            contains: []string{`href="https://example.com/docs"`, ">the docs</a>"},
+        },
+        {
+            name:     "Table",
+            source:   "| Key | Value |\n| --- | --- |\n| a | 1 |\n",
+            contains: []string{"<table>", "<th>Key</th>", "<td>1</td>"},
+        },
+        {
+            name:     "Task list",
+            source:   "- [x] done\n- [ ] to do\n",
+            contains: []string{`type="checkbox"`, "disabled"},
+        },
+        {
+            name:     "Strikethrough",
+            source:   "~~old~~ new\n",
+            contains: []string{"<del>old</del>"},
+        },
+        {
+            name:     "Fenced code",
+            source:   "```go\npackage main\n```\n",
+            contains: []string{`<pre class="chroma">`, `class="kn"`},
+            excludes: []string{"style="},
+        },
+        {
+            name:     "Script block",
+            source:   "<script>alert(1)</script>\n\nAfter.\n",
+            contains: []string{"<p>After.</p>"},
+            excludes: []string{"<script", "alert(1)"},
+        },
+        {
+            name:     "JavaScript link",
+            source:   "[click](javascript:alert(1))\n",
+            excludes: []string{"javascript:"},
+        },
+        {
+            name:     "Event handler",
+            source:   "<img src=\"x.png\" onerror=\"alert(1)\">\n\n<a href=\"/\" onclick=\"alert(1)\">home</a>\n",
+            excludes: []string{"onerror", "onclick", "alert(1)"},
+        },
+        {
+            name:     "Inline HTML",
+            source:   "Some <b style=\"color: red\">bold</b> text.\n",
+            contains: []string{"bold"},
+            excludes: []string{"<b", "style="},
+        },
+        {
+            name:     "Raw HTML block",
+            source:   "<div class=\"banner\"><iframe src=\"https://example.com\"></iframe></div>\n",
+            excludes: []string{"<div", "<iframe"},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            html, err := Render(tt.source)
+            assert.NilError(t, err)
+
+            for _, s := range tt.contains {
+                assert.StringContains(t, string(html), s)
+            }
+            for _, s := range tt.excludes {
+                if strings.Contains(string(html), s) {
+                    t.Errorf("got: %q; expected not to contain: %q", html, s)
+                }
+            }
+        })
+    }
+}
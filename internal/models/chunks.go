@@ -1,68 +1,302 @@
 package models
 import (
+    "context"
     "database/sql"
     "time"
     "errors"
 )
+
+// The content types a chunk file can have. Code files are syntax
+// highlighted, Markdown files are rendered to HTML.
+const (
+    ContentTypeCode     = "code"
+    ContentTypeMarkdown = "markdown"
+)
+
 // define a chunk struct for an individual chunk.
 // This will get stored in sql
 type Chunk struct {
     ID      int
+    Slug    string // random, URL-safe identifier used in links
     Title   string
-    Content string
+    Files   []*File // only loaded by Get(), in position order
+    Size    int64   // total size of the files in bytes
+    UserID  int     // the user who created the chunk, or 0; only loaded by Get() and Search()
+    // OwnerIP is the address the chunk was created from, and UserEmail the
+    // email address of the user who created it. Only loaded by Search().
+    OwnerIP   string
+    UserEmail string
+    // WorkspaceID is the ID of the workspace the chunk belongs to, or 0 if
+    // it is public. WorkspaceSlug and WorkspaceName are only loaded by
+    // Get().
+    WorkspaceID   int
+    WorkspaceSlug string
+    WorkspaceName string
+    // Private chunks outside a workspace can only be seen by whoever
+    // created them and those they are shared with, see grants.go.
+    Private bool
+    // CanEdit and CanShare say whether the user the chunk was fetched for
+    // may change its files, and its sharing. Only loaded by Get(), apart
+    // from CanEdit which SharedWith() loads too.
+    CanEdit  bool
+    CanShare bool
     Created time.Time
     Expires time.Time
+    // ForkedFrom is the ID of the chunk this one was forked from, or 0 if
+    // it is an original, and ForkedFromSlug is the slug of that chunk. Not
+    // loaded by Latest().
+    ForkedFrom     int
+    ForkedFromSlug string
+}
+
+// File is one of the named files which make up a chunk, gist-style. Each
+// file is highlighted (or rendered) on its own.
+type File struct {
+    ID          int
+    Name        string
+    Content     string
+    ContentType string // ContentTypeCode or ContentTypeMarkdown
+    Language    string // chroma alias used for highlighting, like "go"
+}
+
+// File returns the file of the chunk with the given name, or nil if there
+// isn't one.
+func (c *Chunk) File(name string) *File {
+    for _, f := range c.Files {
+        if f.Name == name {
+            return f
+        }
+    }
+    return nil
 }
 
 // Define a ChunkModel type which wraps a sql.DB connection pool.
 type ChunkModel struct {
     DB *sql.DB
+    // SlugLength is the length of the random slugs given to new chunks.
+    // If it is zero, DefaultSlugLength is used.
+    SlugLength int
+    // Timeout limits how long each method may spend waiting on the
+    // database, on top of any deadline the caller's context already has.
+    // If it is zero there is no limit of our own.
+    Timeout time.Duration
+    // IPQuota limits the chunks created by people who aren't logged in,
+    // per IP address, and UserQuota those created by each user.
+    IPQuota   Quota
+    UserQuota Quota
 }
 
-// This will insert a new snippet into the database.
-func (m *ChunkModel) Insert(title string, content string, expires int) (int, error) {
-    // Write the SQL statement we want to execute.
-    stmt := `INSERT INTO chunks (title, content, created, expires)
-    VALUES(?, ?, UTC_TIMESTAMP(), DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? DAY))`
-    // Use the Exec() method on the embedded connection pool to execute the
-    // statement. The first parameter is the SQL statement, followed by the
-    // title, content and expiry values for the placeholder parameters. This
-    // method returns a sql.Result type, which contains some basic
-    // information about what happened when the statement was executed.
-    result, err := m.DB.Exec(stmt, title, content, expires)
+// withTimeout returns a context for the database calls of a method, which
+// is cancelled when the Timeout has passed. The returned cancel function
+// must always be called.
+func (m *ChunkModel) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+    if m.Timeout == 0 {
+        return context.WithCancel(ctx)
+    }
+    return context.WithTimeout(ctx, m.Timeout)
+}
+
+// This will insert a new chunk, along with its files, into the database,
+// and return its slug. If customSlug is empty the chunk is given a random
+// slug, otherwise it gets the custom one or ErrDuplicateSlug if a live chunk
+// already has it. forkedFrom is the ID of the chunk it was forked from, or 0
+// for a new chunk. A private chunk is only seen by those it is shared
+// with. If the chunk doesn't fit in the owner's quota, ErrQuotaExceeded is
+// returned, and if the owner puts it in a workspace they don't belong to,
+// ErrNotMember.
+func (m *ChunkModel) Insert(ctx context.Context, owner Owner, title string, customSlug string, files []*File, expires int, forkedFrom int, private bool) (string, error) {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    // The chunk and its files are written in a single transaction, so we
+    // never end up with a chunk which is missing some of its files. If the
+    // context is cancelled before we commit, the transaction is rolled back.
+    tx, err := m.DB.BeginTx(ctx, nil)
+    if err != nil {
+        return "", err
+    }
+    // Rollback() is a no-op once the transaction has been committed, so it
+    // is safe to always defer it.
+    defer tx.Rollback()
+
+    var size int64
+    for _, f := range files {
+        size += int64(len(f.Content))
+    }
+    u, err := usage(ctx, tx, owner, true)
     if err != nil {
-        return 0, err
+        return "", err
+    }
+    if !m.QuotaFor(owner).Allows(u, size) {
+        return "", ErrQuotaExceeded
+    }
+
+    if owner.WorkspaceID != 0 {
+        var member bool
+        stmt := `SELECT EXISTS(SELECT true FROM workspace_members WHERE workspace_id = ? AND user_id = ?)`
+        err = tx.QueryRowContext(ctx, stmt, owner.WorkspaceID, owner.UserID).Scan(&member)
+        if err != nil {
+            return "", err
+        }
+        if !member {
+            return "", ErrNotMember
+        }
+    }
+
+    // Write the SQL statement we want to execute.
+    stmt := `INSERT INTO chunks (slug, title, created, expires, forked_from, owner_ip, user_id, size, workspace_id, private)
+    VALUES(?, ?, UTC_TIMESTAMP(), DATE_ADD(UTC_TIMESTAMP(), INTERVAL ? DAY), ?, ?, ?, ?, ?, ?)`
+    // A chunk which isn't a fork gets a NULL forked_from, one created by
+    // someone who isn't logged in a NULL user_id, and a public one a NULL
+    // workspace_id.
+    parent := sql.NullInt64{Int64: int64(forkedFrom), Valid: forkedFrom != 0}
+    userID := sql.NullInt64{Int64: int64(owner.UserID), Valid: owner.UserID != 0}
+    workspaceID := sql.NullInt64{Int64: int64(owner.WorkspaceID), Valid: owner.WorkspaceID != 0}
+
+    var slug string
+    var result sql.Result
+    if customSlug != "" {
+        // A custom slug can be reclaimed from a chunk which has expired.
+        err = reclaimSlug(ctx, tx, customSlug)
+        if err != nil {
+            return "", err
+        }
+        slug = customSlug
+        result, err = tx.ExecContext(ctx, stmt, slug, title, expires, parent, owner.IP, userID, size, workspaceID, private)
+        if err != nil {
+            // Someone else may have taken the slug since we checked.
+            if isDuplicateSlug(err) {
+                return "", ErrDuplicateSlug
+            }
+            return "", err
+        }
+    }
+
+    length := m.SlugLength
+    if length == 0 {
+        length = DefaultSlugLength
+    }
+
+    // The unique constraint on the slug column does the collision check for
+    // us: if the random slug is already taken, we pick another one and try
+    // again. A failed statement doesn't abort a MySQL transaction.
+    for attempt := 0; result == nil; attempt++ {
+        if attempt == slugAttempts {
+            return "", errors.New("models: could not find a free slug")
+        }
+        slug, err = newSlug(length)
+        if err != nil {
+            return "", err
+        }
+        // Use the ExecContext() method on the transaction to execute the
+        // statement. The parameters are the context and the SQL statement,
+        // followed by the values for the placeholder parameters.
+        // This method returns a sql.Result type, which contains some basic
+        // information about what happened when the statement was executed.
+        result, err = tx.ExecContext(ctx, stmt, slug, title, expires, parent, owner.IP, userID, size, workspaceID, private)
+        if err != nil {
+            if !isDuplicateSlug(err) {
+                return "", err
+            }
+            result = nil
+        }
     }
     // Use the LastInsertId() method on the result to get the ID of our
-    // newly inserted record in the snippets table.
+    // newly inserted record in the chunks table.
     id, err := result.LastInsertId()
     if err != nil {
-        return 0, err
+        return "", err
     }
-    // The ID returned has the type int64, so we convert it to an int type
-    // before returning.
-    return int(id), nil
+
+    err = insertFiles(ctx, tx, int(id), files)
+    if err != nil {
+        return "", err
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        return "", err
+    }
+    return slug, nil
+}
+
+// insertFiles inserts the files of a chunk, using their index in the slice
+// as their position.
+func insertFiles(ctx context.Context, tx *sql.Tx, chunkID int, files []*File) error {
+    stmt := `INSERT INTO chunk_files (chunk_id, name, content, content_type, language, position)
+    VALUES(?, ?, ?, ?, ?, ?)`
+    for i, f := range files {
+        _, err := tx.ExecContext(ctx, stmt, chunkID, f.Name, f.Content, f.ContentType, f.Language, i)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// This will return a specific chunk, including its files, based on its id.
+// The chunk is only returned if the user with the given ID (0 for someone
+// who isn't logged in) may see it, otherwise the error is ErrNoRecord.
+func (m *ChunkModel) Get(ctx context.Context, id int, userID int) (*Chunk, error) {
+    return m.get(ctx, "c.id", id, userID)
+}
+
+// This will return a specific chunk, including its files, based on its slug.
+// Like Get(), it only returns chunks the user may see.
+func (m *ChunkModel) GetBySlug(ctx context.Context, slug string, userID int) (*Chunk, error) {
+    return m.get(ctx, "c.slug", slug, userID)
 }
 
-// This will return a specific snippet based on its id.
-func (m *ChunkModel) Get(id int) (*Chunk, error) {
-    stmt := `SELECT id, title, content, created, expires FROM chunks
-    WHERE expires > UTC_TIMESTAMP() AND id = ?`
+// get returns the unexpired chunk where the column has the given value, if
+// the user may see it. The column is always a constant chosen by the caller,
+// never user input.
+func (m *ChunkModel) get(ctx context.Context, column string, value any, userID int) (*Chunk, error) {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
 
-    // Use the QueryRow() method on the connection pool to execute our
-    // SQL statement, passing in the untrusted id variable as the value for the
+    // Join the chunk to its parent (if any) to get the slug of the parent,
+    // unless the user can't see the parent, and to its workspace (if any)
+    // to get its slug and name. Whether the user may edit or share the
+    // chunk is worked out along the way; owned is NULL rather than false
+    // for chunks created by people who weren't logged in.
+    owned, ownedArgs := ownedBy("c", userID)
+    editable, editableArgs := sharedWith("c", userID, PermissionEdit)
+    parentVisible, parentArgs := visibleTo("p", userID)
+    visible, visibleArgs := visibleTo("c", userID)
+    stmt := `SELECT c.id, c.slug, c.title, c.size, c.user_id, c.created, c.expires, c.forked_from, p.slug,
+    c.workspace_id, w.slug, w.name, c.private, (` + owned + `) IS TRUE, ` + editable + `
+    FROM chunks c LEFT JOIN chunks p ON p.id = c.forked_from AND ` + parentVisible + `
+    LEFT JOIN workspaces w ON w.id = c.workspace_id
+    WHERE c.expires > UTC_TIMESTAMP() AND ` + column + ` = ? AND ` + visible
+
+    var args []any
+    args = append(args, ownedArgs...)
+    args = append(args, editableArgs...)
+    args = append(args, parentArgs...)
+    args = append(args, value)
+    args = append(args, visibleArgs...)
+
+    // Use the QueryRowContext() method on the connection pool to execute our
+    // SQL statement, passing in the untrusted value as the value for the
     // placeholder parameter. This returns a pointer to a sql.Row object which
     // holds the result from the database.
-    row := m.DB.QueryRow(stmt, id)
+    row := m.DB.QueryRowContext(ctx, stmt, args...)
 
     // initialize a pointer to a new chunk struct
     c := &Chunk{}
     // Use row.Scan() to copy the values from each field in sql.Row to the
-    // corresponding field in the Snippet struct. Notice that the arguments
+    // corresponding field in the Chunk struct. Notice that the arguments
     // to row.Scan are *pointers* to the place you want to copy the data into,
     // and the number of arguments must be exactly the same as the number of
     // columns returned by your statement.
-    err := row.Scan(&c.ID, &c.Title, &c.Content, &c.Created, &c.Expires)
+    // forked_from (and so the parent's slug) is NULL for chunks which aren't
+    // forks, so scan them into sql.Null* values first.
+    // The same goes for user_id, for chunks created by people who weren't
+    // logged in, and the workspace of public chunks.
+    var owner, parent, workspaceID sql.NullInt64
+    var parentSlug, workspaceSlug, workspaceName sql.NullString
+    err := row.Scan(&c.ID, &c.Slug, &c.Title, &c.Size, &owner, &c.Created, &c.Expires, &parent, &parentSlug,
+        &workspaceID, &workspaceSlug, &workspaceName, &c.Private, &c.CanShare, &c.CanEdit)
 
     if err != nil {
         // If the query returns no rows, then row.Scan() will return a
@@ -74,22 +308,65 @@ func (m *ChunkModel) Get(id int) (*Chunk, error) {
             return nil, err
         }
     }
+    c.UserID = int(owner.Int64)
+    c.ForkedFrom = int(parent.Int64)
+    c.ForkedFromSlug = parentSlug.String
+    c.WorkspaceID = int(workspaceID.Int64)
+    c.WorkspaceSlug = workspaceSlug.String
+    c.WorkspaceName = workspaceName.String
+    // Whoever may share the chunk may also edit it.
+    c.CanEdit = c.CanEdit || c.CanShare
+
+    c.Files, err = m.files(ctx, c.ID)
+    if err != nil {
+        return nil, err
+    }
     // return chunk object
     return c, nil
 }
 
-// This will return the 10 most recently created snippets.
+// files returns the files of a chunk in position order.
+func (m *ChunkModel) files(ctx context.Context, chunkID int) ([]*File, error) {
+    stmt := `SELECT id, name, content, content_type, language FROM chunk_files
+    WHERE chunk_id = ? ORDER BY position`
+
+    rows, err := m.DB.QueryContext(ctx, stmt, chunkID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    files := []*File{}
+    for rows.Next() {
+        f := &File{}
+        err = rows.Scan(&f.ID, &f.Name, &f.Content, &f.ContentType, &f.Language)
+        if err != nil {
+            return nil, err
+        }
+        files = append(files, f)
+    }
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+    return files, nil
+}
+
+// This will return the 10 most recently created public snippets. Chunks
+// in workspaces are listed by InWorkspace() and ForUser() instead, and those
+// shared with a user by SharedWith().
 // We use slice of pointers to Chunk
-func (m *ChunkModel) Latest() ([]*Chunk, error) {
+func (m *ChunkModel) Latest(ctx context.Context) ([]*Chunk, error) {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
 
  // Write the SQL statement we want to execute.
-    stmt := `SELECT id, title, content, created, expires FROM chunks
-    WHERE expires > UTC_TIMESTAMP() ORDER BY id DESC LIMIT 10`
+    stmt := `SELECT id, slug, title, created, expires FROM chunks
+    WHERE expires > UTC_TIMESTAMP() AND workspace_id IS NULL AND NOT private ORDER BY id DESC LIMIT 10`
 
-    // Use the Query() method on the connection pool to execute our
+    // Use the QueryContext() method on the connection pool to execute our
     // SQL statement. This returns a sql.Rows resultset containing the result of
     // our query.
-    rows, err := m.DB.Query(stmt)
+    rows, err := m.DB.QueryContext(ctx, stmt)
     if err != nil {
         return nil, err
     }
@@ -116,7 +393,7 @@ func (m *ChunkModel) Latest() ([]*Chunk, error) {
         // must be pointers to the place you want to copy the data into, and the
         // number of arguments must be exactly the same as the number of
         // columns returned by your statement.
-        err = rows.Scan(&c.ID, &c.Title, &c.Content, &c.Created, &c.Expires)
+        err = rows.Scan(&c.ID, &c.Slug, &c.Title, &c.Created, &c.Expires)
         if err != nil{
             return nil, err
         }
@@ -134,3 +411,319 @@ func (m *ChunkModel) Latest() ([]*Chunk, error) {
     // If everything went OK then return the Chunks slice.
     return chunks, nil
 }
+
+// ForUser returns the 10 most recently created live chunks which the user
+// owns: their own chunks, and those of the workspaces they belong to. The
+// workspace of each chunk is loaded along with it.
+func (m *ChunkModel) ForUser(ctx context.Context, userID int) ([]*Chunk, error) {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    owned, args := ownedBy("c", userID)
+    stmt := `SELECT c.id, c.slug, c.title, c.created, c.expires, c.private, w.id, w.slug, w.name
+    FROM chunks c LEFT JOIN workspaces w ON w.id = c.workspace_id
+    WHERE c.expires > UTC_TIMESTAMP() AND ` + owned + ` ORDER BY c.id DESC LIMIT 10`
+
+    rows, err := m.DB.QueryContext(ctx, stmt, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    chunks := []*Chunk{}
+    for rows.Next() {
+        c := &Chunk{}
+        // The workspace columns are NULL for the user's own chunks.
+        var workspaceID sql.NullInt64
+        var workspaceSlug, workspaceName sql.NullString
+        err = rows.Scan(&c.ID, &c.Slug, &c.Title, &c.Created, &c.Expires, &c.Private,
+            &workspaceID, &workspaceSlug, &workspaceName)
+        if err != nil {
+            return nil, err
+        }
+        c.WorkspaceID = int(workspaceID.Int64)
+        c.WorkspaceSlug = workspaceSlug.String
+        c.WorkspaceName = workspaceName.String
+        chunks = append(chunks, c)
+    }
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+    return chunks, nil
+}
+
+// Forks returns the chunks which were forked from the given chunk and haven't
+// expired yet, newest first. Only the forks the user may see are returned.
+func (m *ChunkModel) Forks(ctx context.Context, id int, userID int) ([]*Chunk, error) {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    visible, args := visibleTo("c", userID)
+    stmt := `SELECT c.id, c.slug, c.title, c.created, c.expires FROM chunks c
+    WHERE c.expires > UTC_TIMESTAMP() AND c.forked_from = ? AND ` + visible + `
+    ORDER BY c.id DESC`
+
+    rows, err := m.DB.QueryContext(ctx, stmt, append([]any{id}, args...)...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    chunks := []*Chunk{}
+    for rows.Next() {
+        c := &Chunk{ForkedFrom: id}
+        err = rows.Scan(&c.ID, &c.Slug, &c.Title, &c.Created, &c.Expires)
+        if err != nil {
+            return nil, err
+        }
+        chunks = append(chunks, c)
+    }
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+    return chunks, nil
+}
+
+// Delete deletes the chunk with the given slug, along with its files, if it
+// belongs to the user. A chunk in a workspace belongs to the workspace, so
+// any member may delete it, and whoever created it only while they are a
+// member. Being able to edit a chunk someone shared isn't enough. It
+// returns ErrNoRecord if the user has no such chunk, so that nobody can
+// find out about chunks which aren't theirs. Forks of the chunk are kept,
+// and simply stop being forks.
+func (m *ChunkModel) Delete(ctx context.Context, slug string, userID int) error {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    owned, args := ownedBy("chunks", userID)
+    stmt := `DELETE FROM chunks WHERE slug = ? AND ` + owned
+
+    result, err := m.DB.ExecContext(ctx, stmt, append([]any{slug}, args...)...)
+    if err != nil {
+        return err
+    }
+    n, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        return ErrNoRecord
+    }
+    return nil
+}
+
+// Update replaces the title and files of a live chunk, if the user may edit
+// it: they own it, or it was shared with them with the edit permission. It
+// returns ErrNoRecord if there is no such chunk the user may edit. A chunk
+// which grows counts against the quota of whoever created it, and if it no
+// longer fits ErrQuotaExceeded is returned.
+func (m *ChunkModel) Update(ctx context.Context, slug string, userID int, title string, files []*File) error {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    tx, err := m.DB.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    // Lock the chunk, so that two edits at once can't mix their files.
+    owned, ownedArgs := ownedBy("c", userID)
+    editable, editableArgs := sharedWith("c", userID, PermissionEdit)
+    stmt := `SELECT c.id, c.size, c.user_id, c.owner_ip FROM chunks c
+    WHERE c.slug = ? AND c.expires > UTC_TIMESTAMP() AND (` + owned + ` OR ` + editable + `) FOR UPDATE`
+    args := append([]any{slug}, ownedArgs...)
+    args = append(args, editableArgs...)
+
+    var id int
+    var oldSize int64
+    var creator sql.NullInt64
+    var creatorIP sql.NullString
+    err = tx.QueryRowContext(ctx, stmt, args...).Scan(&id, &oldSize, &creator, &creatorIP)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            return ErrNoRecord
+        }
+        return err
+    }
+
+    var size int64
+    for _, f := range files {
+        size += int64(len(f.Content))
+    }
+    if size > oldSize {
+        owner := Owner{UserID: int(creator.Int64), IP: creatorIP.String}
+        u, err := usage(ctx, tx, owner, true)
+        if err != nil {
+            return err
+        }
+        quota := m.QuotaFor(owner)
+        if quota.MaxBytes > 0 && u.Bytes-oldSize+size > quota.MaxBytes {
+            return ErrQuotaExceeded
+        }
+    }
+
+    _, err = tx.ExecContext(ctx, `UPDATE chunks SET title = ?, size = ? WHERE id = ?`, title, size, id)
+    if err != nil {
+        return err
+    }
+    _, err = tx.ExecContext(ctx, `DELETE FROM chunk_files WHERE chunk_id = ?`, id)
+    if err != nil {
+        return err
+    }
+    err = insertFiles(ctx, tx, id, files)
+    if err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// Expired reports whether the chunk has expired. Only Search() returns
+// expired chunks.
+func (c *Chunk) Expired() bool {
+    return !c.Expires.After(time.Now())
+}
+
+// Search returns the chunks whose slug or title contains the query, or all
+// chunks if it is empty, newest first. Unlike the other methods it includes
+// expired chunks, as it is meant for moderators. It returns at most limit
+// chunks after skipping offset of them, and whether there are more.
+func (m *ChunkModel) Search(ctx context.Context, query string, limit, offset int) ([]*Chunk, bool, error) {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    stmt := `SELECT c.id, c.slug, c.title, c.size, c.owner_ip, c.user_id, u.email, c.created, c.expires
+    FROM chunks c LEFT JOIN users u ON u.id = c.user_id
+    WHERE c.slug LIKE ? OR c.title LIKE ? ORDER BY c.id DESC LIMIT ? OFFSET ?`
+    pattern := likePattern(query)
+
+    // Ask for one more than we need, to find out whether there are more.
+    rows, err := m.DB.QueryContext(ctx, stmt, pattern, pattern, limit+1, offset)
+    if err != nil {
+        return nil, false, err
+    }
+    defer rows.Close()
+
+    chunks := []*Chunk{}
+    for rows.Next() {
+        c := &Chunk{}
+        // Chunks from before we kept track of owners have no owner_ip.
+        var userID sql.NullInt64
+        var ownerIP, email sql.NullString
+        err = rows.Scan(&c.ID, &c.Slug, &c.Title, &c.Size, &ownerIP, &userID, &email, &c.Created, &c.Expires)
+        if err != nil {
+            return nil, false, err
+        }
+        c.OwnerIP = ownerIP.String
+        c.UserID = int(userID.Int64)
+        c.UserEmail = email.String
+        chunks = append(chunks, c)
+    }
+    if err = rows.Err(); err != nil {
+        return nil, false, err
+    }
+    if len(chunks) > limit {
+        return chunks[:limit], true, nil
+    }
+    return chunks, false, nil
+}
+
+// InWorkspace returns the live chunks of a workspace whose slug or title
+// contains the query, or all of them if it is empty, newest first. It
+// returns at most limit chunks after skipping offset of them, and whether
+// there are more. The caller checks that the user may see the workspace.
+func (m *ChunkModel) InWorkspace(ctx context.Context, workspaceID int, query string, limit, offset int) ([]*Chunk, bool, error) {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    stmt := `SELECT id, slug, title, created, expires FROM chunks
+    WHERE workspace_id = ? AND expires > UTC_TIMESTAMP() AND (slug LIKE ? OR title LIKE ?)
+    ORDER BY id DESC LIMIT ? OFFSET ?`
+    pattern := likePattern(query)
+
+    // Ask for one more than we need, to find out whether there are more.
+    rows, err := m.DB.QueryContext(ctx, stmt, workspaceID, pattern, pattern, limit+1, offset)
+    if err != nil {
+        return nil, false, err
+    }
+    defer rows.Close()
+
+    chunks := []*Chunk{}
+    for rows.Next() {
+        c := &Chunk{WorkspaceID: workspaceID}
+        err = rows.Scan(&c.ID, &c.Slug, &c.Title, &c.Created, &c.Expires)
+        if err != nil {
+            return nil, false, err
+        }
+        chunks = append(chunks, c)
+    }
+    if err = rows.Err(); err != nil {
+        return nil, false, err
+    }
+    if len(chunks) > limit {
+        return chunks[:limit], true, nil
+    }
+    return chunks, false, nil
+}
+
+// DeleteAny deletes the chunk with the given slug, expired or not, whoever
+// it belongs to. It is for moderators; users can only Delete() their own
+// chunks. It returns ErrNoRecord if there is no such chunk.
+func (m *ChunkModel) DeleteAny(ctx context.Context, slug string) error {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    result, err := m.DB.ExecContext(ctx, `DELETE FROM chunks WHERE slug = ?`, slug)
+    if err != nil {
+        return err
+    }
+    n, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        return ErrNoRecord
+    }
+    return nil
+}
+
+// Extend pushes back the expiry of a chunk by the given number of days. An
+// expired chunk comes back to life, expiring that many days from now. It
+// returns ErrNoRecord if there is no such chunk.
+func (m *ChunkModel) Extend(ctx context.Context, slug string, days int) error {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    stmt := `UPDATE chunks SET expires = DATE_ADD(GREATEST(expires, UTC_TIMESTAMP()), INTERVAL ? DAY)
+    WHERE slug = ?`
+
+    result, err := m.DB.ExecContext(ctx, stmt, days, slug)
+    if err != nil {
+        return err
+    }
+    // The expiry always changes, so no rows affected means no chunk.
+    n, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        return ErrNoRecord
+    }
+    return nil
+}
+
+// Counts returns the number of chunks which are still live and the number
+// which have expired but are still in the database.
+func (m *ChunkModel) Counts(ctx context.Context) (live int, expired int, err error) {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    stmt := `SELECT COALESCE(SUM(expires > UTC_TIMESTAMP()), 0),
+    COALESCE(SUM(expires <= UTC_TIMESTAMP()), 0) FROM chunks`
+
+    err = m.DB.QueryRowContext(ctx, stmt).Scan(&live, &expired)
+    if err != nil {
+        return 0, 0, err
+    }
+    return live, expired, nil
+}
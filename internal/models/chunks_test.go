@@ -0,0 +1,123 @@
+package models
+
+import (
+    "context"
+    "database/sql"
+    "testing"
+
+    "github.com/cpucortexm/chunkbox/internal/assert"
+)
+
+// newTeamTestDB returns a test database where Alice (user 1) owns the
+// workspace "team" (workspace 1), which Bob (user 2) belongs to.
+func newTeamTestDB(t *testing.T) *sql.DB {
+    t.Helper()
+
+    db := newTestDB(t)
+    ctx := context.Background()
+    users := &UserModel{DB: db}
+    err := users.Insert(ctx, "Alice", "alice@example.com", "pa55word!")
+    assert.NilError(t, err)
+    err = users.Insert(ctx, "Bob", "bob@example.com", "pa55word!")
+    assert.NilError(t, err)
+    workspaces := &WorkspaceModel{DB: db}
+    err = workspaces.Insert(ctx, 1, "Team", "team")
+    assert.NilError(t, err)
+    err = workspaces.AddMember(ctx, 1, "bob@example.com", WorkspaceMember)
+    assert.NilError(t, err)
+    return db
+}
+
+func TestChunkUpdate(t *testing.T) {
+    m := &ChunkModel{DB: newTeamTestDB(t), UserQuota: Quota{MaxBytes: 20}}
+    ctx := context.Background()
+    files := func(contents ...string) []*File {
+        var files []*File
+        for i, content := range contents {
+            files = append(files, &File{Name: string(rune('a'+i)) + ".txt", Content: content, ContentType: ContentTypeCode})
+        }
+        return files
+    }
+    own, err := m.Insert(ctx, Owner{UserID: 1}, "Own", "", files("12345", "678"), 7, 0, false)
+    assert.NilError(t, err)
+    team, err := m.Insert(ctx, Owner{UserID: 1, WorkspaceID: 1}, "Team", "", files("12345"), 7, 0, false)
+    assert.NilError(t, err)
+    anonymous, err := m.Insert(ctx, Owner{IP: "203.0.113.7"}, "Anonymous", "", files("12345"), 7, 0, false)
+    assert.NilError(t, err)
+
+    tests := []struct {
+        name     string
+        slug     string
+        userID   int
+        wantEdit bool
+    }{
+        {"Own chunk", own, 1, true},
+        {"Someone else's chunk", own, 2, false},
+        {"Not logged in", own, 0, false},
+        {"Workspace chunk", team, 2, true},
+        {"Anonymous chunk", anonymous, 0, false},
+        {"Missing chunk", "missing", 1, false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if tt.slug != "missing" {
+                c, err := m.GetBySlug(ctx, tt.slug, tt.userID)
+                assert.NilError(t, err)
+                assert.Equal(t, c.CanEdit, tt.wantEdit)
+            }
+
+            err := m.Update(ctx, tt.slug, tt.userID, tt.name, files("123"))
+            if !tt.wantEdit {
+                assert.Equal(t, err, ErrNoRecord)
+                return
+            }
+            assert.NilError(t, err)
+
+            // The title and all of the files are replaced.
+            c, err := m.GetBySlug(ctx, tt.slug, tt.userID)
+            assert.NilError(t, err)
+            assert.Equal(t, c.Title, tt.name)
+            assert.Equal(t, c.Size, int64(3))
+            assert.Equal(t, len(c.Files), 1)
+            assert.Equal(t, c.Files[0].Content, "123")
+        })
+    }
+}
+
+func TestChunkUpdateQuota(t *testing.T) {
+    m := &ChunkModel{DB: newTeamTestDB(t), UserQuota: Quota{MaxBytes: 20}}
+    ctx := context.Background()
+    files := func(content string) []*File {
+        return []*File{{Name: "a.txt", Content: content, ContentType: ContentTypeCode}}
+    }
+    own, err := m.Insert(ctx, Owner{UserID: 1}, "Own", "", files("12345"), 7, 0, false)
+    assert.NilError(t, err)
+    team, err := m.Insert(ctx, Owner{UserID: 1, WorkspaceID: 1}, "Team", "", files("12345"), 7, 0, false)
+    assert.NilError(t, err)
+
+    // Alice has used 10 of her 20 bytes, so her chunk can grow by 10 bytes
+    // but no more.
+    err = m.Update(ctx, own, 1, "Own", files("123456789012345"))
+    assert.NilError(t, err)
+    err = m.Update(ctx, own, 1, "Too big", files("1234567890123456"))
+    assert.Equal(t, err, ErrQuotaExceeded)
+    c, err := m.GetBySlug(ctx, own, 1)
+    assert.NilError(t, err)
+    assert.Equal(t, c.Title, "Own")
+    assert.Equal(t, c.Size, int64(15))
+
+    // Bob has no chunks of his own, but the workspace chunk Alice created
+    // counts against her quota, whoever edits it.
+    err = m.Update(ctx, team, 2, "Team", files("123456"))
+    assert.Equal(t, err, ErrQuotaExceeded)
+
+    // A chunk can always shrink, even when its creator is over quota.
+    m.UserQuota.MaxBytes = 5
+    err = m.Update(ctx, team, 2, "Team", files("1234"))
+    assert.NilError(t, err)
+
+    u, err := m.Usage(ctx, Owner{UserID: 1})
+    assert.NilError(t, err)
+    assert.Equal(t, u, Usage{Chunks: 2, Bytes: 19})
+}
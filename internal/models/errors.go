@@ -5,3 +5,53 @@ import (
 )
 
 var ErrNoRecord = errors.New("models: no matching record found")
+
+// ErrDuplicateSlug is returned when a custom slug is already used by a chunk
+// which hasn't expired.
+var ErrDuplicateSlug = errors.New("models: duplicate slug")
+
+// ErrNotMigrated is returned when the database has no schema_migrations
+// table, because the migrations have never been run against it.
+var ErrNotMigrated = errors.New("models: database has not been migrated")
+
+// ErrQuotaExceeded is returned when creating a chunk would take its owner
+// over their quota.
+var ErrQuotaExceeded = errors.New("models: quota exceeded")
+
+// ErrInvalidCredentials is returned when a user tries to log in with an
+// incorrect email address or password, or uses an unknown API token.
+var ErrInvalidCredentials = errors.New("models: invalid credentials")
+
+// ErrDuplicateEmail is returned when a user tries to sign up with an email
+// address that's already in use.
+var ErrDuplicateEmail = errors.New("models: duplicate email")
+
+// ErrUserDisabled is returned when a user who has been disabled by an admin
+// tries to log in.
+var ErrUserDisabled = errors.New("models: user disabled")
+
+// ErrLinkRequired is returned when someone logs in with single sign-on for
+// the first time, and a user with a password already has their email
+// address. Only that user can link the two, by logging in with their
+// password and confirming it.
+var ErrLinkRequired = errors.New("models: identity must be linked by the user")
+
+// ErrIdentityTaken is returned when a single sign-on identity is linked to
+// a user, but already belongs to another.
+var ErrIdentityTaken = errors.New("models: identity belongs to another user")
+
+// ErrAlreadyMember is returned when a user is added to a workspace they
+// already belong to.
+var ErrAlreadyMember = errors.New("models: already a member")
+
+// ErrLastOwner is returned when a change would leave a workspace without
+// an owner.
+var ErrLastOwner = errors.New("models: last owner of workspace")
+
+// ErrNotMember is returned when a user tries to create a chunk in a
+// workspace they don't belong to.
+var ErrNotMember = errors.New("models: not a member of the workspace")
+
+// ErrUnknownGrantee is returned when a chunk is shared with a user or
+// workspace which doesn't exist, or a workspace the user doesn't belong to.
+var ErrUnknownGrantee = errors.New("models: unknown user or workspace")
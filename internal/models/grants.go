@@ -0,0 +1,273 @@
+package models
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "time"
+)
+
+// Who may see and change a chunk:
+//
+//   - Everyone may see a public chunk: one outside any workspace which
+//     isn't private.
+//   - The owners of a chunk may see, edit, share and delete it. A chunk in
+//     a workspace is owned by all of its members, any other chunk by whoever
+//     created it.
+//   - A grant shares a chunk with a user, or with every member of a
+//     workspace. The read permission lets them see it, and the edit
+//     permission also lets them change its title and files.
+//
+// The rules are SQL conditions, so that the model can't hand out a chunk
+// to someone who may not have it.
+
+// The permissions a grant can give.
+const (
+    PermissionRead = "read"
+    PermissionEdit = "edit"
+)
+
+// Permissions lists the permissions a grant can give, weakest first.
+var Permissions = []string{PermissionRead, PermissionEdit}
+
+// Grant shares a chunk with a user or with the members of a workspace.
+type Grant struct {
+    ID         int
+    ChunkID    int
+    Permission string
+    Created    time.Time
+    // A grant to a user has their ID, name and email address; a grant to a
+    // workspace has its ID, name and slug instead.
+    UserID        int
+    UserName      string
+    UserEmail     string
+    WorkspaceID   int
+    WorkspaceName string
+    WorkspaceSlug string
+}
+
+// ownedBy returns the SQL condition, and its arguments, for the chunks
+// (with the given table alias) which the user owns: those they created
+// outside a workspace, and those of the workspaces they belong to. Someone
+// who isn't logged in has the ID 0, and owns nothing.
+func ownedBy(alias string, userID int) (string, []any) {
+    stmt := `((` + alias + `.workspace_id IS NULL AND ` + alias + `.user_id = ?) OR ` + alias + `.workspace_id IN
+    (SELECT workspace_id FROM workspace_members WHERE user_id = ?))`
+    return stmt, []any{userID, userID}
+}
+
+// sharedWith returns the SQL condition, and its arguments, for the chunks
+// which have been shared with the user, or with a workspace they belong
+// to, with at least the given permission.
+func sharedWith(alias string, userID int, permission string) (string, []any) {
+    stmt := `EXISTS(SELECT true FROM chunk_grants g WHERE g.chunk_id = ` + alias + `.id AND
+    (g.user_id = ? OR g.workspace_id IN (SELECT workspace_id FROM workspace_members WHERE user_id = ?))`
+    args := []any{userID, userID}
+    if permission == PermissionEdit {
+        stmt += ` AND g.permission = ?`
+        args = append(args, PermissionEdit)
+    }
+    return stmt + `)`, args
+}
+
+// visibleTo returns the SQL condition, and its arguments, for the chunks
+// which the user may see: the public ones, their own, and those shared with
+// them.
+func visibleTo(alias string, userID int) (string, []any) {
+    owned, args := ownedBy(alias, userID)
+    shared, sharedArgs := sharedWith(alias, userID, PermissionRead)
+    stmt := `((` + alias + `.workspace_id IS NULL AND NOT ` + alias + `.private) OR ` + owned + ` OR ` + shared + `)`
+    return stmt, append(args, sharedArgs...)
+}
+
+// owns reports whether the user owns the chunk, live or not.
+func (m *ChunkModel) owns(ctx context.Context, chunkID int, userID int) (bool, error) {
+    owned, args := ownedBy("c", userID)
+    stmt := `SELECT EXISTS(SELECT true FROM chunks c WHERE c.id = ? AND ` + owned + `)`
+
+    var ok bool
+    err := m.DB.QueryRowContext(ctx, stmt, append([]any{chunkID}, args...)...).Scan(&ok)
+    if err != nil {
+        return false, err
+    }
+    return ok, nil
+}
+
+// Grants returns the grants of a chunk, oldest first.
+func (m *ChunkModel) Grants(ctx context.Context, chunkID int) ([]*Grant, error) {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    stmt := `SELECT g.id, g.permission, g.created, g.user_id, u.name, u.email, g.workspace_id, w.name, w.slug
+    FROM chunk_grants g LEFT JOIN users u ON u.id = g.user_id
+    LEFT JOIN workspaces w ON w.id = g.workspace_id
+    WHERE g.chunk_id = ? ORDER BY g.id`
+
+    rows, err := m.DB.QueryContext(ctx, stmt, chunkID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    grants := []*Grant{}
+    for rows.Next() {
+        g := &Grant{ChunkID: chunkID}
+        // Each grant has either a user or a workspace, the other columns are
+        // NULL.
+        var userID, workspaceID sql.NullInt64
+        var userName, userEmail, workspaceName, workspaceSlug sql.NullString
+        err = rows.Scan(&g.ID, &g.Permission, &g.Created, &userID, &userName, &userEmail,
+            &workspaceID, &workspaceName, &workspaceSlug)
+        if err != nil {
+            return nil, err
+        }
+        g.UserID = int(userID.Int64)
+        g.UserName = userName.String
+        g.UserEmail = userEmail.String
+        g.WorkspaceID = int(workspaceID.Int64)
+        g.WorkspaceName = workspaceName.String
+        g.WorkspaceSlug = workspaceSlug.String
+        grants = append(grants, g)
+    }
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+    return grants, nil
+}
+
+// ShareWithUser shares a chunk owned by the user "by" with the user who has
+// the email address. Sharing it with them again changes the permission. It
+// returns ErrNoRecord if "by" doesn't own the chunk, and ErrUnknownGrantee
+// if there is no user with the email address.
+func (m *ChunkModel) ShareWithUser(ctx context.Context, chunkID int, by int, email string, permission string) error {
+    return m.share(ctx, chunkID, by, "user_id", `SELECT id FROM users WHERE email = ?`, []any{email}, permission)
+}
+
+// ShareWithWorkspace shares a chunk owned by the user "by" with every member
+// of the workspace with the slug. Users can only share with workspaces they
+// belong to, so it returns ErrUnknownGrantee for any other workspace, and
+// ErrNoRecord if "by" doesn't own the chunk.
+func (m *ChunkModel) ShareWithWorkspace(ctx context.Context, chunkID int, by int, slug string, permission string) error {
+    stmt := `SELECT w.id FROM workspaces w JOIN workspace_members wm ON wm.workspace_id = w.id
+    WHERE w.slug = ? AND wm.user_id = ?`
+    return m.share(ctx, chunkID, by, "workspace_id", stmt, []any{slug, by}, permission)
+}
+
+// share adds or changes the grant of a chunk to the user or workspace which
+// the lookup statement finds. The column is "user_id" or "workspace_id",
+// never user input.
+func (m *ChunkModel) share(ctx context.Context, chunkID int, by int, column string, lookup string, lookupArgs []any, permission string) error {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    ok, err := m.owns(ctx, chunkID, by)
+    if err != nil {
+        return err
+    }
+    if !ok {
+        return ErrNoRecord
+    }
+
+    var grantee int
+    err = m.DB.QueryRowContext(ctx, lookup, lookupArgs...).Scan(&grantee)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            return ErrUnknownGrantee
+        }
+        return err
+    }
+
+    // The unique constraints on (chunk_id, user_id) and (chunk_id,
+    // workspace_id) turn a second grant to the same grantee into an update.
+    stmt := `INSERT INTO chunk_grants (chunk_id, ` + column + `, permission, created)
+    VALUES(?, ?, ?, UTC_TIMESTAMP()) ON DUPLICATE KEY UPDATE permission = VALUES(permission)`
+    _, err = m.DB.ExecContext(ctx, stmt, chunkID, grantee, permission)
+    return err
+}
+
+// Unshare removes a grant from a chunk owned by the user "by". It returns
+// ErrNoRecord if "by" doesn't own the chunk or it has no such grant.
+func (m *ChunkModel) Unshare(ctx context.Context, chunkID int, by int, grantID int) error {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    ok, err := m.owns(ctx, chunkID, by)
+    if err != nil {
+        return err
+    }
+    if !ok {
+        return ErrNoRecord
+    }
+
+    result, err := m.DB.ExecContext(ctx, `DELETE FROM chunk_grants WHERE id = ? AND chunk_id = ?`, grantID, chunkID)
+    if err != nil {
+        return err
+    }
+    n, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        return ErrNoRecord
+    }
+    return nil
+}
+
+// SetPrivate makes a chunk owned by the user "by" private, or public again.
+// It returns ErrNoRecord if "by" doesn't own the chunk.
+func (m *ChunkModel) SetPrivate(ctx context.Context, chunkID int, by int, private bool) error {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    ok, err := m.owns(ctx, chunkID, by)
+    if err != nil {
+        return err
+    }
+    if !ok {
+        return ErrNoRecord
+    }
+
+    _, err = m.DB.ExecContext(ctx, `UPDATE chunks SET private = ? WHERE id = ?`, private, chunkID)
+    return err
+}
+
+// SharedWith returns the live chunks which have been shared with the user,
+// or with a workspace they belong to, newest first. CanEdit is set on those
+// they may edit. It returns at most limit chunks after skipping offset of
+// them, and whether there are more.
+func (m *ChunkModel) SharedWith(ctx context.Context, userID int, limit, offset int) ([]*Chunk, bool, error) {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    // A chunk can be shared with the user more than once, directly and
+    // through their workspaces, so group the grants by chunk.
+    stmt := `SELECT c.id, c.slug, c.title, c.created, c.expires, MAX(g.permission = ?)
+    FROM chunks c JOIN chunk_grants g ON g.chunk_id = c.id
+    WHERE c.expires > UTC_TIMESTAMP() AND
+    (g.user_id = ? OR g.workspace_id IN (SELECT workspace_id FROM workspace_members WHERE user_id = ?))
+    GROUP BY c.id ORDER BY c.id DESC LIMIT ? OFFSET ?`
+
+    // Ask for one more than we need, to find out whether there are more.
+    rows, err := m.DB.QueryContext(ctx, stmt, PermissionEdit, userID, userID, limit+1, offset)
+    if err != nil {
+        return nil, false, err
+    }
+    defer rows.Close()
+
+    chunks := []*Chunk{}
+    for rows.Next() {
+        c := &Chunk{}
+        err = rows.Scan(&c.ID, &c.Slug, &c.Title, &c.Created, &c.Expires, &c.CanEdit)
+        if err != nil {
+            return nil, false, err
+        }
+        chunks = append(chunks, c)
+    }
+    if err = rows.Err(); err != nil {
+        return nil, false, err
+    }
+    if len(chunks) > limit {
+        return chunks[:limit], true, nil
+    }
+    return chunks, false, nil
+}
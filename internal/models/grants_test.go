@@ -0,0 +1,379 @@
+package models
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "testing"
+
+    "github.com/cpucortexm/chunkbox/internal/assert"
+)
+
+// grantsFixture is a test database with three users: alice owns the
+// workspace "team", bob is a plain member of it and carol belongs to no
+// workspace. Someone who isn't logged in has the ID 0.
+type grantsFixture struct {
+    chunks     *ChunkModel
+    workspaces *WorkspaceModel
+    alice      int
+    bob        int
+    carol      int
+    team       int
+}
+
+func newGrantsFixture(t *testing.T) *grantsFixture {
+    t.Helper()
+
+    db := newTestDB(t)
+    f := &grantsFixture{
+        chunks:     &ChunkModel{DB: db},
+        workspaces: &WorkspaceModel{DB: db},
+    }
+    f.alice = insertTestUser(t, db, "Alice", "alice@example.com")
+    f.bob = insertTestUser(t, db, "Bob", "bob@example.com")
+    f.carol = insertTestUser(t, db, "Carol", "carol@example.com")
+
+    ctx := context.Background()
+    err := f.workspaces.Insert(ctx, f.alice, "Team", "team")
+    assert.NilError(t, err)
+    ws, err := f.workspaces.Get(ctx, "team", f.alice)
+    assert.NilError(t, err)
+    f.team = ws.ID
+    err = f.workspaces.AddMember(ctx, f.team, "bob@example.com", WorkspaceMember)
+    assert.NilError(t, err)
+    return f
+}
+
+// insertTestUser adds a user without a password, which saves hashing one,
+// and returns their ID.
+func insertTestUser(t *testing.T, db *sql.DB, name, email string) int {
+    t.Helper()
+
+    result, err := db.Exec(`INSERT INTO users (name, email, created) VALUES(?, ?, UTC_TIMESTAMP())`, name, email)
+    assert.NilError(t, err)
+    id, err := result.LastInsertId()
+    assert.NilError(t, err)
+    return int(id)
+}
+
+// insert adds a chunk with a single file for the owner, and returns its
+// slug and ID.
+func (f *grantsFixture) insert(t *testing.T, owner Owner, private bool) (string, int) {
+    t.Helper()
+
+    files := []*File{{Name: "main.go", Content: "package main", ContentType: ContentTypeCode, Language: "go"}}
+    slug, err := f.chunks.Insert(context.Background(), owner, "A chunk", "", files, 7, 0, private)
+    assert.NilError(t, err)
+    c, err := f.chunks.GetBySlug(context.Background(), slug, owner.UserID)
+    assert.NilError(t, err)
+    return slug, c.ID
+}
+
+// get returns the chunk if the user may see it, or nil if they may not.
+func (f *grantsFixture) get(t *testing.T, slug string, userID int) *Chunk {
+    t.Helper()
+
+    c, err := f.chunks.GetBySlug(context.Background(), slug, userID)
+    if errors.Is(err, ErrNoRecord) {
+        return nil
+    }
+    assert.NilError(t, err)
+    return c
+}
+
+// assertAccess checks whether the user may see, edit and share the chunk.
+func (f *grantsFixture) assertAccess(t *testing.T, slug string, userID int, see, edit, share bool) {
+    t.Helper()
+
+    c := f.get(t, slug, userID)
+    assert.Equal(t, c != nil, see)
+    if c == nil {
+        return
+    }
+    assert.Equal(t, c.CanEdit, edit)
+    assert.Equal(t, c.CanShare, share)
+}
+
+// sharedWith returns the IDs of the chunks SharedWith() lists for the user,
+// and whether they may edit each one.
+func (f *grantsFixture) sharedWith(t *testing.T, userID int) map[int]bool {
+    t.Helper()
+
+    chunks, _, err := f.chunks.SharedWith(context.Background(), userID, 10, 0)
+    assert.NilError(t, err)
+    shared := make(map[int]bool)
+    for _, c := range chunks {
+        shared[c.ID] = c.CanEdit
+    }
+    return shared
+}
+
+func TestVisibilityPublic(t *testing.T) {
+    f := newGrantsFixture(t)
+    slug, _ := f.insert(t, Owner{UserID: f.alice}, false)
+
+    f.assertAccess(t, slug, f.alice, true, true, true)
+    f.assertAccess(t, slug, f.bob, true, false, false)
+    f.assertAccess(t, slug, f.carol, true, false, false)
+    f.assertAccess(t, slug, 0, true, false, false)
+}
+
+func TestVisibilityAnonymousChunk(t *testing.T) {
+    f := newGrantsFixture(t)
+    slug, _ := f.insert(t, Owner{IP: "192.0.2.1"}, false)
+
+    // Nobody owns a chunk created by someone who wasn't logged in, not even
+    // someone else who isn't logged in.
+    f.assertAccess(t, slug, 0, true, false, false)
+    f.assertAccess(t, slug, f.alice, true, false, false)
+}
+
+func TestVisibilityPrivate(t *testing.T) {
+    f := newGrantsFixture(t)
+    slug, _ := f.insert(t, Owner{UserID: f.alice}, true)
+
+    f.assertAccess(t, slug, f.alice, true, true, true)
+    // Belonging to a workspace with the owner doesn't make their private
+    // chunks visible.
+    f.assertAccess(t, slug, f.bob, false, false, false)
+    f.assertAccess(t, slug, f.carol, false, false, false)
+    f.assertAccess(t, slug, 0, false, false, false)
+}
+
+func TestVisibilityWorkspace(t *testing.T) {
+    f := newGrantsFixture(t)
+    // Chunks in a workspace are private to it, whatever their own flag
+    // says.
+    slug, _ := f.insert(t, Owner{UserID: f.alice, WorkspaceID: f.team}, false)
+
+    // Every member owns the chunk, not just whoever created it.
+    f.assertAccess(t, slug, f.alice, true, true, true)
+    f.assertAccess(t, slug, f.bob, true, true, true)
+    f.assertAccess(t, slug, f.carol, false, false, false)
+    f.assertAccess(t, slug, 0, false, false, false)
+
+    c := f.get(t, slug, f.bob)
+    assert.Equal(t, c.WorkspaceID, f.team)
+    assert.Equal(t, c.WorkspaceSlug, "team")
+
+    // Only members can put a chunk in the workspace.
+    _, err := f.chunks.Insert(context.Background(), Owner{UserID: f.carol, WorkspaceID: f.team}, "A chunk", "", nil, 7, 0, false)
+    assert.Equal(t, err, ErrNotMember)
+}
+
+func TestVisibilityUserGrant(t *testing.T) {
+    tests := []struct {
+        name       string
+        permission string
+        wantEdit   bool
+    }{
+        {
+            name:       "Read",
+            permission: PermissionRead,
+            wantEdit:   false,
+        },
+        {
+            name:       "Edit",
+            permission: PermissionEdit,
+            wantEdit:   true,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            f := newGrantsFixture(t)
+            slug, id := f.insert(t, Owner{UserID: f.alice}, true)
+
+            err := f.chunks.ShareWithUser(context.Background(), id, f.alice, "carol@example.com", tt.permission)
+            assert.NilError(t, err)
+
+            // The grantee may see the chunk, and edit it with the edit
+            // permission, but never share it.
+            f.assertAccess(t, slug, f.carol, true, tt.wantEdit, false)
+            f.assertAccess(t, slug, f.bob, false, false, false)
+            f.assertAccess(t, slug, 0, false, false, false)
+
+            shared := f.sharedWith(t, f.carol)
+            assert.Equal(t, len(shared), 1)
+            edit, ok := shared[id]
+            assert.Equal(t, ok, true)
+            assert.Equal(t, edit, tt.wantEdit)
+            assert.Equal(t, len(f.sharedWith(t, f.bob)), 0)
+        })
+    }
+}
+
+func TestVisibilityUserGrantOfWorkspaceChunk(t *testing.T) {
+    f := newGrantsFixture(t)
+    slug, id := f.insert(t, Owner{UserID: f.bob, WorkspaceID: f.team}, false)
+
+    // Any member may share a chunk of the workspace with someone outside
+    // it.
+    err := f.chunks.ShareWithUser(context.Background(), id, f.bob, "carol@example.com", PermissionRead)
+    assert.NilError(t, err)
+
+    f.assertAccess(t, slug, f.carol, true, false, false)
+    f.assertAccess(t, slug, 0, false, false, false)
+}
+
+func TestVisibilityWorkspaceGrant(t *testing.T) {
+    tests := []struct {
+        name       string
+        permission string
+        wantEdit   bool
+    }{
+        {
+            name:       "Read",
+            permission: PermissionRead,
+            wantEdit:   false,
+        },
+        {
+            name:       "Edit",
+            permission: PermissionEdit,
+            wantEdit:   true,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            f := newGrantsFixture(t)
+            slug, id := f.insert(t, Owner{UserID: f.alice}, true)
+
+            err := f.chunks.ShareWithWorkspace(context.Background(), id, f.alice, "team", tt.permission)
+            assert.NilError(t, err)
+
+            // Every member of the workspace is a grantee, and nobody else.
+            f.assertAccess(t, slug, f.bob, true, tt.wantEdit, false)
+            f.assertAccess(t, slug, f.carol, false, false, false)
+            f.assertAccess(t, slug, 0, false, false, false)
+
+            shared := f.sharedWith(t, f.bob)
+            assert.Equal(t, len(shared), 1)
+            assert.Equal(t, shared[id], tt.wantEdit)
+            assert.Equal(t, len(f.sharedWith(t, f.carol)), 0)
+        })
+    }
+}
+
+func TestVisibilityWorkspaceGrantNotMember(t *testing.T) {
+    f := newGrantsFixture(t)
+    _, id := f.insert(t, Owner{UserID: f.carol}, true)
+
+    // Users can only share with workspaces they belong to.
+    err := f.chunks.ShareWithWorkspace(context.Background(), id, f.carol, "team", PermissionRead)
+    assert.Equal(t, err, ErrUnknownGrantee)
+}
+
+func TestVisibilityGrantStrongest(t *testing.T) {
+    f := newGrantsFixture(t)
+    slug, id := f.insert(t, Owner{UserID: f.alice}, true)
+
+    // Bob gets read directly and edit through the workspace; the stronger
+    // permission wins, and the chunk is only listed once.
+    ctx := context.Background()
+    err := f.chunks.ShareWithUser(ctx, id, f.alice, "bob@example.com", PermissionRead)
+    assert.NilError(t, err)
+    err = f.chunks.ShareWithWorkspace(ctx, id, f.alice, "team", PermissionEdit)
+    assert.NilError(t, err)
+
+    f.assertAccess(t, slug, f.bob, true, true, false)
+    shared := f.sharedWith(t, f.bob)
+    assert.Equal(t, len(shared), 1)
+    assert.Equal(t, shared[id], true)
+}
+
+func TestVisibilityShareNotOwner(t *testing.T) {
+    f := newGrantsFixture(t)
+    _, id := f.insert(t, Owner{UserID: f.alice}, true)
+
+    ctx := context.Background()
+    err := f.chunks.ShareWithUser(ctx, id, f.alice, "carol@example.com", PermissionEdit)
+    assert.NilError(t, err)
+
+    // Not even a grantee with the edit permission may share the chunk on,
+    // or make it public.
+    err = f.chunks.ShareWithUser(ctx, id, f.carol, "bob@example.com", PermissionRead)
+    assert.Equal(t, err, ErrNoRecord)
+    err = f.chunks.SetPrivate(ctx, id, f.carol, false)
+    assert.Equal(t, err, ErrNoRecord)
+}
+
+func TestVisibilityRevoke(t *testing.T) {
+    f := newGrantsFixture(t)
+    ctx := context.Background()
+    slug, id := f.insert(t, Owner{UserID: f.alice}, true)
+
+    err := f.chunks.ShareWithUser(ctx, id, f.alice, "carol@example.com", PermissionEdit)
+    assert.NilError(t, err)
+    err = f.chunks.ShareWithWorkspace(ctx, id, f.alice, "team", PermissionRead)
+    assert.NilError(t, err)
+    f.assertAccess(t, slug, f.carol, true, true, false)
+    f.assertAccess(t, slug, f.bob, true, false, false)
+
+    grants, err := f.chunks.Grants(ctx, id)
+    assert.NilError(t, err)
+    assert.Equal(t, len(grants), 2)
+
+    // Only an owner may take a grant away.
+    err = f.chunks.Unshare(ctx, id, f.carol, grants[0].ID)
+    assert.Equal(t, err, ErrNoRecord)
+
+    for _, g := range grants {
+        err = f.chunks.Unshare(ctx, id, f.alice, g.ID)
+        assert.NilError(t, err)
+    }
+    f.assertAccess(t, slug, f.alice, true, true, true)
+    f.assertAccess(t, slug, f.carol, false, false, false)
+    f.assertAccess(t, slug, f.bob, false, false, false)
+    assert.Equal(t, len(f.sharedWith(t, f.carol)), 0)
+    assert.Equal(t, len(f.sharedWith(t, f.bob)), 0)
+
+    // A grant can only be taken away once.
+    err = f.chunks.Unshare(ctx, id, f.alice, grants[0].ID)
+    assert.Equal(t, err, ErrNoRecord)
+}
+
+func TestVisibilityRemovedMember(t *testing.T) {
+    f := newGrantsFixture(t)
+    ctx := context.Background()
+    owned, _ := f.insert(t, Owner{UserID: f.bob, WorkspaceID: f.team}, false)
+    shared, id := f.insert(t, Owner{UserID: f.alice}, true)
+    err := f.chunks.ShareWithWorkspace(ctx, id, f.alice, "team", PermissionRead)
+    assert.NilError(t, err)
+
+    err = f.workspaces.RemoveMember(ctx, f.team, f.bob)
+    assert.NilError(t, err)
+
+    // Leaving the workspace takes away its chunks, even those bob created,
+    // and what was shared with it.
+    f.assertAccess(t, owned, f.bob, false, false, false)
+    f.assertAccess(t, owned, f.alice, true, true, true)
+    f.assertAccess(t, shared, f.bob, false, false, false)
+    assert.Equal(t, len(f.sharedWith(t, f.bob)), 0)
+}
+
+func TestUpdateGrant(t *testing.T) {
+    f := newGrantsFixture(t)
+    ctx := context.Background()
+    slug, id := f.insert(t, Owner{UserID: f.alice}, true)
+    files := []*File{{Name: "main.go", Content: "package changed", ContentType: ContentTypeCode}}
+
+    // Reading a chunk isn't enough to change it.
+    err := f.chunks.ShareWithUser(ctx, id, f.alice, "carol@example.com", PermissionRead)
+    assert.NilError(t, err)
+    err = f.chunks.Update(ctx, slug, f.carol, "Carol's", files)
+    assert.Equal(t, err, ErrNoRecord)
+
+    // The edit permission is.
+    err = f.chunks.ShareWithUser(ctx, id, f.alice, "carol@example.com", PermissionEdit)
+    assert.NilError(t, err)
+    err = f.chunks.Update(ctx, slug, f.carol, "Carol's", files)
+    assert.NilError(t, err)
+    c := f.get(t, slug, f.alice)
+    assert.Equal(t, c.Title, "Carol's")
+    assert.Equal(t, c.Files[0].Content, "package changed")
+
+    // But not a grant to someone else.
+    err = f.chunks.Update(ctx, slug, f.bob, "Bob's", files)
+    assert.Equal(t, err, ErrNoRecord)
+}
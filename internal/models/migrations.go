@@ -0,0 +1,286 @@
+package models
+
+import (
+    "context"
+    "database/sql"
+    "embed"
+    "errors"
+    "fmt"
+    "io/fs"
+    "sort"
+    "strings"
+
+    "github.com/go-sql-driver/mysql"
+)
+
+// The SQL migrations are embedded in the binary, so the schema a binary
+// expects always travels with it.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// MigrationModel applies the migrations in the migrations directory and
+// keeps track of them in the schema_migrations table. A migration is known
+// by its file name, like "001_create_chunks_table.sql", and they are applied
+// in file name order.
+type MigrationModel struct {
+    DB *sql.DB
+}
+
+// The migrations up to and including baselineMigration were written before
+// the migrations were tracked, and were applied to existing databases by
+// hand. Such a database has their tables and columns but no record of
+// them, so Migrate adopts it by recording them as applied, once it has
+// checked that the schema matches.
+const baselineMigration = "006_add_chunks_slug.sql"
+
+// baselineColumns are the columns which the baseline migrations leave
+// behind, by table, and droppedColumns those they take away again.
+var (
+    baselineColumns = map[string][]string{
+        "chunks":      {"id", "title", "created", "expires", "forked_from", "slug"},
+        "chunk_files": {"id", "chunk_id", "name", "content", "content_type", "language", "position"},
+    }
+    droppedColumns = map[string][]string{
+        "chunks": {"content", "content_type", "language"},
+    }
+)
+
+// migrations returns the file names of all the migrations, in order.
+func migrations() ([]string, error) {
+    names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+    if err != nil {
+        return nil, err
+    }
+    for i := range names {
+        names[i] = strings.TrimPrefix(names[i], "migrations/")
+    }
+    sort.Strings(names)
+    return names, nil
+}
+
+// Pending returns the migrations which haven't been applied yet, in order.
+// A database which has never been migrated has no schema_migrations table,
+// which is reported as ErrNotMigrated rather than every migration being
+// pending.
+func (m *MigrationModel) Pending(ctx context.Context) ([]string, error) {
+    all, err := migrations()
+    if err != nil {
+        return nil, err
+    }
+
+    rows, err := m.DB.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+    if err != nil {
+        // MySQL error 1146 is "table doesn't exist".
+        var mySQLError *mysql.MySQLError
+        if errors.As(err, &mySQLError) && mySQLError.Number == 1146 {
+            return nil, ErrNotMigrated
+        }
+        return nil, err
+    }
+    defer rows.Close()
+
+    applied := make(map[string]bool)
+    for rows.Next() {
+        var version string
+        err = rows.Scan(&version)
+        if err != nil {
+            return nil, err
+        }
+        applied[version] = true
+    }
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    pending := []string{}
+    for _, name := range all {
+        if !applied[name] {
+            pending = append(pending, name)
+        }
+    }
+    return pending, nil
+}
+
+// Migrate applies the pending migrations in order and returns their names.
+// MySQL commits schema changes straight away, so a migration can't be
+// rolled back if it fails half way through. Migrate stops at the first
+// failure, leaving that migration pending to be fixed by hand.
+//
+// A database which already has a chunks table but no migrations recorded
+// dates from before they were tracked. Migrate adopts it with baseline()
+// before applying the migrations which come after the baseline.
+func (m *MigrationModel) Migrate(ctx context.Context) ([]string, error) {
+    _, err := m.DB.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+        version VARCHAR(255) NOT NULL PRIMARY KEY,
+        applied DATETIME NOT NULL
+    )`)
+    if err != nil {
+        return nil, err
+    }
+
+    var recorded int
+    err = m.DB.QueryRowContext(ctx, `SELECT COUNT(*) FROM schema_migrations`).Scan(&recorded)
+    if err != nil {
+        return nil, err
+    }
+    if recorded == 0 {
+        chunks, err := m.columns(ctx, "chunks")
+        if err != nil {
+            return nil, err
+        }
+        if len(chunks) > 0 {
+            err = m.baseline(ctx)
+            if err != nil {
+                return nil, err
+            }
+        }
+    }
+
+    pending, err := m.Pending(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    for i, name := range pending {
+        err = m.apply(ctx, name)
+        if err != nil {
+            return pending[:i], fmt.Errorf("models: migration %s: %w", name, err)
+        }
+    }
+    return pending, nil
+}
+
+// baseline records the baseline migrations as applied, without running
+// them, if the database has exactly the tables and columns they would have
+// made. If it doesn't, nothing is recorded and the error lists what is
+// wrong, so that the schema can be fixed by hand first.
+func (m *MigrationModel) baseline(ctx context.Context) error {
+    var problems []string
+    for _, table := range []string{"chunks", "chunk_files"} {
+        columns, err := m.columns(ctx, table)
+        if err != nil {
+            return err
+        }
+        if len(columns) == 0 {
+            problems = append(problems, fmt.Sprintf("table %s is missing", table))
+            continue
+        }
+        for _, column := range baselineColumns[table] {
+            if !columns[column] {
+                problems = append(problems, fmt.Sprintf("column %s.%s is missing", table, column))
+            }
+        }
+        for _, column := range droppedColumns[table] {
+            if columns[column] {
+                problems = append(problems, fmt.Sprintf("column %s.%s should have been dropped", table, column))
+            }
+        }
+    }
+    if len(problems) > 0 {
+        return fmt.Errorf("models: the existing database doesn't match migration %s: %s",
+            baselineMigration, strings.Join(problems, "; "))
+    }
+
+    all, err := migrations()
+    if err != nil {
+        return err
+    }
+
+    tx, err := m.DB.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    for _, name := range all {
+        if name > baselineMigration {
+            break
+        }
+        _, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied)
+        VALUES(?, UTC_TIMESTAMP())`, name)
+        if err != nil {
+            return err
+        }
+    }
+    return tx.Commit()
+}
+
+// columns returns the names of the columns of a table in the current
+// database. A table which doesn't exist has none.
+func (m *MigrationModel) columns(ctx context.Context, table string) (map[string]bool, error) {
+    stmt := `SELECT column_name FROM information_schema.columns
+    WHERE table_schema = DATABASE() AND table_name = ?`
+
+    rows, err := m.DB.QueryContext(ctx, stmt, table)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    columns := make(map[string]bool)
+    for rows.Next() {
+        var name string
+        err = rows.Scan(&name)
+        if err != nil {
+            return nil, err
+        }
+        columns[strings.ToLower(name)] = true
+    }
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+    return columns, nil
+}
+
+// apply runs the statements of a migration one at a time, as the driver
+// doesn't allow several statements in a single Exec(), and records it as
+// applied.
+func (m *MigrationModel) apply(ctx context.Context, name string) error {
+    b, err := migrationFiles.ReadFile("migrations/" + name)
+    if err != nil {
+        return err
+    }
+
+    // All the statements are run on one connection, in case a migration
+    // relies on session state.
+    conn, err := m.DB.Conn(ctx)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    for _, stmt := range splitStatements(string(b)) {
+        _, err = conn.ExecContext(ctx, stmt)
+        if err != nil {
+            return err
+        }
+    }
+
+    _, err = conn.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied)
+    VALUES(?, UTC_TIMESTAMP())`, name)
+    return err
+}
+
+// splitStatements splits a migration into its statements. Our migrations
+// end every statement with a semicolon at the end of a line, and never put
+// one at the end of a line anywhere else. Comment lines are dropped.
+func splitStatements(source string) []string {
+    var stmts []string
+    var current []string
+    for _, line := range strings.Split(source, "\n") {
+        trimmed := strings.TrimSpace(line)
+        if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+            continue
+        }
+        current = append(current, line)
+        if strings.HasSuffix(trimmed, ";") {
+            stmts = append(stmts, strings.TrimSuffix(strings.TrimSpace(strings.Join(current, "\n")), ";"))
+            current = nil
+        }
+    }
+    if len(current) > 0 {
+        stmts = append(stmts, strings.TrimSpace(strings.Join(current, "\n")))
+    }
+    return stmts
+}
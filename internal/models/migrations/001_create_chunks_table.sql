@@ -0,0 +1,11 @@
+-- Create a `chunks` table.
+CREATE TABLE chunks (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    title VARCHAR(100) NOT NULL,
+    content TEXT NOT NULL,
+    created DATETIME NOT NULL,
+    expires DATETIME NOT NULL
+);
+
+-- Add an index on the created column.
+CREATE INDEX idx_chunks_created ON chunks(created);
@@ -0,0 +1,3 @@
+-- Store the language used to highlight each chunk. Existing chunks are
+-- treated as plain text.
+ALTER TABLE chunks ADD COLUMN language VARCHAR(50) NOT NULL DEFAULT 'text';
@@ -0,0 +1,3 @@
+-- Record how a chunk's content should be displayed: highlighted as code, or
+-- rendered as Markdown.
+ALTER TABLE chunks ADD COLUMN content_type VARCHAR(20) NOT NULL DEFAULT 'code';
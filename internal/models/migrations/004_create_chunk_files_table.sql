@@ -0,0 +1,19 @@
+-- A chunk is made up of one or more named files, shown in position order.
+CREATE TABLE chunk_files (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    chunk_id INTEGER NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    content TEXT NOT NULL,
+    content_type VARCHAR(20) NOT NULL DEFAULT 'code',
+    language VARCHAR(50) NOT NULL DEFAULT 'text',
+    position INTEGER NOT NULL,
+    CONSTRAINT fk_chunk_files_chunk FOREIGN KEY (chunk_id) REFERENCES chunks(id) ON DELETE CASCADE,
+    CONSTRAINT uc_chunk_files_name UNIQUE (chunk_id, name)
+);
+
+-- Move the content of existing chunks into a single file each.
+INSERT INTO chunk_files (chunk_id, name, content, content_type, language, position)
+SELECT id, IF(content_type = 'markdown', 'README.md', 'chunk.txt'), content, content_type, language, 0
+FROM chunks;
+
+ALTER TABLE chunks DROP COLUMN content, DROP COLUMN content_type, DROP COLUMN language;
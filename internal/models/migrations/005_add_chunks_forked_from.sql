@@ -0,0 +1,4 @@
+-- Remember which chunk a chunk was forked from, so the lineage of a chunk can
+-- be browsed. If the original is deleted the fork simply loses its parent.
+ALTER TABLE chunks ADD COLUMN forked_from INTEGER NULL,
+    ADD CONSTRAINT fk_chunks_forked_from FOREIGN KEY (forked_from) REFERENCES chunks(id) ON DELETE SET NULL;
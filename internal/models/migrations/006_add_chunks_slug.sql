@@ -0,0 +1,9 @@
+-- Chunks are addressed by a random, URL-safe slug rather than their
+-- sequential id. Existing chunks get a slug made from a hash of their id and
+-- a random number.
+ALTER TABLE chunks ADD COLUMN slug VARCHAR(64) NULL;
+
+UPDATE chunks SET slug = SUBSTRING(SHA2(CONCAT(id, '-', RAND()), 256), 1, 10);
+
+ALTER TABLE chunks MODIFY slug VARCHAR(64) NOT NULL,
+    ADD CONSTRAINT uc_chunks_slug UNIQUE (slug);
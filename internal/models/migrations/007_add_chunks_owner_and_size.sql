@@ -0,0 +1,17 @@
+-- Record who created each chunk and how many bytes its files hold, so that
+-- quotas can be enforced. Chunks created by someone who isn't logged in
+-- only have the IP address they came from. Existing chunks have no owner.
+ALTER TABLE chunks ADD COLUMN owner_ip VARCHAR(45) NULL,
+    ADD COLUMN user_id INTEGER NULL,
+    ADD COLUMN size INTEGER NOT NULL DEFAULT 0;
+
+UPDATE chunks c SET size = (
+    SELECT COALESCE(SUM(LENGTH(f.content)), 0) FROM chunk_files f WHERE f.chunk_id = c.id
+);
+
+CREATE INDEX idx_chunks_owner_ip ON chunks(owner_ip);
+CREATE INDEX idx_chunks_user_id ON chunks(user_id);
+
+-- A TEXT column holds at most 64KB, which is less than the size limit of a
+-- chunk.
+ALTER TABLE chunk_files MODIFY content MEDIUMTEXT NOT NULL;
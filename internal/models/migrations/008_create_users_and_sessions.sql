@@ -0,0 +1,22 @@
+-- User accounts. Passwords are stored as bcrypt hashes.
+CREATE TABLE users (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    name VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    hashed_password CHAR(60) NOT NULL,
+    created DATETIME NOT NULL,
+    CONSTRAINT uc_users_email UNIQUE (email)
+);
+
+-- The sessions of logged in users, in the form the scs mysqlstore expects.
+CREATE TABLE sessions (
+    token CHAR(43) PRIMARY KEY,
+    data BLOB NOT NULL,
+    expiry TIMESTAMP(6) NOT NULL
+);
+
+CREATE INDEX sessions_expiry_idx ON sessions (expiry);
+
+-- Chunks created by a user now belong to them. If the user is deleted the
+-- chunk stays, without an owner.
+ALTER TABLE chunks ADD CONSTRAINT fk_chunks_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL;
@@ -0,0 +1,15 @@
+-- Personal API tokens. Only the SHA-256 hash of a token is stored, so a leak
+-- of the database doesn't leak working tokens. scopes is a comma-separated
+-- list like "read,write". A token without an expiry date never expires.
+CREATE TABLE api_tokens (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    user_id INTEGER NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    hash BINARY(32) NOT NULL,
+    scopes VARCHAR(100) NOT NULL,
+    created DATETIME NOT NULL,
+    last_used DATETIME NULL,
+    expires DATETIME NULL,
+    CONSTRAINT fk_api_tokens_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    CONSTRAINT uc_api_tokens_hash UNIQUE (hash)
+);
@@ -0,0 +1,14 @@
+-- Users who log in with single sign-on are known to the identity provider by
+-- the issuer and subject of their ID tokens. Such users may have no password
+-- of their own.
+CREATE TABLE user_identities (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    user_id INTEGER NOT NULL,
+    issuer VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    created DATETIME NOT NULL,
+    CONSTRAINT fk_user_identities_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    CONSTRAINT uc_user_identities_subject UNIQUE (issuer, subject)
+);
+
+ALTER TABLE users MODIFY hashed_password CHAR(60) NULL;
@@ -0,0 +1,6 @@
+-- Every user has a role, which decides what they may do: "user",
+-- "moderator" or "admin". Disabled users can't log in or use their API
+-- tokens.
+ALTER TABLE users
+    ADD COLUMN role VARCHAR(20) NOT NULL DEFAULT 'user',
+    ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,26 @@
+-- Workspaces let a team own chunks together. Each member of a workspace is
+-- either an "owner", who can manage the members, or a plain "member".
+CREATE TABLE workspaces (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    name VARCHAR(100) NOT NULL,
+    slug VARCHAR(64) NOT NULL,
+    created DATETIME NOT NULL,
+    CONSTRAINT uc_workspaces_slug UNIQUE (slug)
+);
+
+CREATE TABLE workspace_members (
+    workspace_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    role VARCHAR(20) NOT NULL DEFAULT 'member',
+    created DATETIME NOT NULL,
+    PRIMARY KEY (workspace_id, user_id),
+    CONSTRAINT fk_workspace_members_workspace FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE,
+    CONSTRAINT fk_workspace_members_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_workspace_members_user_id ON workspace_members(user_id);
+
+-- A chunk can belong to a workspace, in which case only the members can see
+-- it. Chunks without a workspace are public, as before.
+ALTER TABLE chunks ADD COLUMN workspace_id INTEGER NULL,
+    ADD CONSTRAINT fk_chunks_workspace FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE;
@@ -0,0 +1,23 @@
+-- A private chunk can only be seen by whoever created it, and by those it
+-- is shared with. Chunks in a workspace are always private to the workspace.
+ALTER TABLE chunks ADD COLUMN private BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Grants share a chunk with a user, or with every member of a workspace.
+-- Each grant has exactly one of user_id and workspace_id. permission is
+-- "read" or "edit".
+CREATE TABLE chunk_grants (
+    id INTEGER NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    chunk_id INTEGER NOT NULL,
+    user_id INTEGER NULL,
+    workspace_id INTEGER NULL,
+    permission VARCHAR(10) NOT NULL,
+    created DATETIME NOT NULL,
+    CONSTRAINT fk_chunk_grants_chunk FOREIGN KEY (chunk_id) REFERENCES chunks(id) ON DELETE CASCADE,
+    CONSTRAINT fk_chunk_grants_user FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    CONSTRAINT fk_chunk_grants_workspace FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE,
+    CONSTRAINT uc_chunk_grants_user UNIQUE (chunk_id, user_id),
+    CONSTRAINT uc_chunk_grants_workspace UNIQUE (chunk_id, workspace_id)
+);
+
+CREATE INDEX idx_chunk_grants_user_id ON chunk_grants(user_id);
+CREATE INDEX idx_chunk_grants_workspace_id ON chunk_grants(workspace_id);
@@ -0,0 +1,166 @@
+package models
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "testing"
+
+    "github.com/cpucortexm/chunkbox/internal/assert"
+)
+
+func TestSplitStatements(t *testing.T) {
+    source := `-- A comment.
+CREATE TABLE things (
+    id INTEGER NOT NULL,
+    name VARCHAR(10) NOT NULL DEFAULT 'a;b'
+);
+
+-- Another comment.
+CREATE INDEX idx_things_name ON things(name);
+UPDATE things SET name = 'c'`
+
+    stmts := splitStatements(source)
+    assert.Equal(t, len(stmts), 3)
+    assert.Equal(t, stmts[0], "CREATE TABLE things (\n    id INTEGER NOT NULL,\n    name VARCHAR(10) NOT NULL DEFAULT 'a;b'\n)")
+    assert.Equal(t, stmts[1], "CREATE INDEX idx_things_name ON things(name)")
+    assert.Equal(t, stmts[2], "UPDATE things SET name = 'c'")
+}
+
+// applyByHand runs the migrations up to and including last without
+// recording them, the way databases were set up before the migrations were
+// tracked.
+func applyByHand(t *testing.T, db *sql.DB, last string) {
+    t.Helper()
+
+    all, err := migrations()
+    assert.NilError(t, err)
+    for _, name := range all {
+        if name > last {
+            break
+        }
+        b, err := migrationFiles.ReadFile("migrations/" + name)
+        assert.NilError(t, err)
+        for _, stmt := range splitStatements(string(b)) {
+            _, err = db.Exec(stmt)
+            assert.NilError(t, err)
+        }
+    }
+}
+
+// recorded returns the number of migrations recorded as applied.
+func recorded(t *testing.T, db *sql.DB) int {
+    t.Helper()
+
+    var n int
+    err := db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&n)
+    assert.NilError(t, err)
+    return n
+}
+
+func TestMigrate(t *testing.T) {
+    db := newEmptyTestDB(t)
+    m := &MigrationModel{DB: db}
+    ctx := context.Background()
+
+    all, err := migrations()
+    assert.NilError(t, err)
+
+    _, err = m.Pending(ctx)
+    assert.Equal(t, errors.Is(err, ErrNotMigrated), true)
+
+    applied, err := m.Migrate(ctx)
+    assert.NilError(t, err)
+    assert.Equal(t, len(applied), len(all))
+
+    pending, err := m.Pending(ctx)
+    assert.NilError(t, err)
+    assert.Equal(t, len(pending), 0)
+
+    // Migrating again has nothing to do.
+    applied, err = m.Migrate(ctx)
+    assert.NilError(t, err)
+    assert.Equal(t, len(applied), 0)
+    assert.Equal(t, recorded(t, db), len(all))
+}
+
+func TestMigrateBaseline(t *testing.T) {
+    db := newEmptyTestDB(t)
+    m := &MigrationModel{DB: db}
+    ctx := context.Background()
+
+    // A database from before the migrations were tracked, with a chunk in
+    // it.
+    applyByHand(t, db, baselineMigration)
+    result, err := db.Exec(`INSERT INTO chunks (title, created, expires, slug)
+    VALUES('An old silent pond', UTC_TIMESTAMP(), DATE_ADD(UTC_TIMESTAMP(), INTERVAL 7 DAY), 'pond')`)
+    assert.NilError(t, err)
+    id, err := result.LastInsertId()
+    assert.NilError(t, err)
+    _, err = db.Exec(`INSERT INTO chunk_files (chunk_id, name, content, position)
+    VALUES(?, 'haiku.txt', 'A frog jumps into the pond', 0)`, id)
+    assert.NilError(t, err)
+
+    // It isn't ready until it has been migrated once.
+    _, err = m.Pending(ctx)
+    assert.Equal(t, errors.Is(err, ErrNotMigrated), true)
+
+    all, err := migrations()
+    assert.NilError(t, err)
+    var after []string
+    for _, name := range all {
+        if name > baselineMigration {
+            after = append(after, name)
+        }
+    }
+
+    // Only the migrations after the baseline are run; running the baseline
+    // ones again would fail on the tables which are already there.
+    applied, err := m.Migrate(ctx)
+    assert.NilError(t, err)
+    assert.Equal(t, len(applied), len(after))
+    for i := range after {
+        assert.Equal(t, applied[i], after[i])
+    }
+
+    pending, err := m.Pending(ctx)
+    assert.NilError(t, err)
+    assert.Equal(t, len(pending), 0)
+    assert.Equal(t, recorded(t, db), len(all))
+
+    var title string
+    err = db.QueryRow(`SELECT title FROM chunks WHERE slug = 'pond'`).Scan(&title)
+    assert.NilError(t, err)
+    assert.Equal(t, title, "An old silent pond")
+}
+
+func TestMigrateBaselineMismatch(t *testing.T) {
+    db := newEmptyTestDB(t)
+    m := &MigrationModel{DB: db}
+    ctx := context.Background()
+
+    // A database which missed the last of the baseline migrations isn't
+    // adopted, and nothing is recorded.
+    applyByHand(t, db, "005_add_chunks_forked_from.sql")
+
+    _, err := m.Migrate(ctx)
+    if err == nil {
+        t.Fatal("got: nil; expected an error")
+    }
+    assert.StringContains(t, err.Error(), "column chunks.slug is missing")
+    assert.Equal(t, recorded(t, db), 0)
+
+    // Once the schema has been brought up to date by hand, it is.
+    b, err := migrationFiles.ReadFile("migrations/" + baselineMigration)
+    assert.NilError(t, err)
+    for _, stmt := range splitStatements(string(b)) {
+        _, err = db.Exec(stmt)
+        assert.NilError(t, err)
+    }
+
+    _, err = m.Migrate(ctx)
+    assert.NilError(t, err)
+    pending, err := m.Pending(ctx)
+    assert.NilError(t, err)
+    assert.Equal(t, len(pending), 0)
+}
@@ -0,0 +1,230 @@
+package mocks
+
+import (
+    "context"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/cpucortexm/chunkbox/internal/models"
+)
+
+// UserModel is an in-memory stand-in for models.UserModel, which behaves
+// like it as far as the handlers can tell. Passwords are stored as they
+// are, which is fine for tests.
+type UserModel struct {
+    mu         sync.Mutex
+    users      []*models.User
+    passwords  map[int]string // by user ID; users without one have none
+    identities map[identityKey]int
+}
+
+type identityKey struct {
+    issuer  string
+    subject string
+}
+
+// AddUser adds a user with the password (none if it is empty), and returns
+// their ID.
+func (m *UserModel) AddUser(name, email, password string) int {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    return m.add(name, email, password)
+}
+
+func (m *UserModel) add(name, email, password string) int {
+    if m.passwords == nil {
+        m.passwords = make(map[int]string)
+        m.identities = make(map[identityKey]int)
+    }
+    u := &models.User{
+        ID:      len(m.users) + 1,
+        Name:    name,
+        Email:   email,
+        Created: time.Now().UTC(),
+        Role:    models.RoleUser,
+    }
+    m.users = append(m.users, u)
+    if password != "" {
+        m.passwords[u.ID] = password
+    }
+    return u.ID
+}
+
+// byEmail returns the user with the email address, or nil.
+func (m *UserModel) byEmail(email string) *models.User {
+    for _, u := range m.users {
+        if strings.EqualFold(u.Email, email) {
+            return u
+        }
+    }
+    return nil
+}
+
+// byID returns the user with the ID, or nil.
+func (m *UserModel) byID(id int) *models.User {
+    if id < 1 || id > len(m.users) {
+        return nil
+    }
+    return m.users[id-1]
+}
+
+// Identity returns the ID of the user the identity is linked to, or 0.
+func (m *UserModel) Identity(issuer, subject string) int {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    return m.identities[identityKey{issuer, subject}]
+}
+
+// Count returns the number of users.
+func (m *UserModel) Count() int {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    return len(m.users)
+}
+
+func (m *UserModel) Insert(ctx context.Context, name, email, password string) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    if m.byEmail(email) != nil {
+        return models.ErrDuplicateEmail
+    }
+    m.add(name, email, password)
+    return nil
+}
+
+func (m *UserModel) Authenticate(ctx context.Context, email, password string) (int, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    u := m.byEmail(email)
+    if u == nil {
+        return 0, models.ErrInvalidCredentials
+    }
+    stored, ok := m.passwords[u.ID]
+    if !ok || stored != password {
+        return 0, models.ErrInvalidCredentials
+    }
+    if u.Disabled {
+        return 0, models.ErrUserDisabled
+    }
+    return u.ID, nil
+}
+
+func (m *UserModel) Get(ctx context.Context, id int) (*models.User, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    u := m.byID(id)
+    if u == nil {
+        return nil, models.ErrNoRecord
+    }
+    user := *u
+    return &user, nil
+}
+
+func (m *UserModel) Provision(ctx context.Context, issuer, subject, name, email string) (int, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    if id, ok := m.identities[identityKey{issuer, subject}]; ok {
+        if m.byID(id).Disabled {
+            return 0, models.ErrUserDisabled
+        }
+        return id, nil
+    }
+
+    var id int
+    if u := m.byEmail(email); u != nil {
+        if u.Disabled {
+            return 0, models.ErrUserDisabled
+        }
+        if _, ok := m.passwords[u.ID]; ok {
+            return 0, models.ErrLinkRequired
+        }
+        id = u.ID
+    } else {
+        id = m.add(name, email, "")
+    }
+    m.identities[identityKey{issuer, subject}] = id
+    return id, nil
+}
+
+func (m *UserModel) LinkIdentity(ctx context.Context, userID int, issuer, subject string) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    if m.identities == nil {
+        m.identities = make(map[identityKey]int)
+    }
+    if owner, ok := m.identities[identityKey{issuer, subject}]; ok {
+        if owner != userID {
+            return models.ErrIdentityTaken
+        }
+        return nil
+    }
+    m.identities[identityKey{issuer, subject}] = userID
+    return nil
+}
+
+func (m *UserModel) Search(ctx context.Context, query string, limit, offset int) ([]*models.User, bool, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    var found []*models.User
+    for _, u := range m.users {
+        if strings.Contains(u.Name, query) || strings.Contains(u.Email, query) {
+            user := *u
+            found = append(found, &user)
+        }
+    }
+    if offset > len(found) {
+        offset = len(found)
+    }
+    found = found[offset:]
+    if len(found) > limit {
+        return found[:limit], true, nil
+    }
+    return found, false, nil
+}
+
+func (m *UserModel) SetRole(ctx context.Context, id int, role string) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    u := m.byID(id)
+    if u == nil {
+        return models.ErrNoRecord
+    }
+    u.Role = role
+    return nil
+}
+
+func (m *UserModel) SetDisabled(ctx context.Context, id int, disabled bool) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    u := m.byID(id)
+    if u == nil {
+        return models.ErrNoRecord
+    }
+    u.Disabled = disabled
+    return nil
+}
+
+func (m *UserModel) Counts(ctx context.Context) (total int, disabled int, err error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    for _, u := range m.users {
+        total++
+        if u.Disabled {
+            disabled++
+        }
+    }
+    return total, disabled, nil
+}
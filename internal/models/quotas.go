@@ -0,0 +1,90 @@
+package models
+
+import (
+    "context"
+    "database/sql"
+)
+
+// Owner is whoever creates a chunk. Someone who is logged in is known by
+// their user ID, anyone else by their IP address. A logged in user can
+// create the chunk in one of their workspaces, but it still counts against
+// their own quota.
+type Owner struct {
+    UserID      int // 0 if not logged in
+    IP          string
+    WorkspaceID int // 0 for a public chunk
+}
+
+// Quota limits the live chunks an owner can have. A zero limit means no
+// limit.
+type Quota struct {
+    MaxChunks int
+    MaxBytes  int64
+}
+
+// Usage is what an owner's live chunks add up to.
+type Usage struct {
+    Chunks int
+    Bytes  int64
+}
+
+// Allows reports whether the quota has room for another chunk of the given
+// size on top of the usage.
+func (q Quota) Allows(u Usage, size int64) bool {
+    if q.MaxChunks > 0 && u.Chunks+1 > q.MaxChunks {
+        return false
+    }
+    if q.MaxBytes > 0 && u.Bytes+size > q.MaxBytes {
+        return false
+    }
+    return true
+}
+
+// QuotaFor returns the quota which applies to the owner.
+func (m *ChunkModel) QuotaFor(owner Owner) Quota {
+    if owner.UserID != 0 {
+        return m.UserQuota
+    }
+    return m.IPQuota
+}
+
+// Usage returns the number and total size of the owner's live chunks.
+func (m *ChunkModel) Usage(ctx context.Context, owner Owner) (Usage, error) {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    return usage(ctx, m.DB, owner, false)
+}
+
+// querier is what sql.DB and sql.Tx have in common, so that usage() can
+// run in a transaction or not.
+type querier interface {
+    QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// usage counts the owner's live chunks. Chunks created by someone who was
+// logged in don't count against their IP address. With lock set the rows
+// are locked until the end of the transaction, so that two chunks created at
+// once can't both squeeze into the last of the quota.
+func usage(ctx context.Context, q querier, owner Owner, lock bool) (Usage, error) {
+    stmt := `SELECT COUNT(*), COALESCE(SUM(size), 0) FROM chunks
+    WHERE expires > UTC_TIMESTAMP() AND `
+    var arg any
+    if owner.UserID != 0 {
+        stmt += `user_id = ?`
+        arg = owner.UserID
+    } else {
+        stmt += `user_id IS NULL AND owner_ip = ?`
+        arg = owner.IP
+    }
+    if lock {
+        stmt += ` FOR UPDATE`
+    }
+
+    var u Usage
+    err := q.QueryRowContext(ctx, stmt, arg).Scan(&u.Chunks, &u.Bytes)
+    if err != nil {
+        return Usage{}, err
+    }
+    return u, nil
+}
@@ -0,0 +1,82 @@
+package models
+
+import (
+    "context"
+    "testing"
+
+    "github.com/cpucortexm/chunkbox/internal/assert"
+)
+
+func TestQuotaAllows(t *testing.T) {
+    tests := []struct {
+        name  string
+        quota Quota
+        usage Usage
+        size  int64
+        want  bool
+    }{
+        {
+            name:  "No limit",
+            usage: Usage{Chunks: 1000, Bytes: 1 << 30},
+            size:  1 << 20,
+            want:  true,
+        },
+        {
+            name:  "Room for one more chunk",
+            quota: Quota{MaxChunks: 3},
+            usage: Usage{Chunks: 2},
+            want:  true,
+        },
+        {
+            name:  "Too many chunks",
+            quota: Quota{MaxChunks: 3},
+            usage: Usage{Chunks: 3},
+            want:  false,
+        },
+        {
+            name:  "Fills the bytes exactly",
+            quota: Quota{MaxBytes: 100},
+            usage: Usage{Chunks: 1, Bytes: 60},
+            size:  40,
+            want:  true,
+        },
+        {
+            name:  "Too many bytes",
+            quota: Quota{MaxChunks: 10, MaxBytes: 100},
+            usage: Usage{Chunks: 1, Bytes: 60},
+            size:  41,
+            want:  false,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            assert.Equal(t, tt.quota.Allows(tt.usage, tt.size), tt.want)
+        })
+    }
+}
+
+func TestInsertQuota(t *testing.T) {
+    m := &ChunkModel{
+        DB:      newTestDB(t),
+        IPQuota: Quota{MaxChunks: 2, MaxBytes: 10},
+    }
+    ctx := context.Background()
+    owner := Owner{IP: "203.0.113.7"}
+    files := func(content string) []*File {
+        return []*File{{Name: "a.txt", Content: content, ContentType: ContentTypeCode}}
+    }
+
+    _, err := m.Insert(ctx, owner, "First", "", files("12345"), 7, 0, false)
+    assert.NilError(t, err)
+
+    // Six more bytes would go over the limit, five fill it up.
+    _, err = m.Insert(ctx, owner, "Too big", "", files("123456"), 7, 0, false)
+    assert.Equal(t, err, ErrQuotaExceeded)
+    _, err = m.Insert(ctx, owner, "Second", "", files("12345"), 7, 0, false)
+    assert.NilError(t, err)
+
+    u, err := m.Usage(ctx, owner)
+    assert.NilError(t, err)
+    assert.Equal(t, u, Usage{Chunks: 2, Bytes: 10})
+}
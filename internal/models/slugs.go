@@ -0,0 +1,78 @@
+package models
+
+import (
+    "context"
+    "crypto/rand"
+    "database/sql"
+    "errors"
+    "math/big"
+    "strings"
+
+    "github.com/go-sql-driver/mysql"
+)
+
+// The characters random slugs are made of. They are all safe to use in a URL
+// path without escaping.
+const slugAlphabet = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// DefaultSlugLength is the length of random slugs when the ChunkModel
+// doesn't set one. With 57 characters to pick from, 8 characters give about
+// 10^14 possible slugs.
+const DefaultSlugLength = 8
+
+// slugAttempts is how many random slugs Insert() tries before giving up.
+// A collision is very unlikely, so running out of attempts means something
+// else is wrong.
+const slugAttempts = 5
+
+// newSlug returns a random slug of the given length, using crypto/rand so
+// that the slugs can't be predicted.
+func newSlug(length int) (string, error) {
+    max := big.NewInt(int64(len(slugAlphabet)))
+    var b strings.Builder
+    for i := 0; i < length; i++ {
+        n, err := rand.Int(rand.Reader, max)
+        if err != nil {
+            return "", err
+        }
+        b.WriteByte(slugAlphabet[n.Int64()])
+    }
+    return b.String(), nil
+}
+
+// isDuplicateSlug reports whether the error is MySQL complaining that the
+// slug is already taken by another chunk.
+func isDuplicateSlug(err error) bool {
+    var mySQLError *mysql.MySQLError
+    if errors.As(err, &mySQLError) {
+        return mySQLError.Number == 1062 && strings.Contains(mySQLError.Message, "uc_chunks_slug")
+    }
+    return false
+}
+
+// reclaimSlug makes sure a custom slug is free to use inside the transaction.
+// If a live chunk has the slug it returns ErrDuplicateSlug. If an expired
+// chunk has it, that chunk's slug is changed to "~" followed by its id, which
+// can't clash with any other slug as neither random nor custom slugs contain
+// a "~".
+func reclaimSlug(ctx context.Context, tx *sql.Tx, slug string) error {
+    // FOR UPDATE locks the row, so nobody else can reclaim the slug at the
+    // same time.
+    stmt := `SELECT id, expires > UTC_TIMESTAMP() FROM chunks WHERE slug = ? FOR UPDATE`
+
+    var id int
+    var live bool
+    err := tx.QueryRowContext(ctx, stmt, slug).Scan(&id, &live)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            return nil
+        }
+        return err
+    }
+    if live {
+        return ErrDuplicateSlug
+    }
+
+    _, err = tx.ExecContext(ctx, `UPDATE chunks SET slug = CONCAT('~', id) WHERE id = ?`, id)
+    return err
+}
@@ -0,0 +1,104 @@
+package models
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "strings"
+    "testing"
+
+    "github.com/cpucortexm/chunkbox/internal/assert"
+    "github.com/go-sql-driver/mysql"
+)
+
+func TestNewSlug(t *testing.T) {
+    seen := make(map[string]bool)
+    for i := 0; i < 100; i++ {
+        slug, err := newSlug(DefaultSlugLength)
+        assert.NilError(t, err)
+        assert.Equal(t, len(slug), DefaultSlugLength)
+        for _, c := range slug {
+            assert.Equal(t, strings.ContainsRune(slugAlphabet, c), true)
+        }
+        assert.Equal(t, seen[slug], false)
+        seen[slug] = true
+    }
+}
+
+func TestIsDuplicateSlug(t *testing.T) {
+    tests := []struct {
+        name string
+        err  error
+        want bool
+    }{
+        {
+            name: "Duplicate slug",
+            err:  &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'dev-setup' for key 'chunks.uc_chunks_slug'"},
+            want: true,
+        },
+        {
+            name: "Wrapped",
+            err:  fmt.Errorf("insert: %w", &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'dev-setup' for key 'uc_chunks_slug'"}),
+            want: true,
+        },
+        {
+            name: "Another key",
+            err:  &mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'a@example.com' for key 'users.users_uc_email'"},
+            want: false,
+        },
+        {
+            name: "Another error",
+            err:  &mysql.MySQLError{Number: 1452, Message: "Cannot add or update a child row: uc_chunks_slug"},
+            want: false,
+        },
+        {
+            name: "Not MySQL",
+            err:  errors.New("uc_chunks_slug"),
+            want: false,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            assert.Equal(t, isDuplicateSlug(tt.err), tt.want)
+        })
+    }
+}
+
+func TestInsertCustomSlug(t *testing.T) {
+    db := newTestDB(t)
+    m := &ChunkModel{DB: db, SlugLength: 12}
+    ctx := context.Background()
+    files := []*File{{Name: "Makefile", Content: "dev:", ContentType: ContentTypeCode}}
+    owner := Owner{IP: "203.0.113.7"}
+
+    slug, err := m.Insert(ctx, owner, "Dev setup", "dev-setup", files, 7, 0, false)
+    assert.NilError(t, err)
+    assert.Equal(t, slug, "dev-setup")
+
+    // A live chunk keeps its slug.
+    _, err = m.Insert(ctx, owner, "Another", "dev-setup", files, 7, 0, false)
+    assert.Equal(t, err, ErrDuplicateSlug)
+
+    // An expired one gives it up to the next chunk which asks for it, and
+    // is renamed to "~" and its id.
+    _, err = db.Exec(`UPDATE chunks SET expires = DATE_SUB(UTC_TIMESTAMP(), INTERVAL 1 DAY) WHERE slug = 'dev-setup'`)
+    assert.NilError(t, err)
+    slug, err = m.Insert(ctx, owner, "New dev setup", "dev-setup", files, 7, 0, false)
+    assert.NilError(t, err)
+    assert.Equal(t, slug, "dev-setup")
+    c, err := m.GetBySlug(ctx, "dev-setup", 0)
+    assert.NilError(t, err)
+    assert.Equal(t, c.Title, "New dev setup")
+
+    var oldSlug string
+    err = db.QueryRow(`SELECT slug FROM chunks WHERE title = 'Dev setup'`).Scan(&oldSlug)
+    assert.NilError(t, err)
+    assert.Equal(t, oldSlug, "~1")
+
+    // Without a custom slug the chunk gets a random one of the model's
+    // length.
+    slug, err = m.Insert(ctx, owner, "Random", "", files, 7, 0, false)
+    assert.NilError(t, err)
+    assert.Equal(t, len(slug), 12)
+}
@@ -0,0 +1,92 @@
+package models
+
+import (
+    "context"
+    "database/sql"
+    "os"
+    "testing"
+)
+
+// newTestDB connects to the test database named by the CHUNKBOX_TEST_DSN
+// environment variable, like "test_web:pass@/test_chunkbox?parseTime=true",
+// and migrates it. Without the variable the test is skipped.
+func newTestDB(t *testing.T) *sql.DB {
+    t.Helper()
+
+    db := newEmptyTestDB(t)
+    _, err := (&MigrationModel{DB: db}).Migrate(context.Background())
+    if err != nil {
+        t.Fatal(err)
+    }
+    return db
+}
+
+// newEmptyTestDB is like newTestDB, but leaves the database empty. Every
+// table in it is dropped before the test and again when it finishes, so it
+// must be a database which is used for nothing else.
+func newEmptyTestDB(t *testing.T) *sql.DB {
+    t.Helper()
+
+    dsn := os.Getenv("CHUNKBOX_TEST_DSN")
+    if dsn == "" {
+        t.Skip("CHUNKBOX_TEST_DSN isn't set")
+    }
+
+    db, err := sql.Open("mysql", dsn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    dropTables(t, db)
+    t.Cleanup(func() {
+        dropTables(t, db)
+        db.Close()
+    })
+    return db
+}
+
+// dropTables drops every table in the test database. The foreign key checks
+// are turned off on the connection doing it, so the order doesn't matter.
+func dropTables(t *testing.T, db *sql.DB) {
+    t.Helper()
+
+    ctx := context.Background()
+    conn, err := db.Conn(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    rows, err := conn.QueryContext(ctx, `SELECT table_name FROM information_schema.tables
+    WHERE table_schema = DATABASE()`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var tables []string
+    for rows.Next() {
+        var table string
+        err = rows.Scan(&table)
+        if err != nil {
+            t.Fatal(err)
+        }
+        tables = append(tables, table)
+    }
+    rows.Close()
+    if err = rows.Err(); err != nil {
+        t.Fatal(err)
+    }
+
+    _, err = conn.ExecContext(ctx, `SET FOREIGN_KEY_CHECKS = 0`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, table := range tables {
+        _, err = conn.ExecContext(ctx, "DROP TABLE `"+table+"`")
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    _, err = conn.ExecContext(ctx, `SET FOREIGN_KEY_CHECKS = 1`)
+    if err != nil {
+        t.Fatal(err)
+    }
+}
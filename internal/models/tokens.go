@@ -0,0 +1,198 @@
+package models
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/base64"
+    "errors"
+    "strings"
+    "time"
+)
+
+// The scopes an API token can have. A token can only be used for what its
+// scopes allow.
+const (
+    ScopeRead   = "read"
+    ScopeWrite  = "write"
+    ScopeDelete = "delete"
+)
+
+// Scopes lists all the scopes, in the order they are shown.
+var Scopes = []string{ScopeRead, ScopeWrite, ScopeDelete}
+
+// TokenPrefix starts every API token, which makes them easy to recognise,
+// for example by secret scanners.
+const TokenPrefix = "cbx_"
+
+// Token is a personal API token. The token itself is only known when it is
+// created; after that we only have its hash.
+type Token struct {
+    ID       int
+    UserID   int
+    Name     string
+    Scopes   []string
+    Created  time.Time
+    LastUsed time.Time // zero if never used
+    Expires  time.Time // zero if it never expires
+}
+
+// HasScope reports whether the token has the given scope.
+func (t *Token) HasScope(scope string) bool {
+    for _, s := range t.Scopes {
+        if s == scope {
+            return true
+        }
+    }
+    return false
+}
+
+// TokenModel wraps the api_tokens table.
+type TokenModel struct {
+    DB *sql.DB
+    // Timeout limits how long each method may spend waiting on the
+    // database, like ChunkModel.Timeout.
+    Timeout time.Duration
+}
+
+func (m *TokenModel) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+    if m.Timeout == 0 {
+        return context.WithCancel(ctx)
+    }
+    return context.WithTimeout(ctx, m.Timeout)
+}
+
+// hashToken returns the hash of a token which is stored in the database.
+// The tokens are random, so a fast hash like SHA-256 is enough: there is no
+// dictionary to guess them from.
+func hashToken(plaintext string) []byte {
+    hash := sha256.Sum256([]byte(plaintext))
+    return hash[:]
+}
+
+// Insert creates a new token for the user and returns it. This is the only
+// time the token itself is available. If expires is zero the token never
+// expires.
+func (m *TokenModel) Insert(ctx context.Context, userID int, name string, scopes []string, expires time.Time) (string, error) {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    b := make([]byte, 32)
+    _, err := rand.Read(b)
+    if err != nil {
+        return "", err
+    }
+    plaintext := TokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+    stmt := `INSERT INTO api_tokens (user_id, name, hash, scopes, created, expires)
+    VALUES(?, ?, ?, ?, UTC_TIMESTAMP(), ?)`
+    exp := sql.NullTime{Time: expires.UTC(), Valid: !expires.IsZero()}
+
+    _, err = m.DB.ExecContext(ctx, stmt, userID, name, hashToken(plaintext), strings.Join(scopes, ","), exp)
+    if err != nil {
+        return "", err
+    }
+    return plaintext, nil
+}
+
+// ForUser returns the tokens of a user, newest first, including expired
+// ones so the user can see them and tidy up.
+func (m *TokenModel) ForUser(ctx context.Context, userID int) ([]*Token, error) {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    stmt := `SELECT id, user_id, name, scopes, created, last_used, expires
+    FROM api_tokens WHERE user_id = ? ORDER BY id DESC`
+
+    rows, err := m.DB.QueryContext(ctx, stmt, userID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    tokens := []*Token{}
+    for rows.Next() {
+        t, err := scanToken(rows)
+        if err != nil {
+            return nil, err
+        }
+        tokens = append(tokens, t)
+    }
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+    return tokens, nil
+}
+
+// Revoke deletes one of the user's tokens. It returns ErrNoRecord if the
+// user has no token with that ID.
+func (m *TokenModel) Revoke(ctx context.Context, userID int, id int) error {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    result, err := m.DB.ExecContext(ctx, `DELETE FROM api_tokens WHERE id = ? AND user_id = ?`, id, userID)
+    if err != nil {
+        return err
+    }
+    n, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        return ErrNoRecord
+    }
+    return nil
+}
+
+// Authenticate returns the unexpired token matching the plaintext, or
+// ErrInvalidCredentials if there isn't one (or its user is disabled), and
+// records that it was used.
+func (m *TokenModel) Authenticate(ctx context.Context, plaintext string) (*Token, error) {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    // The tokens of disabled users don't work either.
+    stmt := `SELECT t.id, t.user_id, t.name, t.scopes, t.created, t.last_used, t.expires
+    FROM api_tokens t JOIN users u ON u.id = t.user_id
+    WHERE t.hash = ? AND (t.expires IS NULL OR t.expires > UTC_TIMESTAMP()) AND NOT u.disabled`
+
+    t, err := scanToken(m.DB.QueryRowContext(ctx, stmt, hashToken(plaintext)))
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            return nil, ErrInvalidCredentials
+        }
+        return nil, err
+    }
+
+    // A script may use its token many times a second, so last_used is
+    // only brought up to date once a minute to spare the database.
+    stmt = `UPDATE api_tokens SET last_used = UTC_TIMESTAMP()
+    WHERE id = ? AND (last_used IS NULL OR last_used < UTC_TIMESTAMP() - INTERVAL 1 MINUTE)`
+    _, err = m.DB.ExecContext(ctx, stmt, t.ID)
+    if err != nil {
+        return nil, err
+    }
+    return t, nil
+}
+
+// scanner is what sql.Row and sql.Rows have in common.
+type scanner interface {
+    Scan(dest ...any) error
+}
+
+func scanToken(row scanner) (*Token, error) {
+    t := &Token{}
+    var scopes string
+    var lastUsed, expires sql.NullTime
+    err := row.Scan(&t.ID, &t.UserID, &t.Name, &scopes, &t.Created, &lastUsed, &expires)
+    if err != nil {
+        return nil, err
+    }
+    if scopes != "" {
+        t.Scopes = strings.Split(scopes, ",")
+    }
+    t.LastUsed = lastUsed.Time
+    t.Expires = expires.Time
+    return t, nil
+}
@@ -0,0 +1,93 @@
+package models
+
+import (
+    "context"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/cpucortexm/chunkbox/internal/assert"
+)
+
+func TestTokenModel(t *testing.T) {
+    db := newTestDB(t)
+    users := &UserModel{DB: db}
+    m := &TokenModel{DB: db}
+    ctx := context.Background()
+
+    err := users.Insert(ctx, "Alice", "alice@example.com", "pa55word!")
+    assert.NilError(t, err)
+    userID, err := users.Authenticate(ctx, "alice@example.com", "pa55word!")
+    assert.NilError(t, err)
+
+    plaintext, err := m.Insert(ctx, userID, "Deploy script", []string{ScopeRead, ScopeWrite}, time.Time{})
+    assert.NilError(t, err)
+    assert.Equal(t, strings.HasPrefix(plaintext, TokenPrefix), true)
+
+    token, err := m.Authenticate(ctx, plaintext)
+    assert.NilError(t, err)
+    assert.Equal(t, token.UserID, userID)
+    assert.Equal(t, token.Name, "Deploy script")
+    assert.Equal(t, token.HasScope(ScopeWrite), true)
+    assert.Equal(t, token.HasScope(ScopeDelete), false)
+
+    // Using the token is recorded.
+    tokens, err := m.ForUser(ctx, userID)
+    assert.NilError(t, err)
+    assert.Equal(t, len(tokens), 1)
+    assert.Equal(t, tokens[0].LastUsed.IsZero(), false)
+
+    tests := []struct {
+        name      string
+        plaintext string
+    }{
+        {
+            name:      "Unknown token",
+            plaintext: TokenPrefix + "not-a-real-token",
+        },
+        {
+            name:      "Token without its prefix",
+            plaintext: strings.TrimPrefix(plaintext, TokenPrefix),
+        },
+        {
+            name:      "Empty token",
+            plaintext: "",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, err := m.Authenticate(ctx, tt.plaintext)
+            assert.Equal(t, err, ErrInvalidCredentials)
+        })
+    }
+
+    // An expired token no longer works, but is still listed.
+    expired, err := m.Insert(ctx, userID, "Old", []string{ScopeRead}, time.Now().Add(-time.Hour))
+    assert.NilError(t, err)
+    _, err = m.Authenticate(ctx, expired)
+    assert.Equal(t, err, ErrInvalidCredentials)
+    tokens, err = m.ForUser(ctx, userID)
+    assert.NilError(t, err)
+    assert.Equal(t, len(tokens), 2)
+
+    // The tokens of a disabled user stop working until they are enabled.
+    err = users.SetDisabled(ctx, userID, true)
+    assert.NilError(t, err)
+    _, err = m.Authenticate(ctx, plaintext)
+    assert.Equal(t, err, ErrInvalidCredentials)
+    err = users.SetDisabled(ctx, userID, false)
+    assert.NilError(t, err)
+    _, err = m.Authenticate(ctx, plaintext)
+    assert.NilError(t, err)
+
+    // Only the owner of a token can revoke it, and then it stops working.
+    err = m.Revoke(ctx, userID+1, token.ID)
+    assert.Equal(t, err, ErrNoRecord)
+    err = m.Revoke(ctx, userID, token.ID)
+    assert.NilError(t, err)
+    _, err = m.Authenticate(ctx, plaintext)
+    assert.Equal(t, err, ErrInvalidCredentials)
+    err = m.Revoke(ctx, userID, token.ID)
+    assert.Equal(t, err, ErrNoRecord)
+}
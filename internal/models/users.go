@@ -0,0 +1,382 @@
+package models
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "strings"
+    "time"
+
+    "github.com/go-sql-driver/mysql"
+    "golang.org/x/crypto/bcrypt"
+)
+
+// The roles a user can have. Each role may do everything the roles before
+// it may: moderators look after the chunks, admins also look after the
+// users and the system.
+const (
+    RoleUser      = "user"
+    RoleModerator = "moderator"
+    RoleAdmin     = "admin"
+)
+
+// Roles lists all the roles, from the least to the most powerful.
+var Roles = []string{RoleUser, RoleModerator, RoleAdmin}
+
+// RoleAllows reports whether a user with the role may do what the required
+// role may. An unknown role allows nothing.
+func RoleAllows(role, required string) bool {
+    rank := func(r string) int {
+        for i, known := range Roles {
+            if r == known {
+                return i
+            }
+        }
+        return -1
+    }
+    return rank(role) >= 0 && rank(role) >= rank(required)
+}
+
+// Define a new User type. Notice how the field names and types align
+// with the columns in the database "users" table?
+type User struct {
+    ID             int
+    Name           string
+    Email          string
+    HashedPassword []byte
+    Created        time.Time
+    Role           string
+    Disabled       bool
+}
+
+// UserModelInterface lists the methods of UserModel which the web
+// application uses, so that its handlers can be tested with a mock instead
+// of a database, see the mocks package.
+type UserModelInterface interface {
+    Insert(ctx context.Context, name, email, password string) error
+    Authenticate(ctx context.Context, email, password string) (int, error)
+    Get(ctx context.Context, id int) (*User, error)
+    Provision(ctx context.Context, issuer, subject, name, email string) (int, error)
+    LinkIdentity(ctx context.Context, userID int, issuer, subject string) error
+    Search(ctx context.Context, query string, limit, offset int) ([]*User, bool, error)
+    SetRole(ctx context.Context, id int, role string) error
+    SetDisabled(ctx context.Context, id int, disabled bool) error
+    Counts(ctx context.Context) (total int, disabled int, err error)
+}
+
+// Define a new UserModel type which wraps a database connection pool.
+type UserModel struct {
+    DB *sql.DB
+    // Timeout limits how long each method may spend waiting on the
+    // database, like ChunkModel.Timeout.
+    Timeout time.Duration
+}
+
+func (m *UserModel) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+    if m.Timeout == 0 {
+        return context.WithCancel(ctx)
+    }
+    return context.WithTimeout(ctx, m.Timeout)
+}
+
+// We'll use the Insert method to add a new record to the "users" table.
+func (m *UserModel) Insert(ctx context.Context, name, email, password string) error {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    // Create a bcrypt hash of the plain-text password.
+    hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+    if err != nil {
+        return err
+    }
+
+    stmt := `INSERT INTO users (name, email, hashed_password, created)
+    VALUES(?, ?, ?, UTC_TIMESTAMP())`
+
+    // Use the ExecContext() method to insert the user details and hashed
+    // password into the users table.
+    _, err = m.DB.ExecContext(ctx, stmt, name, email, string(hashedPassword))
+    if err != nil {
+        // If this returns an error, we use the errors.As() function to check
+        // whether the error has the type *mysql.MySQLError. If it does, the
+        // error will be assigned to the mySQLError variable. We can then check
+        // whether or not the error relates to our uc_users_email key by
+        // checking if the error code equals 1062 and the contents of the error
+        // message string. If it does, we return an ErrDuplicateEmail error.
+        var mySQLError *mysql.MySQLError
+        if errors.As(err, &mySQLError) {
+            if mySQLError.Number == 1062 && strings.Contains(mySQLError.Message, "uc_users_email") {
+                return ErrDuplicateEmail
+            }
+        }
+        return err
+    }
+    return nil
+}
+
+// We'll use the Authenticate method to verify whether a user exists with
+// the provided email address and password. This will return the relevant
+// user ID if they do.
+func (m *UserModel) Authenticate(ctx context.Context, email, password string) (int, error) {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    // Retrieve the id and hashed password associated with the given email. If
+    // no matching email exists we return the ErrInvalidCredentials error.
+    var id int
+    var hashedPassword []byte
+    var disabled bool
+
+    stmt := "SELECT id, hashed_password, disabled FROM users WHERE email = ?"
+
+    err := m.DB.QueryRowContext(ctx, stmt, email).Scan(&id, &hashedPassword, &disabled)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            return 0, ErrInvalidCredentials
+        } else {
+            return 0, err
+        }
+    }
+
+    // Users who signed up through single sign-on have no password, and can
+    // only log in that way.
+    if hashedPassword == nil {
+        return 0, ErrInvalidCredentials
+    }
+
+    // Check whether the hashed password and plain-text password provided match.
+    // If they don't, we return the ErrInvalidCredentials error.
+    err = bcrypt.CompareHashAndPassword(hashedPassword, []byte(password))
+    if err != nil {
+        if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+            return 0, ErrInvalidCredentials
+        } else {
+            return 0, err
+        }
+    }
+
+    // The password is correct, but a disabled user still can't log in. We
+    // only say so once they have proved who they are.
+    if disabled {
+        return 0, ErrUserDisabled
+    }
+
+    // Otherwise, the password is correct. Return the user ID.
+    return id, nil
+}
+
+// Get returns the user with the given ID.
+func (m *UserModel) Get(ctx context.Context, id int) (*User, error) {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    stmt := `SELECT id, name, email, created, role, disabled FROM users WHERE id = ?`
+
+    u := &User{}
+    err := m.DB.QueryRowContext(ctx, stmt, id).Scan(&u.ID, &u.Name, &u.Email, &u.Created, &u.Role, &u.Disabled)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            return nil, ErrNoRecord
+        }
+        return nil, err
+    }
+    return u, nil
+}
+
+// Provision returns the ID of the user with the given identity at a single
+// sign-on provider, known by the issuer and subject of their ID tokens. A
+// user logging in for the first time gets a new account (without a
+// password), unless there is already a user with the same email address.
+// A user without a password, who could only have signed up through single
+// sign-on, is linked to the identity; one with a password gets
+// ErrLinkRequired, as only they may link it, see LinkIdentity. The caller
+// must have checked that the provider vouches for the email address.
+// Disabled users get ErrUserDisabled.
+func (m *UserModel) Provision(ctx context.Context, issuer, subject, name, email string) (int, error) {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    tx, err := m.DB.BeginTx(ctx, nil)
+    if err != nil {
+        return 0, err
+    }
+    // Rollback() is a no-op once the transaction has been committed.
+    defer tx.Rollback()
+
+    var id int
+    var disabled bool
+    stmt := `SELECT u.id, u.disabled FROM user_identities i JOIN users u ON u.id = i.user_id
+    WHERE i.issuer = ? AND i.subject = ?`
+    err = tx.QueryRowContext(ctx, stmt, issuer, subject).Scan(&id, &disabled)
+    if err == nil {
+        if disabled {
+            return 0, ErrUserDisabled
+        }
+        return id, nil
+    }
+    if !errors.Is(err, sql.ErrNoRows) {
+        return 0, err
+    }
+
+    var hasPassword bool
+    stmt = `SELECT id, disabled, hashed_password IS NOT NULL FROM users WHERE email = ? FOR UPDATE`
+    err = tx.QueryRowContext(ctx, stmt, email).Scan(&id, &disabled, &hasPassword)
+    if errors.Is(err, sql.ErrNoRows) {
+        stmt = `INSERT INTO users (name, email, hashed_password, created)
+        VALUES(?, ?, NULL, UTC_TIMESTAMP())`
+        result, err := tx.ExecContext(ctx, stmt, name, email)
+        if err != nil {
+            return 0, err
+        }
+        newID, err := result.LastInsertId()
+        if err != nil {
+            return 0, err
+        }
+        id = int(newID)
+    } else if err != nil {
+        return 0, err
+    } else if disabled {
+        return 0, ErrUserDisabled
+    } else if hasPassword {
+        return 0, ErrLinkRequired
+    }
+
+    stmt = `INSERT INTO user_identities (user_id, issuer, subject, created)
+    VALUES(?, ?, ?, UTC_TIMESTAMP())`
+    _, err = tx.ExecContext(ctx, stmt, id, issuer, subject)
+    if err != nil {
+        return 0, err
+    }
+    return id, tx.Commit()
+}
+
+// LinkIdentity links an identity at a single sign-on provider to a user,
+// so that they can log in with it from then on. It is for users who have
+// confirmed the link while logged in, see Provision. Linking an identity
+// to the user it already belongs to does nothing; if it belongs to another
+// user we return ErrIdentityTaken.
+func (m *UserModel) LinkIdentity(ctx context.Context, userID int, issuer, subject string) error {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    stmt := `INSERT INTO user_identities (user_id, issuer, subject, created)
+    VALUES(?, ?, ?, UTC_TIMESTAMP())`
+    _, err := m.DB.ExecContext(ctx, stmt, userID, issuer, subject)
+    if err == nil {
+        return nil
+    }
+    var mySQLError *mysql.MySQLError
+    if !errors.As(err, &mySQLError) || mySQLError.Number != 1062 {
+        return err
+    }
+
+    var owner int
+    stmt = `SELECT user_id FROM user_identities WHERE issuer = ? AND subject = ?`
+    err = m.DB.QueryRowContext(ctx, stmt, issuer, subject).Scan(&owner)
+    if err != nil {
+        return err
+    }
+    if owner != userID {
+        return ErrIdentityTaken
+    }
+    return nil
+}
+
+// Search returns the users whose name or email address contains the query,
+// or all users if it is empty, oldest first. It returns at most limit users
+// after skipping offset of them, and whether there are more.
+func (m *UserModel) Search(ctx context.Context, query string, limit, offset int) ([]*User, bool, error) {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    stmt := `SELECT id, name, email, created, role, disabled FROM users
+    WHERE name LIKE ? OR email LIKE ? ORDER BY id LIMIT ? OFFSET ?`
+    pattern := likePattern(query)
+
+    // Ask for one more than we need, to find out whether there are more.
+    rows, err := m.DB.QueryContext(ctx, stmt, pattern, pattern, limit+1, offset)
+    if err != nil {
+        return nil, false, err
+    }
+    defer rows.Close()
+
+    users := []*User{}
+    for rows.Next() {
+        u := &User{}
+        err = rows.Scan(&u.ID, &u.Name, &u.Email, &u.Created, &u.Role, &u.Disabled)
+        if err != nil {
+            return nil, false, err
+        }
+        users = append(users, u)
+    }
+    if err = rows.Err(); err != nil {
+        return nil, false, err
+    }
+    if len(users) > limit {
+        return users[:limit], true, nil
+    }
+    return users, false, nil
+}
+
+// SetRole changes the role of a user. It returns ErrNoRecord if there is
+// no such user.
+func (m *UserModel) SetRole(ctx context.Context, id int, role string) error {
+    return m.update(ctx, "role", role, "id", id)
+}
+
+// SetRoleByEmail changes the role of the user with the email address. It
+// returns ErrNoRecord if there is no such user.
+func (m *UserModel) SetRoleByEmail(ctx context.Context, email string, role string) error {
+    return m.update(ctx, "role", role, "email", email)
+}
+
+// SetDisabled disables or enables a user. It returns ErrNoRecord if there
+// is no such user.
+func (m *UserModel) SetDisabled(ctx context.Context, id int, disabled bool) error {
+    return m.update(ctx, "disabled", disabled, "id", id)
+}
+
+// update sets a column of the user whose key column has the given value.
+// Both columns are constants chosen by the caller, never user input. The
+// user is looked up first, as MySQL only counts the rows an UPDATE changed,
+// so giving a user the role they already have would look like a missing
+// user.
+func (m *UserModel) update(ctx context.Context, column string, value any, key string, keyValue any) error {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    var exists bool
+    stmt := `SELECT EXISTS(SELECT true FROM users WHERE ` + key + ` = ?)`
+    err := m.DB.QueryRowContext(ctx, stmt, keyValue).Scan(&exists)
+    if err != nil {
+        return err
+    }
+    if !exists {
+        return ErrNoRecord
+    }
+
+    stmt = `UPDATE users SET ` + column + ` = ? WHERE ` + key + ` = ?`
+    _, err = m.DB.ExecContext(ctx, stmt, value, keyValue)
+    return err
+}
+
+// Counts returns the number of users, and how many of them are disabled.
+func (m *UserModel) Counts(ctx context.Context) (total int, disabled int, err error) {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    stmt := `SELECT COUNT(*), COALESCE(SUM(disabled), 0) FROM users`
+
+    err = m.DB.QueryRowContext(ctx, stmt).Scan(&total, &disabled)
+    if err != nil {
+        return 0, 0, err
+    }
+    return total, disabled, nil
+}
+
+// likePattern returns a LIKE pattern matching strings which contain s. The
+// wildcards in s itself are escaped, so they only match themselves.
+func likePattern(s string) string {
+    s = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+    return "%" + s + "%"
+}
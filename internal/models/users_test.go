@@ -0,0 +1,37 @@
+package models
+
+import (
+    "context"
+    "testing"
+
+    "github.com/cpucortexm/chunkbox/internal/assert"
+)
+
+func TestUserModel(t *testing.T) {
+    m := &UserModel{DB: newTestDB(t)}
+    ctx := context.Background()
+
+    err := m.Insert(ctx, "Alice", "alice@example.com", "pa55word!")
+    assert.NilError(t, err)
+
+    // Email addresses are unique.
+    err = m.Insert(ctx, "Another Alice", "alice@example.com", "pa55word!")
+    assert.Equal(t, err, ErrDuplicateEmail)
+
+    id, err := m.Authenticate(ctx, "alice@example.com", "pa55word!")
+    assert.NilError(t, err)
+
+    u, err := m.Get(ctx, id)
+    assert.NilError(t, err)
+    assert.Equal(t, u.Name, "Alice")
+    assert.Equal(t, u.Email, "alice@example.com")
+
+    // A wrong password and an unknown email address look the same.
+    _, err = m.Authenticate(ctx, "alice@example.com", "wrong password")
+    assert.Equal(t, err, ErrInvalidCredentials)
+    _, err = m.Authenticate(ctx, "bob@example.com", "pa55word!")
+    assert.Equal(t, err, ErrInvalidCredentials)
+
+    _, err = m.Get(ctx, id+1)
+    assert.Equal(t, err, ErrNoRecord)
+}
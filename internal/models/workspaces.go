@@ -0,0 +1,285 @@
+package models
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "strings"
+    "time"
+
+    "github.com/go-sql-driver/mysql"
+)
+
+// The roles a member of a workspace can have. Every member can create
+// chunks in the workspace and delete its chunks, whoever created them;
+// owners can also add and remove members and change their roles.
+const (
+    WorkspaceMember = "member"
+    WorkspaceOwner  = "owner"
+)
+
+// WorkspaceRoles lists the roles a member of a workspace can have.
+var WorkspaceRoles = []string{WorkspaceMember, WorkspaceOwner}
+
+// Workspace is a team of users who own chunks together.
+type Workspace struct {
+    ID      int
+    Name    string
+    Slug    string // URL-safe name, used in links like /w/:slug
+    Created time.Time
+    Role    string // the role of the user the workspace was fetched for
+}
+
+// IsOwner reports whether the user the workspace was fetched for is one of
+// its owners.
+func (w *Workspace) IsOwner() bool {
+    return w.Role == WorkspaceOwner
+}
+
+// Member is a user who belongs to a workspace.
+type Member struct {
+    UserID int
+    Name   string
+    Email  string
+    Role   string
+    Joined time.Time
+}
+
+// WorkspaceModel wraps a database connection pool.
+type WorkspaceModel struct {
+    DB *sql.DB
+    // Timeout limits how long each method may spend waiting on the
+    // database, like ChunkModel.Timeout.
+    Timeout time.Duration
+}
+
+func (m *WorkspaceModel) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+    if m.Timeout == 0 {
+        return context.WithCancel(ctx)
+    }
+    return context.WithTimeout(ctx, m.Timeout)
+}
+
+// Insert creates a workspace, with the user as its first owner. It returns
+// ErrDuplicateSlug if another workspace already has the slug.
+func (m *WorkspaceModel) Insert(ctx context.Context, userID int, name, slug string) error {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    tx, err := m.DB.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    stmt := `INSERT INTO workspaces (name, slug, created) VALUES(?, ?, UTC_TIMESTAMP())`
+    result, err := tx.ExecContext(ctx, stmt, name, slug)
+    if err != nil {
+        var mySQLError *mysql.MySQLError
+        if errors.As(err, &mySQLError) {
+            if mySQLError.Number == 1062 && strings.Contains(mySQLError.Message, "uc_workspaces_slug") {
+                return ErrDuplicateSlug
+            }
+        }
+        return err
+    }
+    id, err := result.LastInsertId()
+    if err != nil {
+        return err
+    }
+
+    stmt = `INSERT INTO workspace_members (workspace_id, user_id, role, created)
+    VALUES(?, ?, ?, UTC_TIMESTAMP())`
+    _, err = tx.ExecContext(ctx, stmt, id, userID, WorkspaceOwner)
+    if err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// Get returns the workspace with the given slug, along with the role the
+// user has in it. It returns ErrNoRecord if the user isn't a member, so that
+// nobody can find out about workspaces they don't belong to.
+func (m *WorkspaceModel) Get(ctx context.Context, slug string, userID int) (*Workspace, error) {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    stmt := `SELECT w.id, w.name, w.slug, w.created, wm.role
+    FROM workspaces w JOIN workspace_members wm ON wm.workspace_id = w.id
+    WHERE w.slug = ? AND wm.user_id = ?`
+
+    ws := &Workspace{}
+    err := m.DB.QueryRowContext(ctx, stmt, slug, userID).Scan(&ws.ID, &ws.Name, &ws.Slug, &ws.Created, &ws.Role)
+    if err != nil {
+        if errors.Is(err, sql.ErrNoRows) {
+            return nil, ErrNoRecord
+        }
+        return nil, err
+    }
+    return ws, nil
+}
+
+// ForUser returns the workspaces the user belongs to, by name.
+func (m *WorkspaceModel) ForUser(ctx context.Context, userID int) ([]*Workspace, error) {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    stmt := `SELECT w.id, w.name, w.slug, w.created, wm.role
+    FROM workspaces w JOIN workspace_members wm ON wm.workspace_id = w.id
+    WHERE wm.user_id = ? ORDER BY w.name, w.id`
+
+    rows, err := m.DB.QueryContext(ctx, stmt, userID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    workspaces := []*Workspace{}
+    for rows.Next() {
+        ws := &Workspace{}
+        err = rows.Scan(&ws.ID, &ws.Name, &ws.Slug, &ws.Created, &ws.Role)
+        if err != nil {
+            return nil, err
+        }
+        workspaces = append(workspaces, ws)
+    }
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+    return workspaces, nil
+}
+
+// Members returns the members of a workspace, owners first.
+func (m *WorkspaceModel) Members(ctx context.Context, workspaceID int) ([]*Member, error) {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    stmt := `SELECT u.id, u.name, u.email, wm.role, wm.created
+    FROM workspace_members wm JOIN users u ON u.id = wm.user_id
+    WHERE wm.workspace_id = ? ORDER BY wm.role = ? DESC, u.name, u.id`
+
+    rows, err := m.DB.QueryContext(ctx, stmt, workspaceID, WorkspaceOwner)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    members := []*Member{}
+    for rows.Next() {
+        mb := &Member{}
+        err = rows.Scan(&mb.UserID, &mb.Name, &mb.Email, &mb.Role, &mb.Joined)
+        if err != nil {
+            return nil, err
+        }
+        members = append(members, mb)
+    }
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+    return members, nil
+}
+
+// AddMember adds the user with the email address to a workspace, with the
+// given role. It returns ErrNoRecord if there is no such user, and
+// ErrAlreadyMember if they already belong to the workspace.
+func (m *WorkspaceModel) AddMember(ctx context.Context, workspaceID int, email, role string) error {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    stmt := `INSERT INTO workspace_members (workspace_id, user_id, role, created)
+    SELECT ?, id, ?, UTC_TIMESTAMP() FROM users WHERE email = ?`
+
+    result, err := m.DB.ExecContext(ctx, stmt, workspaceID, role, email)
+    if err != nil {
+        var mySQLError *mysql.MySQLError
+        if errors.As(err, &mySQLError) && mySQLError.Number == 1062 {
+            return ErrAlreadyMember
+        }
+        return err
+    }
+    n, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        return ErrNoRecord
+    }
+    return nil
+}
+
+// SetMemberRole changes the role of a member of a workspace. It returns
+// ErrNoRecord if the user isn't a member, and ErrLastOwner if it would
+// leave the workspace without an owner.
+func (m *WorkspaceModel) SetMemberRole(ctx context.Context, workspaceID, userID int, role string) error {
+    return m.changeMember(ctx, workspaceID, userID, role)
+}
+
+// RemoveMember takes a user out of a workspace. It returns ErrNoRecord if
+// the user isn't a member, and ErrLastOwner if they are its only owner.
+// The chunks they created in the workspace stay there.
+func (m *WorkspaceModel) RemoveMember(ctx context.Context, workspaceID, userID int) error {
+    return m.changeMember(ctx, workspaceID, userID, "")
+}
+
+// changeMember gives a member of a workspace a new role, or removes them
+// if the role is empty. The members are locked while we check that there
+// is still an owner afterwards, so that two owners can't both step down at
+// once.
+func (m *WorkspaceModel) changeMember(ctx context.Context, workspaceID, userID int, role string) error {
+    ctx, cancel := m.withTimeout(ctx)
+    defer cancel()
+
+    tx, err := m.DB.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    stmt := `SELECT user_id, role FROM workspace_members WHERE workspace_id = ? FOR UPDATE`
+    rows, err := tx.QueryContext(ctx, stmt, workspaceID)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    found := false
+    owners := 0
+    for rows.Next() {
+        var id int
+        var current string
+        err = rows.Scan(&id, &current)
+        if err != nil {
+            return err
+        }
+        if id == userID {
+            found = true
+            current = role
+        }
+        if current == WorkspaceOwner {
+            owners++
+        }
+    }
+    if err = rows.Err(); err != nil {
+        return err
+    }
+    rows.Close()
+
+    if !found {
+        return ErrNoRecord
+    }
+    if owners == 0 {
+        return ErrLastOwner
+    }
+
+    if role == "" {
+        stmt = `DELETE FROM workspace_members WHERE workspace_id = ? AND user_id = ?`
+        _, err = tx.ExecContext(ctx, stmt, workspaceID, userID)
+    } else {
+        stmt = `UPDATE workspace_members SET role = ? WHERE workspace_id = ? AND user_id = ?`
+        _, err = tx.ExecContext(ctx, stmt, role, workspaceID, userID)
+    }
+    if err != nil {
+        return err
+    }
+    return tx.Commit()
+}
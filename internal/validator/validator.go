@@ -0,0 +1,94 @@
+package validator
+
+import (
+    "regexp"
+    "strings"
+    "unicode/utf8"
+)
+
+// Use the regexp.MustCompile() function to parse a regular expression pattern
+// for sanity checking the format of an email address. This returns a pointer to
+// a 'compiled' regexp.Regexp type, or panics in the event of an error. Parsing
+// this pattern once at startup and storing the compiled *regexp.Regexp in a
+// variable is more performant than re-parsing the pattern each time we need it.
+var EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
+
+// Define a new Validator type which contains a map of validation errors for
+// our form fields, and a slice for errors which aren't about one field.
+type Validator struct {
+    NonFieldErrors []string
+    FieldErrors    map[string]string
+}
+
+// Valid() returns true if there are no errors at all.
+func (v *Validator) Valid() bool {
+    return len(v.FieldErrors) == 0 && len(v.NonFieldErrors) == 0
+}
+
+// AddNonFieldError() adds an error message to the NonFieldErrors slice.
+func (v *Validator) AddNonFieldError(message string) {
+    v.NonFieldErrors = append(v.NonFieldErrors, message)
+}
+
+// AddFieldError() adds an error message to the FieldErrors map (so long as no
+// entry already exists for the given key).
+func (v *Validator) AddFieldError(key, message string) {
+    // Note: We need to initialize the map first, if it isn't already
+    // initialized.
+    if v.FieldErrors == nil {
+        v.FieldErrors = make(map[string]string)
+    }
+
+    if _, exists := v.FieldErrors[key]; !exists {
+        v.FieldErrors[key] = message
+    }
+}
+
+// CheckField() adds an error message to the FieldErrors map only if a
+// validation check is not 'ok'.
+func (v *Validator) CheckField(ok bool, key, message string) {
+    if !ok {
+        v.AddFieldError(key, message)
+    }
+}
+
+// NotBlank() returns true if a value is not an empty string.
+func NotBlank(value string) bool {
+    return strings.TrimSpace(value) != ""
+}
+
+// MinChars() returns true if a value contains at least n characters.
+func MinChars(value string, n int) bool {
+    return utf8.RuneCountInString(value) >= n
+}
+
+// MaxChars() returns true if a value contains no more than n characters.
+func MaxChars(value string, n int) bool {
+    return utf8.RuneCountInString(value) <= n
+}
+
+// PermittedInt() returns true if a value is in a list of permitted integers.
+func PermittedInt(value int, permittedValues ...int) bool {
+    for i := range permittedValues {
+        if value == permittedValues[i] {
+            return true
+        }
+    }
+    return false
+}
+
+// PermittedValue() returns true if a value is in a list of permitted strings.
+func PermittedValue(value string, permittedValues ...string) bool {
+    for i := range permittedValues {
+        if value == permittedValues[i] {
+            return true
+        }
+    }
+    return false
+}
+
+// Matches() returns true if a value matches a provided compiled regular
+// expression pattern.
+func Matches(value string, rx *regexp.Regexp) bool {
+    return rx.MatchString(value)
+}
@@ -0,0 +1,12 @@
+package ui
+
+import (
+    "embed"
+)
+
+// Files holds the HTML templates and static assets, embedded into the binary
+// at build time. The paths inside it are relative to this directory, like
+// "html/base.html" and "static/css/main.css".
+//
+//go:embed "html" "static"
+var Files embed.FS
@@ -5,4 +5,96 @@ for (var i = 0; i < navLinks.length; i++) {
         link.classList.add("live");
         break;
     }
-}
\ No newline at end of file
+}
+// Highlight the lines named in the URL fragment of a chunk, either a single
+// line like #L40 or a range like #L40-L55. The line number anchors are
+// rendered server-side with ids of the form L<n> for the first file of a
+// chunk, and F<i>-L<n> (like #F2-L40-L55) for the others.
+function highlightLines() {
+    var previous = document.querySelectorAll(".chroma .line.hl");
+    for (var i = 0; i < previous.length; i++) {
+        previous[i].classList.remove("hl");
+    }
+
+    var match = window.location.hash.match(/^#((?:F\d+-)?L)(\d+)(?:-L(\d+))?$/);
+    if (!match) {
+        return;
+    }
+    var prefix = match[1];
+    var start = parseInt(match[2], 10);
+    var end = match[3] ? parseInt(match[3], 10) : start;
+    if (end < start) {
+        var tmp = start;
+        start = end;
+        end = tmp;
+    }
+
+    for (var n = start; n <= end; n++) {
+        var number = document.getElementById(prefix + n);
+        if (!number) {
+            break;
+        }
+        number.parentNode.classList.add("hl");
+    }
+
+    var first = document.getElementById(prefix + start);
+    if (first) {
+        first.scrollIntoView({block: "center"});
+    }
+}
+
+// Shift-clicking a line number extends the current selection into a range.
+document.addEventListener("click", function (e) {
+    var link = e.target.closest ? e.target.closest(".chroma .ln a") : null;
+    if (!link || !e.shiftKey) {
+        return;
+    }
+    var current = window.location.hash.match(/^#((?:F\d+-)?L)(\d+)/);
+    var clicked = link.getAttribute("href").match(/^#((?:F\d+-)?L)(\d+)$/);
+    // Ranges can't span files.
+    if (!current || !clicked || current[1] !== clicked[1]) {
+        return;
+    }
+    e.preventDefault();
+    var start = Math.min(current[2], clicked[2]);
+    var end = Math.max(current[2], clicked[2]);
+    history.replaceState(null, "", "#" + clicked[1] + start + "-L" + end);
+    highlightLines();
+});
+
+window.addEventListener("hashchange", highlightLines);
+highlightLines();
+
+// On the create page, "Add file" clones the first file of the form with its
+// fields emptied, and "Remove file" removes a file (as long as it isn't the
+// last one).
+var addFile = document.getElementById("add-file");
+if (addFile) {
+    var files = document.getElementById("files");
+
+    addFile.addEventListener("click", function () {
+        var file = files.querySelector(".file").cloneNode(true);
+        var errors = file.querySelectorAll(".error");
+        for (var i = 0; i < errors.length; i++) {
+            errors[i].parentNode.removeChild(errors[i]);
+        }
+        var fields = file.querySelectorAll("input, textarea");
+        for (var i = 0; i < fields.length; i++) {
+            fields[i].value = "";
+        }
+        var selects = file.querySelectorAll("select");
+        for (var i = 0; i < selects.length; i++) {
+            selects[i].selectedIndex = 0;
+        }
+        files.appendChild(file);
+    });
+
+    files.addEventListener("click", function (e) {
+        if (!e.target.classList.contains("remove-file")) {
+            return;
+        }
+        if (files.querySelectorAll(".file").length > 1) {
+            files.removeChild(e.target.closest(".file"));
+        }
+    });
+}